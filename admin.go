@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// MaintenanceResp is our maintenance mode status response struct
+type MaintenanceResp struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// CacheFlushResp is our cache flush response struct
+type CacheFlushResp struct {
+	Flushed int `json:"flushed"`
+}
+
+// maintenanceMode is set while the registry is read-only for backend maintenance
+var maintenanceMode atomic.Bool
+
+// setMaintenance switches maintenance mode on or off, logging the transition
+func setMaintenance(r *http.Request, on bool) {
+	if maintenanceMode.Swap(on) == on {
+		return
+	}
+	msg := "left maintenance mode"
+	if on {
+		msg = "entered maintenance mode"
+	}
+	logger.LogAttrs(r.Context(), slog.LevelWarn, msg, slog.String("request_id", middleware.GetReqID(r.Context())))
+}
+
+// errMaintenance is returned by writes to the backend while in maintenance mode
+var errMaintenance = errors.New("registry is in maintenance mode")
+
+// renderMaintenance responds with a 503 for a request refused in maintenance mode
+func renderMaintenance(w http.ResponseWriter, r *http.Request) {
+	if maintenanceRetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(maintenanceRetryAfter/time.Second)))
+	}
+	renderError(w, r, http.StatusServiceUnavailable, errMaintenance)
+}
+
+// blockInMaintenance is a middleware rejecting requests with a 503 while in maintenance mode,
+// it guards write and admin endpoints so read endpoints keep serving during backend maintenance
+func blockInMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !maintenanceMode.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		renderMaintenance(w, r)
+	})
+}
+
+// maintenanceWriter wraps a WritableBackend to refuse writes while in maintenance mode,
+// so a publish already past blockInMaintenance when maintenance mode is entered doesn't write to the backend
+type maintenanceWriter struct {
+	WritableBackend
+}
+
+// Put implements WritableBackend, returning errMaintenance in maintenance mode
+func (b maintenanceWriter) Put(key string, r io.Reader) error {
+	if maintenanceMode.Load() {
+		return errMaintenance
+	}
+	return b.WritableBackend.Put(key, r)
+}
+
+// requireAdminToken is a middleware restricting admin endpoints to requests carrying -admin-token as a bearer token
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != r.Header.Get("Authorization") && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		renderAuthFailure(w, r)
+	})
+}
+
+// httpMaintenance is a http handler for reading and toggling maintenance mode,
+// PUT enters maintenance mode, DELETE leaves it and GET reports the current mode
+func httpMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		setMaintenance(r, true)
+	case http.MethodDelete:
+		setMaintenance(r, false)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MaintenanceResp{Maintenance: maintenanceMode.Load()})
+}
+
+// listingsOf matches the cache keys of the listings of scope, those below it and those containing it
+func listingsOf(scope string) func(key string) bool {
+	return func(key string) bool {
+		return key == scope || key == "." || strings.HasPrefix(key, scope+"/") || strings.HasPrefix(scope, key+"/")
+	}
+}
+
+// flushListings drops the cached listings whose key matches from every listing cache, returning how many were dropped
+func flushListings(match func(key string) bool) int {
+	return versionsCache.flush(match) + providersCache.flush(match) + providerVersionsCache.flush(match) + modulesCache.flush(match)
+}
+
+// httpFlushCache is a http handler dropping cached listings, so that a newly published module version is listed
+// before the cache expires. The namespace, name and provider params (each requiring the one before) scope the flush
+// to the listings of, below and containing that path, optionally within a tenant's prefix. Without params everything is flushed
+func httpFlushCache(w http.ResponseWriter, r *http.Request) {
+	if versionsCache.ttl <= 0 {
+		renderError(w, r, http.StatusNotFound, errors.New("caching is disabled"))
+		return
+	}
+	q := r.URL.Query()
+	ctx := r.Context()
+	if name := q.Get("tenant"); name != "" {
+		p, ok := tenantPrefixes[name]
+		if !ok {
+			renderError(w, r, http.StatusNotFound, errors.New("tenant not found"))
+			return
+		}
+		ctx = context.WithValue(ctx, tenantKey{}, tenant{name: name, prefix: p})
+	}
+	var elem []string
+	for i, param := range []string{"namespace", "name", "provider"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		// A param is only valid once the ones before it are set
+		if !validCoordinate(v) || len(elem) != i {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid %s %q, namespace, name and provider scope a flush in that order", param, v))
+			return
+		}
+		elem = append(elem, v)
+	}
+	match := func(string) bool { return true }
+	if q.Has("tenant") || len(elem) > 0 {
+		match = listingsOf(backendKey(ctx, elem...))
+	}
+	resp := CacheFlushResp{Flushed: flushListings(match)}
+	logger.LogAttrs(r.Context(), slog.LevelInfo, "flushed cached listings",
+		slog.Int("flushed", resp.Flushed),
+		slog.String("scope", strings.Join(elem, "/")),
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
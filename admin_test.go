@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	setGlobal(t, &maintenanceRetryAfter, 30*time.Second)
+	setGlobal(t, &versionsCache.ttl, time.Minute)
+	t.Cleanup(func() { maintenanceMode.Store(false) })
+	fsys := testLayout(t)
+	h := newPublishRegistry(t, fsys)
+	admin := []string{"Authorization", "Bearer admin"}
+	publish := func(version string) *httptest.ResponseRecorder {
+		return serve(h, http.MethodPut, "/terraform/modules/v1/acme/vpc/aws/"+version, bytes.NewReader(testTarball(t, map[string]string{"main.tf": ""})), admin...)
+	}
+
+	if w := serve(h, http.MethodPut, "/admin/maintenance", nil, admin...); w.Code != http.StatusOK || w.Body.String() != `{"maintenance":true}`+"\n" {
+		t.Fatalf("entering maintenance mode: status %d: %s", w.Code, w.Body)
+	}
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"publish":     publish("3.0.0"),
+		"cache flush": serve(h, http.MethodPost, "/admin/cache/flush", nil, admin...),
+	} {
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status %d, want 503", name, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "30" {
+			t.Errorf("%s: Retry-After %q, want 30", name, got)
+		}
+	}
+	if _, ok := fsys["acme/vpc/aws/3.0.0/vpc.tgz"]; ok {
+		t.Error("publish wrote to the backend in maintenance mode")
+	}
+	// Writes already past the middleware are refused by the backend wrapper
+	if err := moduleWriter.Put("acme/vpc/aws/3.0.0/vpc.tgz", bytes.NewReader(nil)); !errors.Is(err, errMaintenance) {
+		t.Errorf("backend write in maintenance mode: %v, want errMaintenance", err)
+	}
+
+	for _, p := range []string{
+		"/.well-known/terraform.json",
+		"/terraform/modules/v1/acme/vpc/aws/versions",
+		"/download/acme/vpc/aws/1.0.0/vpc.tgz",
+		"/admin/maintenance",
+	} {
+		if w := serve(h, http.MethodGet, p, nil, admin...); w.Code != http.StatusOK {
+			t.Errorf("GET %s in maintenance mode: status %d, want 200", p, w.Code)
+		}
+	}
+
+	if w := serve(h, http.MethodDelete, "/admin/maintenance", nil, admin...); w.Body.String() != `{"maintenance":false}`+"\n" {
+		t.Fatalf("leaving maintenance mode: %s", w.Body)
+	}
+	if w := publish("3.0.0"); w.Code != http.StatusCreated {
+		t.Errorf("publish after maintenance mode: status %d, want 201: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultArchiveName is the default template for the file name of a module version's tarball
+const DefaultArchiveName = "{{.Name}}.tgz"
+
+// archiveTemplates holds the parsed archive name templates, a default and optional per-provider overrides
+type archiveTemplates struct {
+	def        *template.Template
+	byProvider map[string]*template.Template
+}
+
+// parseArchiveTemplates parses the default archive name template,
+// along with a comma separated list of <provider>=<template> overrides
+func parseArchiveTemplates(def string, overrides string) (archiveTemplates, error) {
+	t := archiveTemplates{byProvider: map[string]*template.Template{}}
+	var err error
+	if t.def, err = template.New("archive-name").Option("missingkey=error").Parse(def); err != nil {
+		return t, fmt.Errorf("invalid archive name template: %w", err)
+	}
+	for _, o := range splitList(overrides) {
+		provider, tmpl, ok := strings.Cut(o, "=")
+		if !ok || provider == "" {
+			return t, fmt.Errorf("invalid provider archive name %q, expected <provider>=<template>", o)
+		}
+		if t.byProvider[provider], err = template.New("archive-name-" + provider).Option("missingkey=error").Parse(tmpl); err != nil {
+			return t, fmt.Errorf("invalid archive name template for provider %s: %w", provider, err)
+		}
+	}
+	// Make sure every template renders a plain file name
+	sample := Module{Namespace: "namespace", Name: "name", Provider: "provider", Version: "1.0.0"}
+	for _, tmpl := range append([]*template.Template{t.def}, mapValues(t.byProvider)...) {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, sample); err != nil {
+			return t, fmt.Errorf("invalid archive name template %s: %w", tmpl.Name(), err)
+		}
+		if b.Len() == 0 || strings.ContainsAny(b.String(), `/\`) {
+			return t, fmt.Errorf("invalid archive name template %s: %q is not a file name", tmpl.Name(), b.String())
+		}
+	}
+	return t, nil
+}
+
+// mapValues returns the templates of a per-provider template map
+func mapValues(m map[string]*template.Template) []*template.Template {
+	var v []*template.Template
+	for _, t := range m {
+		v = append(v, t)
+	}
+	return v
+}
+
+// archiveName returns the file name of the tarball for a module version, from its provider's template if it has one
+func archiveName(m Module) string {
+	t, ok := archiveNames.byProvider[m.Provider]
+	if !ok {
+		t = archiveNames.def
+	}
+	var b strings.Builder
+	if t == nil || t.Execute(&b, m) != nil || b.Len() == 0 || strings.ContainsAny(b.String(), `/\`) {
+		// Templates are validated at startup, so this only guards against a template producing a path
+		return m.Name + ".tgz"
+	}
+	return b.String()
+}
+
+// backendKey builds a backend key under the prefix of the request ctx is for, see requestPrefix. Object keys always use forward slashes,
+// so path rather than path/filepath is used to join them whatever OS the registry runs on
+func backendKey(ctx context.Context, elem ...string) string {
+	return path.Join(append([]string{".", requestPrefix(ctx)}, elem...)...)
+}
+
+// normalizePrefix cleans a -prefix value into the form backend keys are built from,
+// accepting backslash separators (e.g. from a Windows shell) and leading or trailing slashes
+func normalizePrefix(p string) string {
+	return strings.Trim(path.Clean("/"+strings.ReplaceAll(p, `\`, "/")), "/")
+}
+
+// archivePath returns the backend path of the gzipped tarball for a module version
+func archivePath(ctx context.Context, m Module) string {
+	return backendKey(ctx, m.Namespace, m.Name, m.Provider, m.Version, archiveName(m))
+}
+
+// resolvedArchivePath returns the backend path of the archive served for a module version, see resolveArchive.
+// It's archivePath when no archive is found, leaving the caller's stat to fail with fs.ErrNotExist
+func resolvedArchivePath(ctx context.Context, m Module) string {
+	file, err := resolveArchive(ctx, m, archiveName(m))
+	if err != nil {
+		return archivePath(ctx, m)
+	}
+	return backendKey(ctx, m.Namespace, m.Name, m.Provider, m.Version, file)
+}
+
+// archiveExtensions are the archive types the version directory is searched for by -archive-fallback, in order of preference
+var archiveExtensions = []string{".tgz", ".tar.gz", ".zip"}
+
+// isArchive reports whether a file name has one of archiveExtensions
+func isArchive(name string) bool {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveArchive returns the file name to serve for a download of file from a module version's directory.
+// That's file itself unless -archive-fallback is set and file doesn't exist, in which case it's an archive found
+// in the directory, fs.ErrNotExist is returned when there is none. When there are several, the first by
+// archiveExtensions and then name is chosen, and the ambiguity is logged
+func resolveArchive(ctx context.Context, m Module, file string) (string, error) {
+	if !archiveFallback {
+		return file, nil
+	}
+	_, err := fs.Stat(moduleFS(ctx), backendKey(ctx, m.Namespace, m.Name, m.Provider, m.Version, file))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	versionPath := backendKey(ctx, m.Namespace, m.Name, m.Provider, m.Version)
+	entries, err := fs.ReadDir(moduleFS(ctx), versionPath)
+	if err != nil {
+		return file, err
+	}
+	// Entries are listed in name order, so grouping them by extension keeps the choice deterministic
+	var found []string
+	for _, ext := range archiveExtensions {
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ext) {
+				found = append(found, e.Name())
+			}
+		}
+	}
+	if len(found) == 0 {
+		return file, fs.ErrNotExist
+	}
+	if len(found) > 1 {
+		logBackendAccess(ctx, slog.LevelWarn, "version directory holds several archives, serving "+found[0], m, versionPath, slog.Any("archives", found))
+	}
+	return found[0], nil
+}
+
+// resolveDownload is a helper function for the download handlers to resolve the archive to serve with resolveArchive.
+// A missing archive is left for the caller to 404 on, ok is false when a response has already been written
+func resolveDownload(w http.ResponseWriter, r *http.Request, m Module, file string) (string, bool) {
+	resolved, err := resolveArchive(r.Context(), m, file)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return resolved, true
+	}
+	logBackendAccess(r.Context(), slog.LevelError, "failed to resolve module archive", m, backendKey(r.Context(), m.Namespace, m.Name, m.Provider, m.Version, file), slog.Any("error", err))
+	renderError(w, r, 500, err)
+	return file, false
+}
+
+// serveArchive serves a module archive with http.ServeContent, so clients get a Content-Length
+// and can resume interrupted downloads with range requests.
+// The archive is closed when the request ends early, so an abandoned download stops streaming from the backend
+func serveArchive(w http.ResponseWriter, r *http.Request, m Module, key string) {
+	fsys := moduleFS(r.Context())
+	// The span covers opening and stating the archive, not streaming it
+	_, span := startModuleSpan(r.Context(), "backend.open", m, key)
+	start := time.Now()
+	f, err := fsys.Open(key)
+	if err != nil {
+		endSpan(span, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module archive not found"))
+			return
+		}
+		renderError(w, r, 500, err)
+		return
+	}
+	rs := &lazySeeker{fsys: fsys, name: key, f: f}
+	defer rs.Close()
+	fi, err := f.Stat()
+	endSpan(span, err)
+	if err != nil {
+		renderError(w, r, 500, err)
+		return
+	}
+	observeDownloadTTFB(r.Context(), time.Since(start))
+	if fi.IsDir() {
+		renderError(w, r, http.StatusNotFound, errors.New("module archive not found"))
+		return
+	}
+	rs.size = fi.Size()
+	// http.ServeContent answers a matching If-None-Match with a 304, and only serves If-Range requests a range while it matches
+	w.Header().Set("ETag", archiveETag(r.Context(), key, fi))
+	http.ServeContent(w, r, path.Base(key), fi.ModTime(), rs)
+}
+
+// lazySeeker makes a backend file an io.ReadSeeker for http.ServeContent, as s3 objects can't seek.
+// Seeks are only recorded, and applied on the next read: natively by files that can seek,
+// otherwise by skipping forward, or reopening the file to seek backwards
+type lazySeeker struct {
+	fsys fs.FS
+	name string
+	size int64
+
+	f fs.File
+	// pos is the position of f, off the position seeked to
+	pos int64
+	off int64
+}
+
+// Seek implements io.Seeker
+func (s *lazySeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek to a negative position")
+	}
+	s.off = offset
+	return offset, nil
+}
+
+// Read implements io.Reader
+func (s *lazySeeker) Read(p []byte) (int, error) {
+	if s.off != s.pos {
+		if sk, ok := s.f.(io.Seeker); ok {
+			if _, err := sk.Seek(s.off, io.SeekStart); err == nil {
+				s.pos = s.off
+			}
+		}
+	}
+	if s.off < s.pos {
+		s.f.Close()
+		f, err := s.fsys.Open(s.name)
+		if err != nil {
+			return 0, err
+		}
+		s.f, s.pos = f, 0
+	}
+	if s.off > s.pos {
+		n, err := io.CopyN(io.Discard, s.f, s.off-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.f.Read(p)
+	s.pos += int64(n)
+	s.off = s.pos
+	return n, err
+}
+
+// Close closes the underlying file
+func (s *lazySeeker) Close() error {
+	return s.f.Close()
+}
+
+// fileETag derives a strong ETag for a backend object from its size and modification time,
+// the s3fs FileInfo does not expose the object's own ETag
+func fileETag(fi fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// objectETag is implemented by the fs.FileInfo of backends exposing the ETag they assigned an object
+type objectETag interface {
+	ETag() string
+}
+
+// archiveETag returns the ETag of a module archive served from key, the backend's own ETag of the object when it has one,
+// otherwise the one derived by fileETag
+func archiveETag(ctx context.Context, key string, fi fs.FileInfo) string {
+	if e, ok := fi.(objectETag); ok && e.ETag() != "" {
+		return quoteETag(e.ETag())
+	}
+	if objectETags != nil {
+		etag, err := objectETags.etag(key)
+		if err == nil && etag != "" {
+			return quoteETag(etag)
+		}
+		logKeyAccess(ctx, slog.LevelWarn, "failed to look up backend etag, deriving one instead", key, []slog.Attr{slog.Any("error", err)})
+	}
+	return fileETag(fi)
+}
+
+// quoteETag returns etag as a quoted entity tag, as ETags are sent in headers
+func quoteETag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// etagMatches reports whether the request's If-None-Match header matches etag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// readArchiveFile is a helper function to extract a single file from the root of a module archive,
+// names are matched case insensitively, fs.ErrNotExist is returned if the archive contains no such file
+func readArchiveFile(fsys fs.FS, key string, name string) ([]byte, error) {
+	files, err := readArchiveFiles(fsys, key, func(n string) bool {
+		return strings.EqualFold(n, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range files {
+		return b, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+// readArchiveFiles is a helper function to extract every regular file matching match from a module archive,
+// a zip file when key ends in .zip and a gzipped tarball otherwise.
+// The returned map is keyed by the cleaned path of each file within the archive
+func readArchiveFiles(fsys fs.FS, key string, match func(name string) bool) (map[string][]byte, error) {
+	f, err := fsys.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files map[string][]byte
+	if strings.HasSuffix(key, ".zip") {
+		files, err = readZipFiles(f, match)
+	} else {
+		files, err = readTarFiles(f, match)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key, err)
+	}
+	return files, nil
+}
+
+// readTarFiles extracts every regular file matching match from a gzipped tarball
+func readTarFiles(r io.Reader, match func(name string) bool) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// tarballs built with `tar -czf <name>.tgz .` prefix every entry with ./
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !match(name) {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = b
+	}
+}
+
+// readZipFiles extracts every regular file matching match from a zip file.
+// The zip's central directory is at its end, so the whole file is read into memory first
+func readZipFiles(r io.Reader, match func(name string) bool) (map[string][]byte, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{}
+	for _, zf := range zr.File {
+		name := path.Clean(zf.Name)
+		if !zf.Mode().IsRegular() || !match(name) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[name] = b
+	}
+	return files, nil
+}
+
+// statArchive is a helper function for handlers serving content derived from a module version's archive,
+// it resolves the archive (see resolveArchive) and handles conditional requests against its ETag.
+// ok is false when a response has already been written, i.e. the version doesn't exist or the client's copy is fresh
+func statArchive(w http.ResponseWriter, r *http.Request, m Module) (key string, ok bool) {
+	key = resolvedArchivePath(r.Context(), m)
+	fi, err := fs.Stat(moduleFS(r.Context()), key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module version not found"))
+			return key, false
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to stat module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return key, false
+	}
+	// Content extracted from the tarball can only change when the tarball does, so the tarball's ETag is reused
+	etag := fileETag(fi)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return key, false
+	}
+	return key, true
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestArchiveNames(t *testing.T) {
+	names, err := parseArchiveTemplates("{{.Name}}-{{.Version}}.tgz", "google={{.Namespace}}_{{.Name}}.tar.gz,azurerm=module.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &archiveNames, names)
+	cases := []struct {
+		provider string
+		want     string
+	}{
+		{"aws", "vpc-1.2.0.tgz"},
+		{"google", "acme_vpc.tar.gz"},
+		{"azurerm", "module.zip"},
+	}
+	for _, c := range cases {
+		if got := archiveName(Module{Namespace: "acme", Name: "vpc", Provider: c.provider, Version: "1.2.0"}); got != c.want {
+			t.Errorf("%s: archive name %q, want %q", c.provider, got, c.want)
+		}
+	}
+
+	for _, bad := range [][2]string{
+		{"{{.Name", ""},
+		{"{{.Missing}}.tgz", ""},
+		{"{{.Namespace}}/{{.Name}}.tgz", ""},
+		{DefaultArchiveName, "google"},
+		{DefaultArchiveName, "=x.tgz"},
+		{DefaultArchiveName, "google={{.Name}}/x.tgz"},
+	} {
+		if _, err := parseArchiveTemplates(bad[0], bad[1]); err == nil {
+			t.Errorf("parseArchiveTemplates(%q, %q) accepted an invalid template", bad[0], bad[1])
+		}
+	}
+}
+
+func TestProviderArchiveDownloads(t *testing.T) {
+	names, err := parseArchiveTemplates(DefaultArchiveName, "google={{.Name}}-{{.Provider}}-{{.Version}}.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &archiveNames, names)
+	fsys := testLayout(t)
+	fsys["acme/vpc/google/0.2.0/vpc-google-0.2.0.tgz"] = fsys["acme/vpc/google/0.1.0/vpc.tgz"]
+	h := newTestRegistry(t, fsys)
+
+	for _, c := range []struct{ version, want string }{
+		{"aws/1.0.0", "/download/acme/vpc/aws/1.0.0/vpc.tgz"},
+		{"google/0.2.0", "/download/acme/vpc/google/0.2.0/vpc-google-0.2.0.tgz"},
+	} {
+		w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/"+c.version+"/download", nil)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%s: status %d, want 204: %s", c.version, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Terraform-Get"); got != c.want {
+			t.Errorf("%s: X-Terraform-Get %q, want %q", c.version, got, c.want)
+		}
+		if w := serve(h, http.MethodGet, c.want, nil); w.Code != http.StatusOK {
+			t.Errorf("%s: archive status %d, want 200", c.version, w.Code)
+		}
+	}
+}
+
+func TestBackendKeysUseSlashes(t *testing.T) {
+	m := Module{Namespace: "acme", Name: "vpc", Provider: "aws", Version: "1.0.0"}
+	tenantCtx := context.WithValue(context.Background(), tenantKey{}, tenant{name: "a", prefix: normalizePrefix(`tenants\a\`)})
+	for _, c := range []struct {
+		prefix string
+		ctx    context.Context
+		got    func(ctx context.Context) string
+		want   string
+	}{
+		{"", context.Background(), func(ctx context.Context) string { return archivePath(ctx, m) }, "acme/vpc/aws/1.0.0/vpc.tgz"},
+		{`registry\modules`, context.Background(), func(ctx context.Context) string { return archivePath(ctx, m) }, "registry/modules/acme/vpc/aws/1.0.0/vpc.tgz"},
+		{"/registry/", context.Background(), func(ctx context.Context) string { return backendKey(ctx, "acme", "vpc") }, "registry/acme/vpc"},
+		{"", tenantCtx, func(ctx context.Context) string { return backendKey(ctx, "acme", "vpc", "aws") }, "tenants/a/acme/vpc/aws"},
+		{"", context.Background(), func(ctx context.Context) string { return providerKey(ctx, "acme", "foo") }, "providers/acme/foo"},
+	} {
+		setGlobal(t, &prefix, normalizePrefix(c.prefix))
+		if got := c.got(c.ctx); got != c.want {
+			t.Errorf("prefix %q: key %q, want %q on %s", c.prefix, got, c.want, runtime.GOOS)
+		}
+	}
+
+	// path/filepath uses the OS separator, so it's only for local files: the local backend and the token file
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := map[string]bool{"backend.go": true, "auth.go": true}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") || allowed[name] {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.ImportsOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, imp := range f.Imports {
+			if imp.Path.Value == `"path/filepath"` {
+				t.Errorf("%s imports path/filepath, backend keys must be built with path", name)
+			}
+		}
+	}
+}
+
+func TestArchiveFallback(t *testing.T) {
+	setGlobal(t, &archiveFallback, true)
+	fsys := testLayout(t)
+	archive := fsys["acme/vpc/aws/1.0.0/vpc.tgz"]
+	fsys["acme/single/aws/1.0.0/module.tar.gz"] = archive
+	fsys["acme/single/aws/1.0.0/README.md"] = testFile([]byte("readme"))
+	fsys["acme/none/aws/1.0.0/README.md"] = testFile([]byte("readme"))
+	// Several archives are resolved by extension then name, whatever the backend lists first
+	fsys["acme/several/aws/1.0.0/b.tgz"] = archive
+	fsys["acme/several/aws/1.0.0/a.zip"] = testFile([]byte("zip"))
+	fsys["acme/several/aws/1.0.0/c.tgz"] = archive
+	h := newTestRegistry(t, fsys)
+
+	for _, c := range []struct {
+		module string
+		want   string
+	}{
+		{"vpc", "/download/acme/vpc/aws/1.0.0/vpc.tgz"},
+		{"single", "/download/acme/single/aws/1.0.0/module.tar.gz"},
+		{"several", "/download/acme/several/aws/1.0.0/b.tgz"},
+	} {
+		w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/"+c.module+"/aws/1.0.0/download", nil)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%s: status %d, want 204: %s", c.module, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Terraform-Get"); got != c.want {
+			t.Errorf("%s: X-Terraform-Get %q, want %q", c.module, got, c.want)
+		}
+		if w := serve(h, http.MethodGet, c.want, nil); w.Code != http.StatusOK {
+			t.Errorf("%s: archive status %d, want 200", c.module, w.Code)
+		}
+		// Downloads of the expected archive name are served the one found too
+		if w := serve(h, http.MethodGet, "/download/acme/"+c.module+"/aws/1.0.0/"+c.module+".tgz", nil); w.Code != http.StatusOK {
+			t.Errorf("%s: expected archive status %d, want 200", c.module, w.Code)
+		}
+	}
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/none/aws/1.0.0/download", nil); w.Code != http.StatusNotFound {
+		t.Errorf("none: status %d, want 404", w.Code)
+	}
+
+	setGlobal(t, &archiveFallback, false)
+	if w := serve(h, http.MethodGet, "/download/acme/single/aws/1.0.0/single.tgz", nil); w.Code != http.StatusNotFound {
+		t.Errorf("without -archive-fallback: status %d, want 404", w.Code)
+	}
+}
+
+// testZip returns a zip archive holding files, written in name order
+func testZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestZipModule(t *testing.T) {
+	setGlobal(t, &enableCatalog, true)
+	setGlobal(t, &releaseCache, &lruCache[ModuleReleaseResp]{name: "releases", max: 16})
+	step, err := parseTransformStep("strip:.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &globalTransforms, []transformStep{step})
+	setGlobal(t, &transformedArchives, &archiveCache{max: 1 << 20})
+	archive := testZip(t, map[string]string{
+		".git/HEAD":    "ref: refs/heads/main",
+		"CHANGELOG.md": "# 2.0.0\n",
+		"main.tf":      "",
+	})
+	fsys := testLayout(t)
+	// Published as a zip rather than the configured vpc.tgz
+	fsys["acme/vpc/aws/2.0.0/module.zip"] = testFile(archive)
+	h := newTestRegistry(t, fsys)
+
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/2.0.0/download", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("download url: status %d, want 204: %s", w.Code, w.Body)
+	}
+	download := w.Header().Get("X-Terraform-Get")
+	if want := "/download/acme/vpc/aws/2.0.0/module.zip"; !strings.HasPrefix(download, want) {
+		t.Fatalf("X-Terraform-Get %q, want the zip at %s", download, want)
+	}
+	// The transforms only rewrite tarballs, the zip is served as it's stored
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := serve(h, method, download, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200: %s", method, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/zip" {
+			t.Errorf("%s: Content-Type %q, want application/zip", method, got)
+		}
+		if method == http.MethodGet && !bytes.Equal(w.Body.Bytes(), archive) {
+			t.Errorf("%s: not the zip as it's stored", method)
+		}
+	}
+	if w := serve(h, http.MethodGet, download, nil, "Range", "bytes=4-"); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), archive[4:]) {
+		t.Errorf("range: status %d, or not a ranged read of the zip", w.Code)
+	}
+
+	// Files within it are read like a tarball's
+	w = serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/2.0.0/release", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"changelog":"# 2.0.0\n"`) {
+		t.Errorf("release: status %d, body %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-chi/chi/v5"
+)
+
+// splitList is a helper function to parse a comma separated flag value, ignoring empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// requestNamespace returns the registry namespace a request is for,
+// from the chi URL params on module routes or from the path on /download/* routes
+func requestNamespace(r *http.Request) string {
+	if ns := chi.URLParam(r, "namespace"); ns != "" {
+		return ns
+	}
+	if m, _, ok := parseDownloadPath(r.URL.Path); ok {
+		return m.Namespace
+	}
+	return ""
+}
+
+// tokenStore holds the bearer tokens accepted by the registry,
+// tokens from -token are fixed for the life of the process while tokens from -token-file are reloaded when the file changes
+type tokenStore struct {
+	mu     sync.RWMutex
+	static []string
+	file   []string
+}
+
+// enabled reports whether any tokens are configured, i.e. whether authentication is enabled
+func (s *tokenStore) enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.static)+len(s.file) > 0
+}
+
+// valid reports whether token is one of the accepted tokens
+func (s *tokenStore) valid(token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, tokens := range [][]string{s.static, s.file} {
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadFile replaces the file tokens with the contents of path, one token per line.
+// A malformed or empty file is rejected and the previous tokens are kept,
+// so that a bad edit can't lock everyone out (or disable authentication altogether)
+func (s *tokenStore) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tokens []string
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.IndexFunc(line, func(r rune) bool { return r <= ' ' || r > '~' }) >= 0 {
+			return fmt.Errorf("%s:%d: malformed token", path, i+1)
+		}
+		tokens = append(tokens, line)
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("%s: no tokens found", path)
+	}
+	s.mu.Lock()
+	s.file = tokens
+	s.mu.Unlock()
+	return nil
+}
+
+// watch reloads the token file whenever it changes. The file's directory is watched rather than the file itself,
+// so that editors and kubernetes secret updates, which replace the file rather than writing to it, are picked up
+func (s *tokenStore) watch(path string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Has(fsnotify.Remove) {
+					continue
+				}
+				// kubernetes swaps a ..data symlink, so any event in the directory may change the file's contents
+				if err := s.loadFile(path); err != nil {
+					logger.Error("failed to reload token file, keeping the previous tokens", slog.Any("error", err))
+					continue
+				}
+				logger.Info("reloaded token file", slog.String("path", path))
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("token file watch failed", slog.Any("error", err))
+			}
+		}
+	}()
+	return nil
+}
+
+// validToken reports whether the request carries one of the configured bearer tokens
+func validToken(r *http.Request) bool {
+	token, ok := bearerToken(r)
+	return ok && authTokens.valid(token)
+}
+
+// bearerToken returns the bearer token of the request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return "", false
+	}
+	return token, true
+}
+
+// canRead reports whether a request may read the modules of a namespace: any namespace without authentication
+// or with a valid token, and public namespaces without one
+func canRead(r *http.Request, namespace string) bool {
+	return !authTokens.enabled() || publicNamespaces[namespace] || validToken(r)
+}
+
+// renderAuthFailure responds to a request without an accepted token, a 401 challenge when it carries no bearer token
+// and a 403 when the one it carries isn't accepted, so clients can tell missing credentials from wrong ones
+func renderAuthFailure(w http.ResponseWriter, r *http.Request) {
+	if _, ok := bearerToken(r); ok {
+		renderError(w, r, http.StatusForbidden, errors.New("forbidden, the token isn't accepted"))
+		return
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	renderError(w, r, http.StatusUnauthorized, errors.New("unauthorized"))
+}
+
+// requireToken is a middleware enforcing bearer token authentication when tokens are configured,
+// requests for namespaces marked as public are let through without a token
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if canRead(r, requestNamespace(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		renderAuthFailure(w, r)
+	})
+}
+
+// requireProviderToken is a middleware enforcing bearer token authentication on provider routes.
+// They're authenticated like module routes, unless -provider-tokens or -public-providers configure them separately
+func requireProviderToken(next http.Handler) http.Handler {
+	moduleAuth := requireToken(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicProviders {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !providerTokens.enabled() {
+			moduleAuth.ServeHTTP(w, r)
+			return
+		}
+		if token, ok := bearerToken(r); ok && providerTokens.valid(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		renderAuthFailure(w, r)
+	})
+}
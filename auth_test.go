@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNamespaceVisibility(t *testing.T) {
+	setGlobal(t, &authTokens, &tokenStore{static: []string{"s3cret"}})
+	setGlobal(t, &publicNamespaces, map[string]bool{"public": true})
+	fsys := testLayout(t)
+	fsys["public/vpc/aws/1.0.0/vpc.tgz"] = fsys["acme/vpc/aws/1.0.0/vpc.tgz"]
+	h := newTestRegistry(t, fsys)
+	cases := []struct {
+		name    string
+		path    string
+		headers []string
+		want    int
+	}{
+		{"public without a token", "/terraform/modules/v1/public/vpc/aws/versions", nil, http.StatusOK},
+		{"public download without a token", "/download/public/vpc/aws/1.0.0/vpc.tgz", nil, http.StatusOK},
+		{"private without a token", "/terraform/modules/v1/acme/vpc/aws/versions", nil, http.StatusUnauthorized},
+		{"private download without a token", "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil, http.StatusUnauthorized},
+		{"private with a token", "/terraform/modules/v1/acme/vpc/aws/versions", []string{"Authorization", "Bearer s3cret"}, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if w := serve(h, http.MethodGet, c.path, nil, c.headers...); w.Code != c.want {
+				t.Errorf("status %d, want %d", w.Code, c.want)
+			}
+		})
+	}
+}
+
+// eventually polls cond until it holds, failing the test after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTokenFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("# ci\nold-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &tokenStore{static: []string{"static"}}
+	if err := s.loadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.watch(path); err != nil {
+		t.Fatal(err)
+	}
+	if !s.valid("old-token") || !s.valid("static") {
+		t.Fatal("configured tokens aren't accepted")
+	}
+
+	if err := os.WriteFile(path, []byte("new-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the edited token file to be reloaded", func() bool { return s.valid("new-token") })
+	if s.valid("old-token") {
+		t.Error("the rotated out token is still accepted")
+	}
+	if !s.valid("static") {
+		t.Error("the -token tokens were dropped by the reload")
+	}
+
+	// A malformed edit is rejected and the previous tokens are kept
+	for _, bad := range []string{"two tokens\n", "# nothing but comments\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.loadFile(path); err == nil {
+			t.Errorf("%q was loaded", bad)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if !s.valid("new-token") {
+			t.Errorf("after %q: the previous tokens were dropped", bad)
+		}
+	}
+
+	// Files are often replaced rather than written in place, e.g. by kubernetes or an editor
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("renamed-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the replaced token file to be reloaded", func() bool { return s.valid("renamed-token") })
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// azureBackend serves modules from an azure blob storage container, authenticating with DefaultAzureCredential,
+// i.e. environment credentials, a managed identity or the azure cli's login
+type azureBackend struct {
+	account   string
+	container string
+}
+
+func (b azureBackend) Name() string {
+	return b.url()
+}
+
+// url is the container's blob service url
+func (b azureBackend) url() string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s", b.account, b.container)
+}
+
+func (b azureBackend) FS() (fs.FS, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := container.NewClient(b.url(), cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.GetProperties(context.Background(), nil); err != nil {
+		return nil, err
+	}
+	return objectFS{store: azureStore{container: azureContainerClient{client}}}, nil
+}
+
+// azureContainer is the part of an azure container client azureStore uses
+type azureContainer interface {
+	getProperties(ctx context.Context, key string) (blob.GetPropertiesResponse, error)
+	listBlobsHierarchy(opts *container.ListBlobsHierarchyOptions) *runtime.Pager[container.ListBlobsHierarchyResponse]
+	downloadStream(ctx context.Context, key string, opts *blob.DownloadStreamOptions) (blob.DownloadStreamResponse, error)
+}
+
+// azureContainerClient is the azureContainer of a container client
+type azureContainerClient struct {
+	client *container.Client
+}
+
+func (c azureContainerClient) getProperties(ctx context.Context, key string) (blob.GetPropertiesResponse, error) {
+	return c.client.NewBlobClient(key).GetProperties(ctx, nil)
+}
+
+func (c azureContainerClient) listBlobsHierarchy(opts *container.ListBlobsHierarchyOptions) *runtime.Pager[container.ListBlobsHierarchyResponse] {
+	return c.client.NewListBlobsHierarchyPager("/", opts)
+}
+
+func (c azureContainerClient) downloadStream(ctx context.Context, key string, opts *blob.DownloadStreamOptions) (blob.DownloadStreamResponse, error) {
+	return c.client.NewBlobClient(key).DownloadStream(ctx, opts)
+}
+
+// azureStore is the objectStore of an azure blob container
+type azureStore struct {
+	container azureContainer
+}
+
+func (a azureStore) attrs(ctx context.Context, key string) (objectEntry, error) {
+	props, err := a.container.getProperties(ctx, key)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return objectEntry{}, fs.ErrNotExist
+	}
+	if err != nil {
+		return objectEntry{}, err
+	}
+	e := objectEntry{}
+	if props.ContentLength != nil {
+		e.size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		e.modTime = *props.LastModified
+	}
+	if props.ETag != nil {
+		e.etag = string(*props.ETag)
+	}
+	return e, nil
+}
+
+func (a azureStore) list(ctx context.Context, prefix string, limit int) ([]objectEntry, error) {
+	opts := &container.ListBlobsHierarchyOptions{Prefix: &prefix}
+	if limit > 0 {
+		maxResults := int32(limit)
+		opts.MaxResults = &maxResults
+	}
+	pager := a.container.listBlobsHierarchy(opts)
+	var entries []objectEntry
+	for pager.More() && (limit == 0 || len(entries) < limit) {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Segment.BlobPrefixes {
+			entries = append(entries, objectEntry{name: path.Base(strings.TrimSuffix(*p.Name, "/")), dir: true})
+		}
+		for _, item := range page.Segment.BlobItems {
+			if *item.Name == prefix {
+				continue
+			}
+			e := objectEntry{name: path.Base(*item.Name)}
+			if props := item.Properties; props != nil {
+				if props.ContentLength != nil {
+					e.size = *props.ContentLength
+				}
+				if props.LastModified != nil {
+					e.modTime = *props.LastModified
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (a azureStore) openRange(ctx context.Context, key string, off int64) (io.ReadCloser, error) {
+	resp, err := a.container.downloadStream(ctx, key, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: off},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// mockContainer is an azureContainer of the blobs of a MapFS, listing pageSize entries per page
+type mockContainer struct {
+	fsys     fstest.MapFS
+	pageSize int
+}
+
+func (m mockContainer) blob(key string) (*fstest.MapFile, error) {
+	f, ok := m.fsys[key]
+	if !ok {
+		return nil, &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: string(bloberror.BlobNotFound)}
+	}
+	return f, nil
+}
+
+func (m mockContainer) getProperties(_ context.Context, key string) (blob.GetPropertiesResponse, error) {
+	f, err := m.blob(key)
+	if err != nil {
+		return blob.GetPropertiesResponse{}, err
+	}
+	etag := azcore.ETag("etag")
+	return blob.GetPropertiesResponse{ContentLength: to.Ptr(int64(len(f.Data))), LastModified: to.Ptr(f.ModTime), ETag: &etag}, nil
+}
+
+func (m mockContainer) listBlobsHierarchy(opts *container.ListBlobsHierarchyOptions) *runtime.Pager[container.ListBlobsHierarchyResponse] {
+	// The blobs and virtual directories under the prefix, in the order azure lists them
+	prefix := *opts.Prefix
+	names := map[string]bool{}
+	for name := range m.fsys {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			names[prefix+rest[:i+1]] = true
+			continue
+		}
+		names[name] = true
+	}
+	listing := sortedKeys(names)
+	next := 0
+	return runtime.NewPager(runtime.PagingHandler[container.ListBlobsHierarchyResponse]{
+		More: func(container.ListBlobsHierarchyResponse) bool { return next < len(listing) },
+		Fetcher: func(context.Context, *container.ListBlobsHierarchyResponse) (container.ListBlobsHierarchyResponse, error) {
+			end := min(next+m.pageSize, len(listing))
+			segment := &container.BlobHierarchyListSegment{}
+			for _, name := range listing[next:end] {
+				if strings.HasSuffix(name, "/") {
+					segment.BlobPrefixes = append(segment.BlobPrefixes, &container.BlobPrefix{Name: to.Ptr(name)})
+					continue
+				}
+				f := m.fsys[name]
+				segment.BlobItems = append(segment.BlobItems, &container.BlobItem{
+					Name:       to.Ptr(name),
+					Properties: &container.BlobProperties{ContentLength: to.Ptr(int64(len(f.Data))), LastModified: to.Ptr(f.ModTime)},
+				})
+			}
+			next = end
+			resp := container.ListBlobsHierarchyResponse{}
+			resp.Segment = segment
+			return resp, nil
+		},
+	})
+}
+
+func (m mockContainer) downloadStream(_ context.Context, key string, opts *blob.DownloadStreamOptions) (blob.DownloadStreamResponse, error) {
+	f, err := m.blob(key)
+	if err != nil {
+		return blob.DownloadStreamResponse{}, err
+	}
+	resp := blob.DownloadStreamResponse{}
+	resp.Body = io.NopCloser(bytes.NewReader(f.Data[opts.Range.Offset:]))
+	return resp, nil
+}
+
+func TestAzureBackend(t *testing.T) {
+	layout := testLayout(t)
+	fsys := objectFS{store: azureStore{container: mockContainer{fsys: layout, pageSize: 2}}}
+	want := make([]string, 0, len(layout))
+	for name := range layout {
+		want = append(want, name)
+	}
+	if err := fstest.TestFS(fsys, want...); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(fsys, "acme/vpc/aws/1.0.0/vpc.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := fi.(objectETag); !ok || e.ETag() != "etag" {
+		t.Error("blobs don't carry the ETag azure assigned them")
+	}
+
+	// The registry serves from it unchanged, the virtual directories of the blobs being its listings
+	h := newTestRegistry(t, layout)
+	setGlobal(t, &s3fsys, fs.FS(fsys))
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	if want := `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"1.0.0"},{"version":"1.2.0"},{"version":"10.0.0"}]}]}` + "\n"; w.Body.String() != want {
+		t.Errorf("versions %s, want %s", w.Body, want)
+	}
+	archive := layout["acme/vpc/aws/1.0.0/vpc.tgz"].Data
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil); w.Code != http.StatusOK || w.Body.String() != string(archive) {
+		t.Errorf("download: status %d, or not the blob's contents", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil, "Range", "bytes=4-"); w.Code != http.StatusPartialContent || w.Body.String() != string(archive[4:]) {
+		t.Errorf("range: status %d, or not a ranged read of the blob", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/9.9.9/vpc.tgz", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing blob: status %d, want 404", w.Code)
+	}
+}
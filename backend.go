@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jszwec/s3fs"
+)
+
+// Storage backends selectable with the -backend flag
+const (
+	BackendS3    = "s3"
+	BackendLocal = "local"
+	BackendGCS   = "gcs"
+	BackendAzure = "azure"
+	BackendGit   = "git"
+)
+
+// Backend is a storage backend modules are served from, the http handlers only ever see the fs.FS it connects to
+type Backend interface {
+	// Name describes where modules are served from, e.g. s3://my-bucket
+	Name() string
+	// FS connects to the backend, returning the filesystem rooted at its top level
+	FS() (fs.FS, error)
+}
+
+// presigner is implemented by backends able to sign urls clients can fetch objects from directly
+type presigner interface {
+	presign(key string, ttl time.Duration) (string, error)
+}
+
+// Put implements WritableBackend, writing key to the primary bucket
+func (b *s3Backend) Put(key string, r io.Reader) error {
+	_, err := s3manager.NewUploaderWithClient(b.client).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	return err
+}
+
+// etagger is implemented by backends able to look up the ETag they assigned an object,
+// for backends whose fs.FS doesn't expose it
+type etagger interface {
+	etag(key string) (string, error)
+}
+
+// newBackend returns the backend configured by flags
+func newBackend() (Backend, error) {
+	// Serve from a single monolithic archive when one is configured, e.g. for air-gapped installs
+	if archiveFile != "" {
+		return archiveBackend{file: archiveFile}, nil
+	}
+	switch backend {
+	case BackendS3, BackendLocal, BackendGCS, BackendAzure:
+		return storageBackend(backend, bucket, secondaryBucket, localDir)
+	case BackendGit:
+		if gitURL == "" {
+			return nil, errors.New("git url not set!!!")
+		}
+		parts := strings.Split(gitModule, "/")
+		if len(parts) != 3 || !validCoordinate(parts[0]) || !validCoordinate(parts[1]) || !validCoordinate(parts[2]) {
+			return nil, fmt.Errorf("invalid git module %q, expected <namespace>/<name>/<provider>", gitModule)
+		}
+		return gitBackend{url: gitURL, token: gitToken, module: Module{Namespace: parts[0], Name: parts[1], Provider: parts[2]}}, nil
+	}
+	return nil, fmt.Errorf("invalid backend %q, must be one of %s, %s, %s, %s or %s", backend, BackendS3, BackendLocal, BackendGCS, BackendAzure, BackendGit)
+}
+
+// newProviderBackend returns the backend configured by -provider-backend, nil when providers are served from the module backend.
+// Credentials, regions and endpoints are shared with the module backend, only the bucket or directory differ
+func newProviderBackend() (Backend, error) {
+	if providerBackend == "" {
+		return nil, nil
+	}
+	switch providerBackend {
+	case BackendS3, BackendLocal, BackendGCS, BackendAzure:
+		b, dir := providerBucket, providerDir
+		if b == "" {
+			b = bucket
+		}
+		if dir == "" {
+			dir = localDir
+		}
+		return storageBackend(providerBackend, b, "", dir)
+	}
+	return nil, fmt.Errorf("invalid provider backend %q, must be one of %s, %s, %s or %s", providerBackend, BackendS3, BackendLocal, BackendGCS, BackendAzure)
+}
+
+// storageBackend returns a bucket or directory backend of kind, secondary is the s3 replica bucket failed over to
+func storageBackend(kind string, bucket string, secondary string, dir string) (Backend, error) {
+	switch kind {
+	case BackendS3:
+		if bucket == "" {
+			return nil, errors.New("bucket name not set!!!")
+		}
+		if externalID != "" && roleARN == "" {
+			return nil, errors.New("-external-id requires -role-arn")
+		}
+		return &s3Backend{bucket: bucket, secondaryBucket: secondary, profile: profile, roleARN: roleARN, externalID: externalID,
+			region: s3Region, endpoint: s3Endpoint, forcePathStyle: s3ForcePathStyle}, nil
+	case BackendLocal:
+		if dir == "" {
+			return nil, errors.New("dir not set!!!")
+		}
+		return localBackend{dir: dir}, nil
+	case BackendGCS:
+		if bucket == "" {
+			return nil, errors.New("bucket name not set!!!")
+		}
+		return gcsBackend{bucket: bucket, project: gcsProject}, nil
+	case BackendAzure:
+		if azureAccount == "" {
+			return nil, errors.New("azure storage account not set!!!")
+		}
+		if bucket == "" {
+			return nil, errors.New("bucket name not set!!!")
+		}
+		return azureBackend{account: azureAccount, container: bucket}, nil
+	}
+	return nil, fmt.Errorf("invalid backend %q", kind)
+}
+
+// s3Backend serves modules from an s3 bucket, optionally failing over to a read-only replica bucket
+type s3Backend struct {
+	bucket          string
+	secondaryBucket string
+	profile         string
+	// roleARN is a role assumed non-interactively with the profile's credentials, externalID is passed when assuming it
+	roleARN    string
+	externalID string
+	// region and endpoint override the profile's, e.g. for s3 compatible stores such as minio or ceph,
+	// which mostly need forcePathStyle (bucket/key paths rather than bucket subdomains) too
+	region         string
+	endpoint       string
+	forcePathStyle bool
+
+	// client is the primary bucket's client, set once connected
+	client *s3.S3
+}
+
+func (b *s3Backend) Name() string {
+	return "s3://" + b.bucket
+}
+
+func (b *s3Backend) FS() (fs.FS, error) {
+	// Create an AWS client session
+	sessionOptions := session.Options{
+		Profile:                 b.profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	}
+	if b.region != "" {
+		sessionOptions.Config.Region = aws.String(b.region)
+	}
+	sess, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+	// The endpoint only applies to the s3 clients, roles are still assumed through aws sts
+	var cfg aws.Config
+	if b.endpoint != "" {
+		cfg.Endpoint = aws.String(b.endpoint)
+	}
+	if b.forcePathStyle {
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	if b.roleARN != "" {
+		cfg.Credentials = stscreds.NewCredentials(sess, b.roleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "tf-registry"
+			if b.externalID != "" {
+				p.ExternalID = aws.String(b.externalID)
+			}
+		})
+	}
+	// Create an fs.FS interface for our s3 bucket
+	// TODO the implementation of fs.FS we're importing here is functional,
+	// but its a simple pkg and would be neat to implement directly.
+	b.client = s3.New(sess, &cfg)
+	fsys := fs.FS(s3fs.New(b.client, b.bucket))
+	bucketRoot := "."
+	if _, err := fs.Stat(fsys, bucketRoot); err != nil {
+		return nil, err
+	}
+
+	// Optionally fall back to a read-only replica bucket when the primary is throttling or erroring
+	if b.secondaryBucket != "" {
+		fsys = failoverFS{
+			primary:   fsys,
+			secondary: s3fs.New(s3.New(sess, &cfg), b.secondaryBucket),
+		}
+		fmt.Printf("Failing over to secondary backend: s3://%s/%s\n", b.secondaryBucket, prefix)
+	}
+	return fsys, nil
+}
+
+// presign returns a pre-signed GET url for key in the primary bucket, valid for ttl
+func (b *s3Backend) presign(key string, ttl time.Duration) (string, error) {
+	req, _ := b.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
+// etag returns the ETag of key in the primary bucket
+func (b *s3Backend) etag(key string) (string, error) {
+	out, err := b.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// localBackend serves modules from a local directory laid out like the s3 bucket
+type localBackend struct {
+	dir string
+}
+
+func (b localBackend) Name() string {
+	return b.dir
+}
+
+func (b localBackend) FS() (fs.FS, error) {
+	fsys := os.DirFS(b.dir)
+	if _, err := fs.Stat(fsys, "."); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// Put implements WritableBackend, the file is written next to key and renamed into place
+// so a partly written archive is never served
+func (b localBackend) Put(key string, r io.Reader) error {
+	name := filepath.Join(b.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// archiveBackend serves modules from a single uncompressed tar of the whole registry tree
+type archiveBackend struct {
+	file string
+}
+
+func (b archiveBackend) Name() string {
+	return b.file
+}
+
+func (b archiveBackend) FS() (fs.FS, error) {
+	return openMonolith(b.file)
+}
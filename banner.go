@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// registeredRoutes returns every route registered on r as "<METHOD> <pattern>", sorted by pattern then method
+func registeredRoutes(r chi.Routes) []string {
+	type route struct{ method, pattern string }
+	var routes []route
+	chi.Walk(r, func(method string, pattern string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routes = append(routes, route{method, pattern})
+		return nil
+	})
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].pattern != routes[j].pattern {
+			return routes[i].pattern < routes[j].pattern
+		}
+		return routes[i].method < routes[j].method
+	})
+	out := make([]string, len(routes))
+	for i, rt := range routes {
+		out[i] = rt.method + " " + rt.pattern
+	}
+	return out
+}
+
+// startupBanner returns the attributes of the startup banner, summarizing the effective configuration
+// and the routes actually registered on r so operators can confirm it at a glance.
+// ops is the router of the operational endpoints, which is r itself unless -admin-port is set
+func startupBanner(r chi.Routes, ops chi.Routes) []slog.Attr {
+	storage := []slog.Attr{slog.String("type", "s3"), slog.String("bucket", bucket)}
+	switch {
+	case archiveFile != "":
+		storage = []slog.Attr{slog.String("type", "archive"), slog.String("file", archiveFile)}
+	case backend == BackendGCS:
+		storage = []slog.Attr{slog.String("type", "gcs"), slog.String("bucket", bucket)}
+	case backend == BackendAzure:
+		storage = []slog.Attr{slog.String("type", "azure"), slog.String("account", azureAccount), slog.String("container", bucket)}
+	case backend == BackendLocal:
+		storage = []slog.Attr{slog.String("type", "local"), slog.String("dir", localDir)}
+	case backend == BackendGit:
+		storage = []slog.Attr{slog.String("type", "git"), slog.String("url", gitURL), slog.String("module", gitModule)}
+	case secondaryBucket != "":
+		storage = append(storage, slog.String("secondary_bucket", secondaryBucket))
+	}
+	storage = append(storage, slog.String("prefix", prefix))
+	if len(tenantPrefixes) > 0 {
+		storage = append(storage, slog.Any("tenants", tenantNames()))
+	}
+
+	auth := "none"
+	if authTokens.enabled() {
+		auth = "token"
+	}
+	listen := []string{"http://" + listenAddr(port)}
+	if useTLS {
+		listen = []string{"https://" + listenAddr(port)}
+		if redirectPort != "" {
+			listen = append(listen, "http://"+listenAddr(redirectPort)+" (redirect)")
+		}
+	}
+	attrs := []slog.Attr{
+		slog.Any("backend", slog.GroupValue(storage...)),
+		slog.String("auth", auth),
+		slog.Any("public_namespaces", splitList(publicNS)),
+		slog.Bool("admin", adminToken != ""),
+		slog.Any("listen", listen),
+		slog.Any("routes", registeredRoutes(r)),
+	}
+	if adminPort != "" {
+		attrs = append(attrs,
+			slog.String("admin_listen", "http://"+listenAddr(adminPort)),
+			slog.Any("admin_routes", registeredRoutes(ops)),
+		)
+	}
+	return attrs
+}
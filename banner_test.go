@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+// TestStartupBanner checks the banner logged at startup reflects the enabled features and the routes actually registered
+func TestStartupBanner(t *testing.T) {
+	type banner struct {
+		Msg     string `json:"msg"`
+		Backend struct {
+			Type   string `json:"type"`
+			Dir    string `json:"dir"`
+			Prefix string `json:"prefix"`
+		} `json:"backend"`
+		Auth        string   `json:"auth"`
+		Listen      []string `json:"listen"`
+		Routes      []string `json:"routes"`
+		AdminListen string   `json:"admin_listen"`
+		AdminRoutes []string `json:"admin_routes"`
+		PublicNS    []string `json:"public_namespaces"`
+	}
+	logged := func() banner {
+		t.Helper()
+		var buf bytes.Buffer
+		setGlobal(t, &logger, slog.New(slog.NewJSONHandler(&buf, nil)))
+		r, ops := newRouter()
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "tf-registry configured", startupBanner(r, ops)...)
+		var b banner
+		if err := json.Unmarshal(buf.Bytes(), &b); err != nil {
+			t.Fatalf("banner isn't a single JSON log line: %v: %s", err, buf.String())
+		}
+		return b
+	}
+
+	setGlobal(t, &enableSearch, false)
+	setGlobal(t, &adminPort, "")
+	setGlobal(t, &bindAddr, "0.0.0.0")
+	setGlobal(t, &port, "8080")
+	b := logged()
+	if b.Auth != "none" || b.AdminListen != "" || len(b.AdminRoutes) != 0 {
+		t.Errorf("defaults: auth %q, admin listen %q and routes %v, want none", b.Auth, b.AdminListen, b.AdminRoutes)
+	}
+	if !slices.Equal(b.Listen, []string{"http://0.0.0.0:8080"}) {
+		t.Errorf("listen %v, want http://0.0.0.0:8080", b.Listen)
+	}
+	for _, want := range []string{"GET /.well-known/terraform.json", "GET /terraform/modules/v1/{namespace}/{name}/{provider}/versions", "GET /download/*", "GET /healthz"} {
+		if !slices.Contains(b.Routes, want) {
+			t.Errorf("routes %v, want %s", b.Routes, want)
+		}
+	}
+	if slices.Contains(b.Routes, "GET /terraform/modules/v1/search") {
+		t.Error("the disabled search route is listed")
+	}
+
+	setGlobal(t, &enableSearch, true)
+	setGlobal(t, &backend, BackendLocal)
+	setGlobal(t, &localDir, "/srv/modules")
+	setGlobal(t, &prefix, "modules")
+	setGlobal(t, &authTokens, &tokenStore{static: []string{"s3cret"}})
+	setGlobal(t, &publicNS, "acme,hashicorp")
+	setGlobal(t, &adminPort, "9090")
+	setGlobal(t, &bindAddr, "127.0.0.1")
+	b = logged()
+	if b.Msg != "tf-registry configured" || b.Backend.Type != "local" || b.Backend.Dir != "/srv/modules" || b.Backend.Prefix != "modules" {
+		t.Errorf("backend %+v, want the local /srv/modules backend below modules", b.Backend)
+	}
+	if b.Auth != "token" || !slices.Equal(b.PublicNS, []string{"acme", "hashicorp"}) {
+		t.Errorf("auth %q with public namespaces %v, want token with acme and hashicorp", b.Auth, b.PublicNS)
+	}
+	if !slices.Equal(b.Listen, []string{"http://127.0.0.1:8080"}) || b.AdminListen != "http://127.0.0.1:9090" {
+		t.Errorf("listen %v and %s, want both on 127.0.0.1", b.Listen, b.AdminListen)
+	}
+	if !slices.Contains(b.Routes, "GET /terraform/modules/v1/search") {
+		t.Errorf("routes %v, want the enabled search route", b.Routes)
+	}
+	// Operational endpoints move to the admin router
+	if slices.Contains(b.Routes, "GET /healthz") || !slices.Contains(b.AdminRoutes, "GET /healthz") {
+		t.Errorf("routes %v and admin routes %v, want /healthz only on the admin port", b.Routes, b.AdminRoutes)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// maxBatchModules is the most modules a single batch versions request may ask for
+	maxBatchModules = 100
+	// maxBatchBody is the largest batch versions request body accepted
+	maxBatchBody = 1 << 20
+)
+
+// BatchModule identifies a module in a batch versions request
+type BatchModule struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+}
+
+// BatchVersionsReq is our batch versions request struct
+type BatchVersionsReq struct {
+	Modules []BatchModule `json:"modules"`
+}
+
+// BatchVersionsResult is the outcome of looking up a single module of a batch,
+// a module that can't be listed carries errors in place of its versions
+type BatchVersionsResult struct {
+	BatchModule
+	Versions []ModuleVersion `json:"versions,omitempty"`
+	Errors   []string        `json:"errors,omitempty"`
+}
+
+// BatchVersionsResp is our batch versions response struct, results are in the same order as the request's modules
+type BatchVersionsResp struct {
+	Modules []BatchVersionsResult `json:"modules"`
+}
+
+// validCoordinate reports whether s can be used as a namespace, name or provider in a backend key.
+// Besides separators and relative segments, control characters and % are rejected: route params are matched
+// against the escaped path, so % only ever appears in escaped (e.g. %2F or %2e%2e) traversal attempts
+func validCoordinate(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\%`) &&
+		strings.IndexFunc(s, unicode.IsControl) < 0
+}
+
+// httpPostVersionsBatch is a http handler for retrieving the versions of many modules in a single request.
+// Modules are looked up through the versions cache with at most -walk-concurrency backend listings in flight,
+// and a module that doesn't exist is reported in its result rather than failing the whole batch
+func httpPostVersionsBatch(w http.ResponseWriter, r *http.Request) {
+	var req BatchVersionsReq
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&req); err != nil {
+		renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid batch request: %s", err))
+		return
+	}
+	if len(req.Modules) > maxBatchModules {
+		renderError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("batch requests are limited to %d modules", maxBatchModules))
+		return
+	}
+	for i, bm := range req.Modules {
+		if !validCoordinate(bm.Namespace) || !validCoordinate(bm.Name) || !validCoordinate(bm.Provider) {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid module %s/%s/%s", bm.Namespace, bm.Name, bm.Provider))
+			return
+		}
+		var ns, name, provider bool
+		requested := []string{bm.Namespace, bm.Name, bm.Provider}
+		bm.Namespace, ns = applyCasePolicy(bm.Namespace)
+		bm.Name, name = applyCasePolicy(bm.Name)
+		bm.Provider, provider = applyCasePolicy(bm.Provider)
+		if !ns || !name || !provider {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid module %s/%s/%s: namespace, name and provider must be lowercase", bm.Namespace, bm.Name, bm.Provider))
+			return
+		}
+		coords := caseFallback(moduleFS(r.Context()), moduleKey(r.Context()), []string{bm.Namespace, bm.Name, bm.Provider}, requested)
+		bm.Namespace, bm.Name, bm.Provider = coords[0], coords[1], coords[2]
+		req.Modules[i] = bm
+	}
+
+	resp := BatchVersionsResp{Modules: make([]BatchVersionsResult, len(req.Modules))}
+	concurrency := walkConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, bm := range req.Modules {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, bm BatchModule) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			m := Module{Namespace: bm.Namespace, Name: bm.Name, Provider: bm.Provider}
+			result := BatchVersionsResult{BatchModule: bm}
+			var modVers ModuleVersionsResp
+			err := fs.ErrNotExist
+			if !moduleHidden(r.Context(), m.Namespace, m.Name, m.Provider) {
+				modVers, err = moduleVersions(r.Context(), m)
+			}
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				result.Errors = []string{"module not found"}
+			case errors.Is(err, errTooManyVersions):
+				result.Errors = []string{err.Error()}
+			case err != nil:
+				logBackendAccess(r.Context(), slog.LevelError, "failed to list module versions", m, backendKey(r.Context(), m.Namespace, m.Name, m.Provider), slog.Any("error", err))
+				result.Errors = []string{err.Error()}
+			default:
+				for _, mod := range modVers.Modules {
+					result.Versions = append(result.Versions, mod.Versions...)
+				}
+			}
+			// each goroutine only writes its own index, so no further locking is needed
+			resp.Modules[i] = result
+		}(i, bm)
+	}
+	wg.Wait()
+	logger.LogAttrs(r.Context(), slog.LevelInfo, "listed module versions in batch",
+		slog.Int("modules", len(req.Modules)),
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
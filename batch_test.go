@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersionsBatch(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	body := `{"modules":[` +
+		`{"namespace":"acme","name":"vpc","provider":"aws"},` +
+		`{"namespace":"acme","name":"nope","provider":"aws"},` +
+		`{"namespace":"acme","name":"vpc","provider":"google"},` +
+		`{"namespace":"nobody","name":"vpc","provider":"aws"}` +
+		`]}`
+	w := serve(h, http.MethodPost, "/terraform/modules/v1/versions:batch", strings.NewReader(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	want := `{"modules":[` +
+		`{"namespace":"acme","name":"vpc","provider":"aws","versions":[{"version":"1.0.0"},{"version":"1.2.0"},{"version":"10.0.0"}]},` +
+		`{"namespace":"acme","name":"nope","provider":"aws","errors":["module not found"]},` +
+		`{"namespace":"acme","name":"vpc","provider":"google","versions":[{"version":"0.1.0"}]},` +
+		`{"namespace":"nobody","name":"vpc","provider":"aws","errors":["module not found"]}` +
+		`]}` + "\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("body\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestVersionsBatchInvalid(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	var tooMany []string
+	for i := 0; i <= maxBatchModules; i++ {
+		tooMany = append(tooMany, fmt.Sprintf(`{"namespace":"acme","name":"m%d","provider":"aws"}`, i))
+	}
+	for _, c := range []struct {
+		name, body string
+		want       int
+	}{
+		{"not json", `modules`, http.StatusBadRequest},
+		{"traversal", `{"modules":[{"namespace":"..","name":"vpc","provider":"aws"}]}`, http.StatusBadRequest},
+		{"separator", `{"modules":[{"namespace":"acme/vpc","name":"vpc","provider":"aws"}]}`, http.StatusBadRequest},
+		{"empty", `{"modules":[{"namespace":"acme","name":"","provider":"aws"}]}`, http.StatusBadRequest},
+		{"too many", `{"modules":[` + strings.Join(tooMany, ",") + `]}`, http.StatusRequestEntityTooLarge},
+	} {
+		if w := serve(h, http.MethodPost, "/terraform/modules/v1/versions:batch", strings.NewReader(c.body)); w.Code != c.want {
+			t.Errorf("%s: status %d, want %d: %s", c.name, w.Code, c.want, w.Body)
+		}
+	}
+}
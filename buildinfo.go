@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+)
+
+// The build's version, commit and date, set with -ldflags when building a release, e.g.
+//
+//	go build -ldflags "-X main.buildVersion=v1.2.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// They're prefixed so they don't clash with the go-version package imported as version
+var (
+	buildVersion = "dev"
+	buildCommit  string
+	buildDate    string
+)
+
+// BuildInfoResp is our build info response struct
+type BuildInfoResp struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// buildInfo returns the version, commit and date of the running build. A commit and date not set with -ldflags
+// are taken from the vcs info go embeds when building from a checkout
+func buildInfo() BuildInfoResp {
+	b := BuildInfoResp{Version: buildVersion, Commit: buildCommit, Date: buildDate}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			}
+		}
+	}
+	return b
+}
+
+// httpGetBuildInfo is a http handler for returning the build of the running registry,
+// e.g. to confirm a new version is rolled out to every replica
+func httpGetBuildInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo())
+}
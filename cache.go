@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// refreshTimeout bounds a backend listing fetched for a listingCache. The listing is shared by every request waiting on it,
+// so it runs detached from the request that started it rather than being cancelled with it
+const refreshTimeout = time.Minute
+
+// listingCacheEntry is a cached backend listing
+type listingCacheEntry[T any] struct {
+	listing   T
+	fetchedAt time.Time
+}
+
+// listingCache caches backend listings (e.g. a module's versions) by path for ttl. Once an entry expires it is still served
+// for up to stale while a single background refresh runs, so an expiry never stalls concurrent requests
+// and never results in more than one backend listing per path
+type listingCache[T any] struct {
+	// name labels the cache's metrics
+	name  string
+	ttl   time.Duration
+	stale time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]listingCacheEntry[T]
+	group   singleflight.Group
+}
+
+// get returns the listing for key from the cache when possible, otherwise from fetch.
+// Failed fetches aren't cached, so fetch should fail rather than return a partial listing
+func (c *listingCache[T]) get(ctx context.Context, key string, fetch func(ctx context.Context) (T, error)) (T, error) {
+	if c.ttl <= 0 {
+		return fetch(ctx)
+	}
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	age := time.Since(e.fetchedAt)
+	switch {
+	case ok && age < c.ttl:
+		cacheLookups.WithLabelValues(c.name, "hit").Inc()
+		return e.listing, nil
+	case ok && age < c.ttl+c.stale:
+		cacheLookups.WithLabelValues(c.name, "stale").Inc()
+		go func() {
+			if _, err := c.refresh(context.WithoutCancel(ctx), key, fetch); err != nil {
+				logger.Warn("failed to refresh cached backend listing", slog.Any("error", err))
+			}
+		}()
+		return e.listing, nil
+	}
+	cacheLookups.WithLabelValues(c.name, "miss").Inc()
+	return c.refresh(ctx, key, fetch)
+}
+
+// refresh fetches the listing for key and caches it, concurrent refreshes of the same key share a single backend listing.
+// The fetch runs under its own timeout, a cancelled ctx only stops waiting for it
+func (c *listingCache[T]) refresh(ctx context.Context, key string, fetch func(ctx context.Context) (T, error)) (T, error) {
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		// A refresh that just finished already fetched the listing
+		c.mu.RLock()
+		e, ok := c.entries[key]
+		c.mu.RUnlock()
+		if ok && time.Since(e.fetchedAt) < c.ttl {
+			return e.listing, nil
+		}
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		listing, err := fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		if c.entries == nil {
+			c.entries = map[string]listingCacheEntry[T]{}
+		}
+		c.entries[key] = listingCacheEntry[T]{listing: listing, fetchedAt: time.Now()}
+		c.mu.Unlock()
+		return listing, nil
+	})
+	var zero T
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// flush drops the cached listings whose key matches, returning how many were dropped
+func (c *listingCache[T]) flush(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key := range c.entries {
+		if match(key) {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// lruCacheEntry is a value cached by an lruCache
+type lruCacheEntry[T any] struct {
+	key      string
+	value    T
+	storedAt time.Time
+}
+
+// lruCache caches values derived from backend objects (e.g. the dependencies parsed from an archive) by key.
+// It holds at most max entries, evicting the least recently used, and entries expire after ttl
+// so values derived from objects that are no longer read are eventually dropped. A max of 0 disables caching
+type lruCache[T any] struct {
+	// name labels the cache's metrics
+	name string
+	max  int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// get returns the cached value for key
+func (c *lruCache[T]) get(key string) (T, bool) {
+	var zero T
+	if c.max <= 0 {
+		return zero, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && c.ttl > 0 && time.Since(el.Value.(*lruCacheEntry[T]).storedAt) >= c.ttl {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		cacheLookups.WithLabelValues(c.name, "miss").Inc()
+		return zero, false
+	}
+	cacheLookups.WithLabelValues(c.name, "hit").Inc()
+	c.order.MoveToFront(el)
+	return el.Value.(*lruCacheEntry[T]).value, true
+}
+
+// put caches value for key, evicting the least recently used entries once the cache is full
+func (c *lruCache[T]) put(key string, value T) {
+	if c.max <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.order = list.New()
+		c.entries = map[string]*list.Element{}
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = &lruCacheEntry[T]{key: key, value: value, storedAt: time.Now()}
+		c.order.MoveToFront(el)
+		return
+	}
+	for c.order.Len() >= c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry[T]).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruCacheEntry[T]{key: key, value: value, storedAt: time.Now()})
+}
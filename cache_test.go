@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingFetch is a listing fetch that counts its calls and blocks until released
+type blockingFetch struct {
+	calls   atomic.Int32
+	release chan struct{}
+	value   int
+	ctxErr  error
+}
+
+func newBlockingFetch(value int) *blockingFetch {
+	return &blockingFetch{release: make(chan struct{}), value: value}
+}
+
+func (f *blockingFetch) fetch(ctx context.Context) (int, error) {
+	f.calls.Add(1)
+	<-f.release
+	f.ctxErr = ctx.Err()
+	return f.value, nil
+}
+
+func TestListingCacheStaleWhileRevalidate(t *testing.T) {
+	c := &listingCache[int]{name: "test", ttl: 20 * time.Millisecond, stale: time.Minute}
+	ctx := context.Background()
+	if _, err := c.get(ctx, "key", func(context.Context) (int, error) { return 1, nil }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(c.ttl)
+
+	// Every request during the refresh gets the stale listing right away, while a single refresh runs
+	refresh := newBlockingFetch(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.get(ctx, "key", refresh.fetch)
+			if err != nil || v != 1 {
+				t.Errorf("got %d, %v during the refresh, want the stale 1", v, err)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests waited on the refresh")
+	}
+	close(refresh.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v, err := c.get(ctx, "key", refresh.fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the refreshed listing was never cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := refresh.calls.Load(); n != 1 {
+		t.Errorf("%d backend refreshes, want 1", n)
+	}
+}
+
+func TestListingCacheMissStampede(t *testing.T) {
+	c := &listingCache[int]{name: "test", ttl: time.Minute}
+	fetch := newBlockingFetch(3)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.get(context.Background(), "key", fetch.fetch); err != nil || v != 3 {
+				t.Errorf("got %d, %v, want 3", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(fetch.release)
+	wg.Wait()
+	if n := fetch.calls.Load(); n != 1 {
+		t.Errorf("%d backend listings, want 1", n)
+	}
+}
+
+func TestListingCacheLeaderCancellation(t *testing.T) {
+	c := &listingCache[int]{name: "test", ttl: time.Minute}
+	fetch := newBlockingFetch(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := c.get(ctx, "key", fetch.fetch)
+		leader <- err
+	}()
+	for fetch.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiter := make(chan int, 1)
+	go func() {
+		v, err := c.get(context.Background(), "key", fetch.fetch)
+		if err != nil {
+			t.Errorf("waiter: %s", err)
+		}
+		waiter <- v
+	}()
+
+	// The leader stops waiting as soon as its request is cancelled, but the listing carries on for the waiter
+	cancel()
+	select {
+	case err := <-leader:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("leader got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled leader kept waiting on the listing")
+	}
+	close(fetch.release)
+	if v := <-waiter; v != 4 {
+		t.Errorf("waiter got %d, want 4", v)
+	}
+	if fetch.ctxErr != nil {
+		t.Errorf("the listing's context was done: %s", fetch.ctxErr)
+	}
+	if n := fetch.calls.Load(); n != 1 {
+		t.Errorf("%d backend listings, want 1", n)
+	}
+}
+
+func TestListingCacheSkipsFailedFetches(t *testing.T) {
+	c := &listingCache[int]{name: "test", ttl: time.Minute}
+	calls := 0
+	fetch := func(context.Context) (int, error) {
+		calls++
+		if calls == 1 {
+			return 0, errors.New("enrichment failed")
+		}
+		return 5, nil
+	}
+	if _, err := c.get(context.Background(), "key", fetch); err == nil {
+		t.Fatal("the failed fetch's error wasn't returned")
+	}
+	if v, err := c.get(context.Background(), "key", fetch); err != nil || v != 5 {
+		t.Errorf("got %d, %v after a failed fetch, want a fresh listing", v, err)
+	}
+	if v, _ := c.get(context.Background(), "key", fetch); v != 5 || calls != 2 {
+		t.Errorf("got %d after %d fetches, want the cached listing", v, calls)
+	}
+}
+
+func TestEnrichmentFailsWithItsContext(t *testing.T) {
+	newTestRegistry(t, testLayout(t))
+	m := Module{Namespace: "acme", Name: "vpc", Provider: "aws"}
+	modVers, err := getModuleVersions(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A listing enriched after its context is done would be missing fields, it's failed so the cache skips it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := addPublishedTimes(ctx, m, modVers); !errors.Is(err, context.Canceled) {
+		t.Errorf("published times: %v, want context.Canceled", err)
+	}
+	if err := addDependencies(ctx, m, modVers); !errors.Is(err, context.Canceled) {
+		t.Errorf("dependencies: %v, want context.Canceled", err)
+	}
+	if err := addPublishedTimes(context.Background(), m, modVers); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range modVers.Modules[0].Versions {
+		if v.PublishedAt != "2024-01-02T03:04:05Z" {
+			t.Errorf("version %s published at %q", v.Version, v.PublishedAt)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Protocol versions implemented by the registry
+const (
+	ProtocolModulesV1   = "modules.v1"
+	ProtocolProvidersV1 = "providers.v1"
+)
+
+// Optional features advertised by the capabilities endpoint, named after the endpoints or fields they enable
+const (
+	FeatureVersionsBatch  = "versions:batch"
+	FeatureVersionsStream = "versions/stream"
+	FeatureLatest         = "latest"
+	FeatureSearch         = "search"
+	FeatureNamespaces     = "namespaces"
+	FeatureProviders      = "providers"
+	FeatureChangelog      = "changelog"
+	FeatureSchema         = "schema"
+	FeatureRelease        = "release"
+	FeatureDependencies   = "dependencies"
+)
+
+// CapabilitiesResp is our capabilities response struct
+type CapabilitiesResp struct {
+	Protocols []string `json:"protocols"`
+	Features  []string `json:"features"`
+}
+
+// capabilities returns the protocol versions and features this registry serves, as configured by flags
+func capabilities() CapabilitiesResp {
+	c := CapabilitiesResp{
+		Protocols: []string{ProtocolModulesV1, ProtocolProvidersV1},
+		Features:  []string{},
+	}
+	if enableBatch {
+		c.Features = append(c.Features, FeatureVersionsBatch, FeatureVersionsStream)
+	}
+	if enableBrowse {
+		c.Features = append(c.Features, FeatureLatest, FeatureNamespaces, FeatureProviders)
+	}
+	if enableSearch {
+		c.Features = append(c.Features, FeatureSearch)
+	}
+	if enableCatalog {
+		c.Features = append(c.Features, FeatureChangelog, FeatureSchema, FeatureRelease)
+	}
+	if includeDependencies {
+		c.Features = append(c.Features, FeatureDependencies)
+	}
+	return c
+}
+
+// httpGetCapabilities is a http handler for returning the protocol versions and optional features of the registry,
+// so clients and tooling can feature-detect rather than probe endpoints
+func httpGetCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilities())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestEndpointSwitches checks each endpoint group is served when enabled and a 404 when disabled,
+// while the versions and download routes terraform uses are always served
+func TestEndpointSwitches(t *testing.T) {
+	groups := []struct {
+		name   string
+		enable *bool
+		method string
+		paths  []string
+	}{
+		{"browse", &enableBrowse, http.MethodGet, []string{
+			"/terraform/modules/v1/acme",
+			"/terraform/modules/v1/acme/vpc/providers",
+			"/terraform/modules/v1/acme/vpc/aws/latest",
+		}},
+		{"search", &enableSearch, http.MethodGet, []string{"/terraform/modules/v1/search?q=vpc"}},
+		{"batch", &enableBatch, http.MethodGet, []string{"/terraform/modules/v1/acme/vpc/aws/versions/stream"}},
+		{"catalog", &enableCatalog, http.MethodGet, []string{"/terraform/modules/v1/acme/vpc/aws/1.0.0"}},
+	}
+	always := []string{"/terraform/modules/v1/acme/vpc/aws/versions", "/terraform/modules/v1/acme/vpc/aws/1.0.0/download"}
+	for _, g := range groups {
+		for _, enabled := range []bool{true, false} {
+			setGlobal(t, g.enable, enabled)
+			h := newTestRegistry(t, testLayout(t))
+			for _, p := range g.paths {
+				w := serve(h, g.method, p, nil)
+				if enabled && w.Code >= 300 {
+					t.Errorf("%s enabled: GET %s status %d, want it served", g.name, p, w.Code)
+				}
+				if !enabled && w.Code != http.StatusNotFound {
+					t.Errorf("%s disabled: GET %s status %d, want 404", g.name, p, w.Code)
+				}
+			}
+			for _, p := range always {
+				if w := serve(h, http.MethodGet, p, nil); w.Code >= 300 {
+					t.Errorf("%s enabled=%t: GET %s status %d, want it served", g.name, enabled, p, w.Code)
+				}
+			}
+		}
+		setGlobal(t, g.enable, true)
+	}
+
+	// The batch endpoint is a POST
+	for _, enabled := range []bool{true, false} {
+		setGlobal(t, &enableBatch, enabled)
+		h := newTestRegistry(t, testLayout(t))
+		w := serve(h, http.MethodPost, "/terraform/modules/v1/versions:batch", strings.NewReader(`{"modules":[{"namespace":"acme","name":"vpc","provider":"aws"}]}`))
+		want := http.StatusOK
+		if !enabled {
+			// The path is also the namespace listing's, which only allows GET
+			want = http.StatusMethodNotAllowed
+		}
+		if w.Code != want {
+			t.Errorf("batch enabled=%t: POST status %d, want %d", enabled, w.Code, want)
+		}
+	}
+}
+
+// TestCapabilities checks the advertised protocols are the ones in service discovery,
+// and that each feature is advertised exactly when the endpoint or field it names is served
+func TestCapabilities(t *testing.T) {
+	archive := testFile(testTarball(t, map[string]string{
+		"main.tf":      `module "dns" { source = "acme/dns/aws" }`,
+		"CHANGELOG.md": "## 1.0.0\n\nFirst release",
+	}))
+	probes := map[string]func(h http.Handler) bool{
+		FeatureVersionsBatch: func(h http.Handler) bool {
+			body := strings.NewReader(`{"modules":[{"namespace":"acme","name":"vpc","provider":"aws"}]}`)
+			return serve(h, http.MethodPost, "/terraform/modules/v1/versions:batch", body).Code == http.StatusOK
+		},
+		FeatureVersionsStream: servesGet("/terraform/modules/v1/acme/vpc/aws/versions/stream"),
+		FeatureLatest:         servesGet("/terraform/modules/v1/acme/vpc/aws/latest"),
+		FeatureSearch:         servesGet("/terraform/modules/v1/search?q=vpc"),
+		FeatureNamespaces:     servesGet("/terraform/modules/v1/acme"),
+		FeatureProviders:      servesGet("/terraform/modules/v1/acme/vpc/providers"),
+		FeatureChangelog:      servesGet("/terraform/modules/v1/acme/vpc/aws/1.0.0/changelog"),
+		FeatureSchema:         servesGet("/terraform/modules/v1/acme/vpc/aws/1.0.0/schema"),
+		FeatureRelease:        servesGet("/terraform/modules/v1/acme/vpc/aws/1.0.0/release"),
+		FeatureDependencies: func(h http.Handler) bool {
+			return strings.Contains(serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil).Body.String(), `"dependencies"`)
+		},
+	}
+	switches := []*bool{&enableBatch, &enableBrowse, &enableSearch, &enableCatalog, &includeDependencies}
+	setGlobal(t, &dependencyCache, &lruCache[[]ModuleDependency]{name: "dependencies"})
+	for _, s := range switches {
+		setGlobal(t, s, false)
+	}
+	// each switch on its own, then all of them
+	for i := 0; i <= len(switches); i++ {
+		for j, s := range switches {
+			*s = i == len(switches) || i == j
+		}
+		h := newTestRegistry(t, fstest.MapFS{"acme/vpc/aws/1.0.0/vpc.tgz": archive})
+		w := serve(h, http.MethodGet, "/terraform/modules/v1/", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", w.Code)
+		}
+		var c CapabilitiesResp
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		var discovery map[string]string
+		if err := json.Unmarshal(serve(h, http.MethodGet, "/.well-known/terraform.json", nil).Body.Bytes(), &discovery); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range c.Protocols {
+			if discovery[p] == "" {
+				t.Errorf("protocol %s is advertised but not in service discovery %v", p, discovery)
+			}
+		}
+		if len(c.Protocols) != len(discovery) {
+			t.Errorf("protocols %v, want those of service discovery %v", c.Protocols, discovery)
+		}
+		var served []string
+		for _, f := range []string{
+			FeatureVersionsBatch, FeatureVersionsStream, FeatureLatest, FeatureNamespaces, FeatureProviders, FeatureSearch,
+			FeatureChangelog, FeatureSchema, FeatureRelease, FeatureDependencies,
+		} {
+			if probes[f](h) {
+				served = append(served, f)
+			}
+		}
+		if len(served) == 0 {
+			served = []string{}
+		}
+		if !reflect.DeepEqual(c.Features, served) {
+			t.Errorf("advertised features %v, want the served %v", c.Features, served)
+		}
+	}
+}
+
+// servesGet returns a probe of whether h serves a GET of target
+func servesGet(target string) func(h http.Handler) bool {
+	return func(h http.Handler) bool {
+		return serve(h, http.MethodGet, target, nil).Code == http.StatusOK
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Coordinate case policies, selecting how namespaces, names and providers that aren't all lowercase are handled.
+// S3 keys are case sensitive, so without a policy MyOrg/vpc/aws and myorg/vpc/aws are different modules
+const (
+	// CaseSensitive uses coordinates exactly as requested
+	CaseSensitive = "sensitive"
+	// CaseLower lowercases coordinates before resolving them, modules must be stored under lowercase keys
+	CaseLower = "lower"
+	// CaseReject rejects coordinates that aren't all lowercase with a 400
+	CaseReject = "reject"
+	// CaseLowerFallback lowercases coordinates like CaseLower, but falls back to them as requested
+	// when only those exist in the backend, for modules stored before keys were lowercased
+	CaseLowerFallback = "lower-fallback"
+)
+
+// parseCasePolicy validates the -coordinate-case flag
+func parseCasePolicy(s string) (string, error) {
+	switch s {
+	case CaseSensitive, CaseLower, CaseReject, CaseLowerFallback:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid coordinate case policy %q, expected one of %s, %s, %s or %s", s, CaseSensitive, CaseLower, CaseReject, CaseLowerFallback)
+}
+
+// applyCasePolicy applies the configured case policy to a namespace, name or provider,
+// ok is false if the policy rejects it
+func applyCasePolicy(coord string) (string, bool) {
+	switch coordinateCase {
+	case CaseLower, CaseLowerFallback:
+		return strings.ToLower(coord), true
+	case CaseReject:
+		return coord, coord == strings.ToLower(coord)
+	}
+	return coord, true
+}
+
+// caseFallback returns the coordinates to resolve a request with under the lower-fallback policy,
+// the lowercased ones unless they miss in fsys while the ones as requested exist. key builds the backend path,
+// e.g. providerKey for provider routes
+func caseFallback(fsys fs.FS, key func(elem ...string) string, lowered []string, requested []string) []string {
+	if coordinateCase != CaseLowerFallback || slices.Equal(lowered, requested) {
+		return lowered
+	}
+	if _, err := fs.Stat(fsys, key(lowered...)); err == nil {
+		return lowered
+	}
+	if _, err := fs.Stat(fsys, key(requested...)); err == nil {
+		return requested
+	}
+	return lowered
+}
+
+// moduleKey returns a key builder of module backend paths for caseFallback
+func moduleKey(ctx context.Context) func(elem ...string) string {
+	return func(elem ...string) string { return backendKey(ctx, elem...) }
+}
+
+// caseParams are the chi URL params holding module and provider coordinates, the version is never case normalized
+var caseParams = map[string]bool{"namespace": true, "name": true, "provider": true, "type": true}
+
+// normalizeCase is a middleware applying the coordinate case policy to module and provider routes, rewriting the
+// namespace, name, provider and type URL params, or the coordinates of /download/* paths, in place
+func normalizeCase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if coordinateCase == CaseSensitive {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok := true
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			var idx []int
+			var lowered, requested []string
+			for i, k := range rctx.URLParams.Keys {
+				if caseParams[k] {
+					v, valid := applyCasePolicy(rctx.URLParams.Values[i])
+					ok = ok && valid
+					idx = append(idx, i)
+					lowered = append(lowered, v)
+					requested = append(requested, rctx.URLParams.Values[i])
+				}
+			}
+			fsys, key := moduleFS(r.Context()), moduleKey(r.Context())
+			if strings.HasPrefix(r.URL.Path, ProviderBasePath+"/") || strings.HasPrefix(r.URL.Path, "/providers/") {
+				fsys, key = providerFS(r.Context()), func(elem ...string) string { return providerKey(r.Context(), elem...) }
+			}
+			for j, v := range caseFallback(fsys, key, lowered, requested) {
+				rctx.URLParams.Values[idx[j]] = v
+			}
+		}
+		if rest, found := strings.CutPrefix(r.URL.Path, "/download/"); found {
+			parts := strings.SplitN(rest, "/", 4)
+			n := min(len(parts), 3)
+			requested := slices.Clone(parts[:n])
+			for i := 0; i < n; i++ {
+				var valid bool
+				parts[i], valid = applyCasePolicy(parts[i])
+				ok = ok && valid
+			}
+			copy(parts, caseFallback(moduleFS(r.Context()), moduleKey(r.Context()), parts[:n], requested))
+			r.URL.Path = "/download/" + strings.Join(parts, "/")
+			r.URL.RawPath = ""
+		}
+		if !ok {
+			renderError(w, r, http.StatusBadRequest, errors.New("namespace, name, provider and type must be lowercase"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
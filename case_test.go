@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestCasePolicies(t *testing.T) {
+	cases := []struct {
+		policy string
+		// statuses of the module listing, module download, provider listing and listing of a module stored mixed case
+		versions, download, providers, legacy int
+		// published is the key a mixed case publish is written to, empty when it's rejected
+		published string
+	}{
+		{CaseSensitive, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound, http.StatusOK, "ACME/vpc/aws/3.0.0/vpc.tgz"},
+		{CaseLower, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNotFound, "acme/vpc/aws/3.0.0/vpc.tgz"},
+		{CaseReject, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, ""},
+		{CaseLowerFallback, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, "acme/vpc/aws/3.0.0/vpc.tgz"},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			setGlobal(t, &coordinateCase, c.policy)
+			fsys := testLayout(t)
+			fsys["Legacy/net/aws/1.0.0/net.tgz"] = fsys["acme/vpc/aws/1.0.0/vpc.tgz"]
+			h := newPublishRegistry(t, fsys)
+			for _, r := range []struct {
+				target string
+				want   int
+			}{
+				{"/terraform/modules/v1/ACME/vpc/aws/versions", c.versions},
+				{"/download/ACME/vpc/aws/1.0.0/vpc.tgz", c.download},
+				{"/terraform/providers/v1/ACME/Foo/versions", c.providers},
+				{"/terraform/modules/v1/Legacy/net/aws/versions", c.legacy},
+			} {
+				if w := serve(h, http.MethodGet, r.target, nil); w.Code != r.want {
+					t.Errorf("GET %s: status %d, want %d", r.target, w.Code, r.want)
+				}
+			}
+
+			w := serve(h, http.MethodPut, "/terraform/modules/v1/ACME/vpc/aws/3.0.0", bytes.NewReader(testTarball(t, map[string]string{"main.tf": ""})), "Authorization", "Bearer admin")
+			if c.published == "" {
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("publish: status %d, want 400", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusCreated {
+				t.Fatalf("publish: status %d, want 201: %s", w.Code, w.Body)
+			}
+			if _, ok := fsys[c.published]; !ok {
+				t.Errorf("publish wasn't written to %s", c.published)
+			}
+		})
+	}
+}
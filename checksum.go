@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// SumsFile is the name of the optional checksum list in a module's provider directory,
+// it uses the `sha256sum` output format with paths relative to the provider directory:
+//
+//	<sha256>  1.0.0/<module_name>.tgz
+const SumsFile = "SHA256SUMS"
+
+// ChecksumExt is the extension of the optional checksum file published alongside a module archive in its version directory,
+// e.g. 1.0.0/<module_name>.tgz.sha256. It holds the archive's hex encoded sha256, alone or in `sha256sum` format
+const ChecksumExt = ".sha256"
+
+// parseSums parses a SHA256SUMS file into a map of relative path to hex encoded checksum
+func parseSums(b []byte) (map[string]string, error) {
+	sums := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed %s line: %q", SumsFile, line)
+		}
+		// sha256sum marks files hashed in binary mode with a leading *
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums, sc.Err()
+}
+
+// parseChecksumFile parses a checksum file into the hex encoded checksum it holds
+func parseChecksumFile(b []byte) (string, error) {
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty %s file", ChecksumExt)
+	}
+	sum := strings.ToLower(fields[0])
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2*sha256.Size {
+		return "", fmt.Errorf("malformed %s file: %q is not a sha256", ChecksumExt, fields[0])
+	}
+	return sum, nil
+}
+
+// archiveChecksum returns the published sha256 of a module archive, from its checksum file or else its provider directory's
+// SHA256SUMS file, it's empty when neither has one
+func archiveChecksum(ctx context.Context, m Module, file string) (string, error) {
+	provPath := backendKey(ctx, m.Namespace, m.Name, m.Provider)
+	b, err := fs.ReadFile(moduleFS(ctx), path.Join(provPath, m.Version, file+ChecksumExt))
+	if err == nil {
+		return parseChecksumFile(b)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	b, err = fs.ReadFile(moduleFS(ctx), path.Join(provPath, SumsFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	sums, err := parseSums(b)
+	if err != nil {
+		return "", err
+	}
+	return sums[m.Version+"/"+file], nil
+}
+
+// fileSHA256 is a helper function to compute the hex encoded sha256 of a backend object
+func fileSHA256(fsys fs.FS, key string) (string, error) {
+	f, err := fsys.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
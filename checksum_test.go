@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseSums(t *testing.T) {
+	sums, err := parseSums([]byte("# comment\nABCDEF  1.0.0/vpc.tgz\n\nabc123 *2.0.0/vpc.tgz\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums["1.0.0/vpc.tgz"] != "abcdef" || sums["2.0.0/vpc.tgz"] != "abc123" || len(sums) != 2 {
+		t.Errorf("parsed %v", sums)
+	}
+	if _, err := parseSums([]byte("only-a-sum\n")); err == nil {
+		t.Error("malformed line parsed")
+	}
+}
+
+// TestVerifySums downloads an archive listed in its provider directory's SHA256SUMS with a matching and a mismatching entry
+func TestVerifySums(t *testing.T) {
+	setGlobal(t, &verifySums, true)
+	archive := testTarball(t, map[string]string{"main.tf": ""})
+	sum := sha256.Sum256(archive)
+	fsys := fstest.MapFS{
+		"acme/vpc/aws/1.0.0/vpc.tgz": testFile(archive),
+		"acme/vpc/aws/2.0.0/vpc.tgz": testFile(archive),
+		"acme/vpc/aws/3.0.0/vpc.tgz": testFile(archive),
+		"acme/vpc/aws/" + SumsFile: testFile([]byte(
+			hex.EncodeToString(sum[:]) + "  1.0.0/vpc.tgz\n" +
+				"0000000000000000000000000000000000000000000000000000000000000000  2.0.0/vpc.tgz\n")),
+	}
+	h := newTestRegistry(t, fsys)
+	cases := []struct {
+		version string
+		want    int
+	}{
+		{"1.0.0", http.StatusOK},
+		{"2.0.0", http.StatusInternalServerError},
+		// Versions without a sums entry are served, with a warning
+		{"3.0.0", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := serve(h, http.MethodGet, "/download/acme/vpc/aws/"+c.version+"/vpc.tgz", nil)
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d", c.version, w.Code, c.want)
+		}
+	}
+
+	// The published checksum is also handed to terraform with the download url
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/1.0.0/download", nil)
+	if got, want := w.Header().Get("X-Terraform-Get"), "/download/acme/vpc/aws/1.0.0/vpc.tgz?checksum=sha256:"+hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("X-Terraform-Get %q, want %q", got, want)
+	}
+}
+
+func TestVerifyChecksumsFlag(t *testing.T) {
+	for _, name := range []string{"verify-checksums", "verify-sums"} {
+		setGlobal(t, &verifySums, false)
+		if err := flag.Set(name, "true"); err != nil {
+			t.Fatal(err)
+		}
+		if !verifySums {
+			t.Errorf("-%s doesn't enable checksum verification", name)
+		}
+	}
+}
+
+// TestVerifySidecarChecksum downloads archives with a .sha256 file alongside them
+func TestVerifySidecarChecksum(t *testing.T) {
+	setGlobal(t, &verifySums, true)
+	archive := testTarball(t, map[string]string{"main.tf": ""})
+	sum := sha256.Sum256(archive)
+	h := newTestRegistry(t, fstest.MapFS{
+		"acme/vpc/aws/1.0.0/vpc.tgz":        testFile(archive),
+		"acme/vpc/aws/1.0.0/vpc.tgz.sha256": testFile([]byte(hex.EncodeToString(sum[:]) + "  vpc.tgz\n")),
+		"acme/vpc/aws/2.0.0/vpc.tgz":        testFile(archive),
+		"acme/vpc/aws/2.0.0/vpc.tgz.sha256": testFile([]byte("0000000000000000000000000000000000000000000000000000000000000000\n")),
+	})
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil); w.Code != http.StatusOK || w.Body.String() != string(archive) {
+		t.Errorf("matching checksum: status %d, want 200 and the archive", w.Code)
+	}
+	w := serve(h, http.MethodGet, "/download/acme/vpc/aws/2.0.0/vpc.tgz", nil)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "checksum mismatch") {
+		t.Errorf("mismatching checksum: status %d, body %s, want a 500 naming the mismatch", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is the prefix of environment variables configuring the registry, e.g. TFREG_BUCKET for -bucket
+const envPrefix = "TFREG_"
+
+// Config is the configuration that can be loaded from a -config file and the environment,
+// each field configures the flag named by its flag tag
+type Config struct {
+	Bucket           string `yaml:"bucket" flag:"bucket"`
+	Prefix           string `yaml:"prefix" flag:"prefix"`
+	Port             string `yaml:"port" flag:"port"`
+	Profile          string `yaml:"profile" flag:"profile"`
+	RoleARN          string `yaml:"role_arn" flag:"role-arn"`
+	ExternalID       string `yaml:"external_id" flag:"external-id"`
+	S3Region         string `yaml:"s3_region" flag:"s3-region"`
+	S3Endpoint       string `yaml:"s3_endpoint" flag:"s3-endpoint"`
+	Backend          string `yaml:"backend" flag:"backend"`
+	Dir              string `yaml:"dir" flag:"dir"`
+	AzureAccount     string `yaml:"azure_account" flag:"azure-account"`
+	GitURL           string `yaml:"git_url" flag:"git-url"`
+	GitModule        string `yaml:"git_module" flag:"git-module"`
+	GitToken         string `yaml:"git_token" flag:"git-token"`
+	Token            string `yaml:"token" flag:"token"`
+	TokenFile        string `yaml:"token_file" flag:"token-file"`
+	PublicNamespaces string `yaml:"public_namespaces" flag:"public-namespaces"`
+	Tenants          string `yaml:"tenants" flag:"tenants"`
+	AdminToken       string `yaml:"admin_token" flag:"admin-token"`
+	ProviderBackend  string `yaml:"provider_backend" flag:"provider-backend"`
+	ProviderBucket   string `yaml:"provider_bucket" flag:"provider-bucket"`
+	ProviderDir      string `yaml:"provider_dir" flag:"provider-dir"`
+	ProviderPrefix   string `yaml:"provider_prefix" flag:"provider-prefix"`
+	ProviderTokens   string `yaml:"provider_tokens" flag:"provider-tokens"`
+}
+
+// envVar returns the environment variable configuring the named flag
+func envVar(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig loads the configuration from the YAML file at path, if any,
+// with TFREG_ environment variables overriding the file's values
+func loadConfig(path string) (Config, error) {
+	var c Config
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := yaml.UnmarshalStrict(b, &c); err != nil {
+			return c, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if env := os.Getenv(envVar(v.Type().Field(i).Tag.Get("flag"))); env != "" {
+			v.Field(i).SetString(env)
+		}
+	}
+	return c, nil
+}
+
+// applyConfig sets the flags configured by c, flags set on the command line take precedence
+func applyConfig(c Config) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("flag")
+		if set[name] || v.Field(i).String() == "" {
+			continue
+		}
+		if err := flag.Set(name, v.Field(i).String()); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
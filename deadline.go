@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newServer returns a http server for handler on addr with the configured timeouts,
+// so slow or idle clients can't hold connections open indefinitely
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// listenAddr returns the address a listener on port binds to, on the -bind interface
+func listenAddr(port string) string {
+	return net.JoinHostPort(bindAddr, port)
+}
+
+// downloadDeadline is a middleware bounding how long a download may take,
+// once d has passed the backend stream is closed and the response is ended where it is
+func downloadDeadline(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				m, file, _ := parseDownloadPath(r.URL.Path)
+				logBackendAccess(ctx, slog.LevelWarn, "module download exceeded its deadline, response was cut short", m,
+					backendKey(ctx, m.Namespace, m.Name, m.Provider, m.Version, file), slog.Duration("deadline", d))
+			}
+		})
+	}
+}
+
+// contextFS is an fs.FS whose open files are closed once ctx is done,
+// so a cancelled or timed out request stops reading from the backend even if a read is stuck.
+// Backends able to make their calls with a context (see contextBinder) make them with ctx
+type contextFS struct {
+	fsys fs.FS
+	ctx  context.Context
+}
+
+// moduleFS returns the module backend for calls made on behalf of ctx
+func moduleFS(ctx context.Context) fs.FS {
+	return contextFS{fsys: s3fsys, ctx: ctx}
+}
+
+// providerFS returns the provider backend for calls made on behalf of ctx
+func providerFS(ctx context.Context) fs.FS {
+	return contextFS{fsys: providerfsys, ctx: ctx}
+}
+
+// contextBinder is implemented by backends whose calls can be made with a context, e.g. object store clients,
+// and by the fs.FS wrappers of backends, passing it on to the backend they wrap
+type contextBinder interface {
+	// withContext returns the fs.FS making its calls with ctx
+	withContext(ctx context.Context) fs.FS
+}
+
+// bindContext returns fsys making its calls with ctx, or fsys itself if it can't
+func bindContext(fsys fs.FS, ctx context.Context) fs.FS {
+	if b, ok := fsys.(contextBinder); ok {
+		return b.withContext(ctx)
+	}
+	return fsys
+}
+
+// Open implements fs.FS
+func (c contextFS) Open(name string) (fs.File, error) {
+	f, err := bindContext(c.fsys, c.ctx).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &contextFile{File: f, stop: context.AfterFunc(c.ctx, func() { f.Close() })}, nil
+}
+
+// Stat implements fs.StatFS
+func (c contextFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(bindContext(c.fsys, c.ctx), name)
+}
+
+// ReadDir implements fs.ReadDirFS
+func (c contextFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(bindContext(c.fsys, c.ctx), name)
+}
+
+// contextFile is a file opened by a contextFS
+type contextFile struct {
+	fs.File
+	stop func() bool
+}
+
+// Close implements fs.File
+func (f *contextFile) Close() error {
+	if !f.stop() {
+		// the context already closed the file
+		return nil
+	}
+	return f.File.Close()
+}
+
+// Seek implements io.Seeker when the underlying file does, http.FileServer needs it to serve ranges
+func (f *contextFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, errors.New("seeker can't seek")
+	}
+	return s.Seek(offset, whence)
+}
+
+// ReadDir implements fs.ReadDirFile when the underlying file does
+func (f *contextFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, errors.New("not a directory")
+	}
+	return d.ReadDir(n)
+}
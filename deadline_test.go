@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stuckFS is a backend whose objects stall after their first after bytes, until they're closed
+type stuckFS struct {
+	fs.FS
+	after int64
+}
+
+func (s stuckFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &stuckFile{File: f, left: s.after, closed: make(chan struct{})}, nil
+}
+
+type stuckFile struct {
+	fs.File
+	left   int64
+	closed chan struct{}
+}
+
+func (f *stuckFile) Read(p []byte) (int, error) {
+	if f.left <= 0 {
+		<-f.closed
+		return 0, fs.ErrClosed
+	}
+	if int64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.File.Read(p)
+	f.left -= int64(n)
+	return n, err
+}
+
+func (f *stuckFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+func (f *stuckFile) Close() error {
+	close(f.closed)
+	return f.File.Close()
+}
+
+func TestDownloadDeadline(t *testing.T) {
+	const size = 1 << 16
+	var buf bytes.Buffer
+	setGlobal(t, &logger, slog.New(slog.NewJSONHandler(&buf, nil)))
+	setGlobal(t, &downloadTimeout, 50*time.Millisecond)
+	fsys := testLayout(t)
+	fsys["acme/vpc/aws/1.0.0/vpc.tgz"] = testFile(bytes.Repeat([]byte{0x1f}, size))
+	h := newTestRegistry(t, fsys)
+	setGlobal(t, &s3fsys, fs.FS(stuckFS{FS: fsys, after: 4096}))
+
+	done := make(chan int)
+	go func() {
+		w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil)
+		done <- w.Body.Len()
+	}()
+	select {
+	case n := <-done:
+		if n >= size {
+			t.Errorf("served %d bytes, want the response cut short", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download outlived its deadline, the stuck backend stream wasn't closed")
+	}
+	if log := buf.String(); !strings.Contains(log, "module download exceeded its deadline") || !strings.Contains(log, "acme/vpc/aws/1.0.0/vpc.tgz") {
+		t.Errorf("the cut short download wasn't logged with its key: %s", log)
+	}
+
+	// Downloads within the deadline are unaffected
+	setGlobal(t, &s3fsys, fs.FS(fsys))
+	buf.Reset()
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil); w.Code != http.StatusOK || w.Body.Len() != size {
+		t.Errorf("status %d with %d bytes, want 200 and the whole archive", w.Code, w.Body.Len())
+	}
+	if strings.Contains(buf.String(), "exceeded its deadline") {
+		t.Error("a download within its deadline was logged as cut short")
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	for bind, want := range map[string]string{
+		"0.0.0.0":   "0.0.0.0:8080",
+		"127.0.0.1": "127.0.0.1:8080",
+		"::1":       "[::1]:8080",
+		"":          ":8080",
+	} {
+		setGlobal(t, &bindAddr, bind)
+		if got := listenAddr("8080"); got != want {
+			t.Errorf("-bind %q: address %s, want %s", bind, got, want)
+		}
+	}
+
+	// A server on the address listens on the -bind interface only
+	setGlobal(t, &bindAddr, "127.0.0.1")
+	srv := newServer(listenAddr("0"), newTestRegistry(t, testLayout(t)))
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	addr := ln.Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bound to %s, want 127.0.0.1", addr)
+	}
+	resp, err := http.Get("http://" + addr.String() + "/.well-known/terraform.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want 200", resp.StatusCode)
+	}
+}
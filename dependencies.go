@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// ModuleDependency is a registry module called by a module version
+type ModuleDependency struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+	Version string `json:"version,omitempty"`
+}
+
+// dependencyCache caches the dependencies parsed from each archive by archive path and ETag,
+// so a version's tarball is only downloaded again once it's overwritten
+var dependencyCache = &lruCache[[]ModuleDependency]{name: "dependencies"}
+
+// isRegistrySource reports whether a module source address refers to a registry module,
+// i.e. [<hostname>/]<namespace>/<name>/<provider> rather than a local path, url or other source type
+func isRegistrySource(source string) bool {
+	if strings.HasPrefix(source, "./") || strings.HasPrefix(source, "../") || strings.Contains(source, "::") || strings.Contains(source, "://") {
+		return false
+	}
+	// Terraform expands these hosts' shorthands to git sources before looking for registry addresses
+	if strings.HasPrefix(source, "github.com/") || strings.HasPrefix(source, "bitbucket.org/") {
+		return false
+	}
+	parts := strings.Split(source, "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		return false
+	}
+	for _, p := range parts {
+		if p == "" {
+			return false
+		}
+	}
+	// Anything with a 4th segment must start with a hostname, otherwise it's a registry subdirectory or a github shorthand
+	return len(parts) == 3 || strings.Contains(parts[0], ".")
+}
+
+// parseModuleDependencies is a helper function to extract the registry modules called from a module's .tf files
+func parseModuleDependencies(files map[string][]byte) ([]ModuleDependency, error) {
+	deps := []ModuleDependency{}
+	err := forEachBlock(files, func(block *hclsyntax.Block, src []byte) {
+		if block.Type != "module" {
+			return
+		}
+		attrs := block.Body.Attributes
+		source := stringAttr(attrs["source"])
+		if !isRegistrySource(source) {
+			return
+		}
+		deps = append(deps, ModuleDependency{
+			Name:    block.Labels[0],
+			Source:  source,
+			Version: stringAttr(attrs["version"]),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Name < deps[j].Name })
+	return deps, nil
+}
+
+// moduleDependencies returns the registry modules called by a module version
+func moduleDependencies(ctx context.Context, m Module) ([]ModuleDependency, error) {
+	key := resolvedArchivePath(ctx, m)
+	fi, err := fs.Stat(moduleFS(ctx), key)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := key + "@" + fileETag(fi)
+	if deps, ok := dependencyCache.get(cacheKey); ok {
+		return deps, nil
+	}
+	files, err := readArchiveFiles(moduleFS(ctx), key, isRootTFFile)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := parseModuleDependencies(files)
+	if err != nil {
+		return nil, err
+	}
+	dependencyCache.put(cacheKey, deps)
+	return deps, nil
+}
+
+// addDependencies is a helper function to fill in the dependencies of every version in a versions response.
+// A version whose tarball can't be parsed is still listed, just without its dependencies,
+// the listing only fails when ctx is done before every tarball was parsed
+func addDependencies(ctx context.Context, m Module, modVers ModuleVersionsResp) error {
+	for _, mod := range modVers.Modules {
+		for i, v := range mod.Versions {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			mv := m
+			mv.Version = v.Version
+			deps, err := moduleDependencies(ctx, mv)
+			if err != nil {
+				logBackendAccess(ctx, slog.LevelWarn, "failed to resolve module dependencies", mv, archivePath(ctx, mv), slog.Any("error", err))
+				continue
+			}
+			mod.Versions[i].Dependencies = deps
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIsRegistrySource(t *testing.T) {
+	for source, want := range map[string]bool{
+		"acme/vpc/aws":                              true,
+		"registry.example.com/acme/vpc/aws":         true,
+		"./modules/subnet":                          false,
+		"../shared":                                 false,
+		"github.com/acme/vpc":                       false,
+		"bitbucket.org/acme/vpc":                    false,
+		"acme/vpc/aws/modules":                      false,
+		"git::https://example.com/vpc.git":          false,
+		"https://example.com/vpc.zip":               false,
+		"s3::https://bucket.s3.amazonaws.com/vpc":   false,
+		"acme//aws":                                 false,
+		"registry.example.com/acme/vpc/aws//subnet": false,
+	} {
+		if got := isRegistrySource(source); got != want {
+			t.Errorf("isRegistrySource(%q) = %t, want %t", source, got, want)
+		}
+	}
+}
+
+func TestVersionDependencies(t *testing.T) {
+	setGlobal(t, &includeDependencies, true)
+	setGlobal(t, &dependencyCache, &lruCache[[]ModuleDependency]{name: "dependencies", max: 16})
+	h := newTestRegistry(t, fstest.MapFS{
+		"acme/app/aws/1.0.0/app.tgz": testFile(testTarball(t, map[string]string{
+			"main.tf": `
+module "vpc" {
+  source  = "acme/vpc/aws"
+  version = "~> 1.2"
+}
+
+module "dns" {
+  source = "registry.example.com/acme/dns/aws"
+}
+
+module "local" {
+  source = "./modules/local"
+}
+`,
+			// Nested modules' calls are the nested modules' dependencies, not the version's
+			"modules/local/main.tf": `module "nested" { source = "acme/nested/aws" }`,
+		})),
+		"acme/app/aws/2.0.0/app.tgz": testFile(testTarball(t, map[string]string{"main.tf": `resource "null_resource" "x" {}`})),
+	})
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/app/aws/versions", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	want := `{"modules":[{"source":"acme/app/aws","versions":[` +
+		`{"version":"1.0.0","dependencies":[{"name":"dns","source":"registry.example.com/acme/dns/aws"},{"name":"vpc","source":"acme/vpc/aws","version":"~\u003e 1.2"}]},` +
+		`{"version":"2.0.0"}` +
+		`]}]}` + "\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("body\n%s\nwant\n%s", got, want)
+	}
+	// Both versions' dependencies are cached, including the empty ones
+	if n := len(dependencyCache.entries); n != 2 {
+		t.Errorf("%d cached versions, want 2", n)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// deprecatedPath maps a retired path prefix onto its replacement
+type deprecatedPath struct {
+	old, new string
+	// sunset is when the old path stops working, zero if no date has been set
+	sunset time.Time
+}
+
+// parseDeprecatedPaths parses the -deprecated-paths flag, a comma separated list of <old>=<new>[@<sunset date>] path prefixes
+func parseDeprecatedPaths(s string) ([]deprecatedPath, error) {
+	var paths []deprecatedPath
+	for _, item := range splitList(s) {
+		old, rest, ok := strings.Cut(item, "=")
+		newPath, date, hasDate := strings.Cut(rest, "@")
+		if !ok || !strings.HasPrefix(old, "/") || !strings.HasPrefix(newPath, "/") || old == "/" {
+			return nil, fmt.Errorf("invalid deprecated path %q, expected <old>=<new>[@<sunset date>]", item)
+		}
+		p := deprecatedPath{old: strings.TrimSuffix(old, "/"), new: strings.TrimSuffix(newPath, "/")}
+		if hasDate {
+			t, err := time.Parse(time.DateOnly, date)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sunset date for deprecated path %s: %w", old, err)
+			}
+			p.sunset = t
+		}
+		paths = append(paths, p)
+	}
+	// Longest prefixes first, so nested deprecations map onto the most specific replacement
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i].old) > len(paths[j].old) })
+	return paths, nil
+}
+
+// deprecatePaths is a middleware serving requests for deprecated paths from their replacements,
+// marking the responses with Deprecation, Sunset and Link headers pointing clients at the new path
+func deprecatePaths(paths []deprecatedPath) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range paths {
+				rest, ok := strings.CutPrefix(r.URL.Path, p.old)
+				if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+					continue
+				}
+				newPath := p.new + rest
+				if newPath == "" {
+					newPath = "/"
+				}
+				w.Header().Set("Deprecation", "true")
+				if !p.sunset.IsZero() {
+					w.Header().Set("Sunset", p.sunset.UTC().Format(http.TimeFormat))
+				}
+				w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, newPath))
+				r.URL.Path = newPath
+				r.URL.RawPath = ""
+				if rctx := chi.RouteContext(r.Context()); rctx != nil {
+					rctx.RoutePath = newPath
+				}
+				break
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
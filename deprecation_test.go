@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseDeprecatedPaths(t *testing.T) {
+	paths, err := parseDeprecatedPaths("/v1=/terraform/v1, /v1/modules/=/terraform/modules/v1@2027-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0].old != "/v1/modules" || paths[0].new != "/terraform/modules/v1" || paths[1].old != "/v1" {
+		t.Fatalf("paths %+v, want the longest prefix first without trailing slashes", paths)
+	}
+	if got := paths[0].sunset.Format("2006-01-02"); got != "2027-01-01" {
+		t.Errorf("sunset %s, want 2027-01-01", got)
+	}
+	for _, s := range []string{"/v1", "v1=/terraform", "/v1=terraform", "/=/terraform", "/v1=/terraform@soon"} {
+		if _, err := parseDeprecatedPaths(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestDeprecatedPaths(t *testing.T) {
+	paths, err := parseDeprecatedPaths("/v1/modules=/terraform/modules/v1@2027-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &deprecatedPaths, paths)
+	h := newTestRegistry(t, testLayout(t))
+
+	current := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	if current.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", current.Code)
+	}
+	if got := current.Header().Get("Deprecation"); got != "" {
+		t.Errorf("current path: Deprecation %q, want none", got)
+	}
+
+	w := serve(h, http.MethodGet, "/v1/modules/acme/vpc/aws/versions", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deprecated path: status %d, want 200", w.Code)
+	}
+	if w.Body.String() != current.Body.String() {
+		t.Errorf("deprecated path body %s, want %s", w.Body, current.Body)
+	}
+	for name, want := range map[string]string{
+		"Deprecation": "true",
+		"Sunset":      "Fri, 01 Jan 2027 00:00:00 GMT",
+		"Link":        `</terraform/modules/v1/acme/vpc/aws/versions>; rel="successor-version"`,
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s %q, want %q", name, got, want)
+		}
+	}
+
+	// Only whole path segments match the old prefix
+	if w := serve(h, http.MethodGet, "/v1/modulesx/acme/vpc/aws/versions", nil); w.Code != http.StatusNotFound || w.Header().Get("Deprecation") != "" {
+		t.Errorf("partial segment: status %d with Deprecation %q, want 404 without", w.Code, w.Header().Get("Deprecation"))
+	}
+}
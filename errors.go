@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// renderError writes err as the JSON error response of a request with the given status.
+// Server errors are logged with the request id and route pattern, so every 5xx can be correlated to a log line,
+// client errors are only logged at debug level
+func renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	renderErrorResp(w, r, status, ErrorResp{Errors: []string{err.Error()}})
+}
+
+// renderErrorResp is renderError for error responses carrying more than the error, e.g. suggestions
+func renderErrorResp(w http.ResponseWriter, r *http.Request, status int, resp ErrorResp) {
+	level := slog.LevelDebug
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	if logger.Enabled(r.Context(), level) {
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+		logger.LogAttrs(r.Context(), level, "request failed",
+			slog.Int("status", status),
+			slog.String("route", route),
+			slog.Any("errors", resp.Errors),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// httpNotFound is the router's handler for paths without a route, in the same JSON shape as every other error
+func httpNotFound(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound, errors.New("not found"))
+}
+
+// methodNotAllowed returns the router's handler for requests of a method a path has no route for,
+// responding with a 405 and the methods that path does have routes for in the Allow header
+func methodNotAllowed(routes chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(routes, r), ", "))
+		renderError(w, r, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// allowedMethods returns the methods routes serves the path of r with.
+// HEAD is allowed wherever GET is, middleware.GetHead serves it with the GET route
+func allowedMethods(routes chi.Routes, r *http.Request) []string {
+	routePath := r.URL.Path
+	if r.URL.RawPath != "" {
+		routePath = r.URL.RawPath
+	}
+	var allowed []string
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		if routes.Match(chi.NewRouteContext(), method, routePath) ||
+			(method == http.MethodHead && len(allowed) > 0 && allowed[0] == http.MethodGet) {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
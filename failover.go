@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// failoverFS is an fs.FS that resolves from a primary backend,
+// and falls back to a read-only secondary backend when the primary fails with a retryable error
+type failoverFS struct {
+	primary   fs.FS
+	secondary fs.FS
+}
+
+// withContext implements contextBinder
+func (f failoverFS) withContext(ctx context.Context) fs.FS {
+	return failoverFS{primary: bindContext(f.primary, ctx), secondary: bindContext(f.secondary, ctx)}
+}
+
+// Open implements fs.FS
+func (f failoverFS) Open(name string) (fs.File, error) {
+	file, err := f.primary.Open(name)
+	if !isRetryableBackendError(err) {
+		return file, err
+	}
+	logFailover("open", err)
+	return f.secondary.Open(name)
+}
+
+// Stat implements fs.StatFS
+func (f failoverFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(f.primary, name)
+	if !isRetryableBackendError(err) {
+		return fi, err
+	}
+	logFailover("stat", err)
+	return fs.Stat(f.secondary, name)
+}
+
+// ReadDir implements fs.ReadDirFS
+func (f failoverFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.primary, name)
+	if !isRetryableBackendError(err) {
+		return entries, err
+	}
+	logFailover("list", err)
+	return fs.ReadDir(f.secondary, name)
+}
+
+// logFailover logs a backend operation falling back to the secondary backend
+func logFailover(op string, err error) {
+	logger.Warn("primary backend failed, falling back to secondary", slog.String("op", op), slog.Any("error", err))
+}
+
+// isRetryableBackendError reports whether err is a transient backend failure,
+// i.e. throttling or a 5xx from the backend, rather than a missing object or a client error
+func isRetryableBackendError(err error) bool {
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() == 429 || reqErr.StatusCode() >= 500
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr)
+	}
+	return false
+}
+
+// isThrottleError reports whether err is the backend asking us to slow down
+func isThrottleError(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && (reqErr.StatusCode() == 429 || reqErr.StatusCode() == 503) {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && request.IsErrorThrottle(awsErr)
+}
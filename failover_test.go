@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// failingFS fails every operation with err
+type failingFS struct {
+	err error
+}
+
+// Open implements fs.FS
+func (f failingFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: f.err}
+}
+
+func TestFailoverServesFromSecondary(t *testing.T) {
+	unavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "try again", nil), http.StatusServiceUnavailable, "req")
+	secondary := testLayout(t)
+	h := newTestRegistry(t, secondary)
+	setGlobal(t, &s3fsys, fs.FS(failoverFS{primary: failingFS{err: unavailable}, secondary: secondary}))
+
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("versions status %d, want 200 from the secondary: %s", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil); w.Code != http.StatusOK {
+		t.Fatalf("download status %d, want 200 from the secondary", w.Code)
+	}
+}
+
+func TestFailoverOnlyOnRetryableErrors(t *testing.T) {
+	secondary := testLayout(t)
+	failure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "req")
+	}
+	cases := []struct {
+		name     string
+		err      error
+		failover bool
+	}{
+		{"missing object", fs.ErrNotExist, false},
+		{"client error", failure("AccessDenied", http.StatusForbidden), false},
+		{"throttled", failure("SlowDown", http.StatusTooManyRequests), true},
+		{"server error", failure("InternalError", http.StatusInternalServerError), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := failoverFS{primary: failingFS{err: c.err}, secondary: secondary}
+			_, err := fs.Stat(f, "acme/vpc/aws/1.0.0/vpc.tgz")
+			if c.failover && err != nil {
+				t.Errorf("not failed over: %s", err)
+			}
+			if !c.failover && !errors.Is(err, c.err) {
+				t.Errorf("error %v, want the primary's %v", err, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsBackend serves modules from a google cloud storage bucket, authenticating with application default credentials
+type gcsBackend struct {
+	bucket string
+	// project is billed for requests, e.g. for requester pays buckets
+	project string
+}
+
+func (b gcsBackend) Name() string {
+	return "gs://" + b.bucket
+}
+
+func (b gcsBackend) FS() (fs.FS, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bucket := client.Bucket(b.bucket)
+	if b.project != "" {
+		bucket = bucket.UserProject(b.project)
+	}
+	if _, err := bucket.Attrs(ctx); err != nil {
+		return nil, err
+	}
+	return objectFS{store: gcsStore{bucket: bucket}}, nil
+}
+
+// gcsStore is the objectStore of a gcs bucket
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+func (g gcsStore) attrs(ctx context.Context, key string) (objectEntry, error) {
+	attrs, err := g.bucket.Object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return objectEntry{}, fs.ErrNotExist
+	}
+	if err != nil {
+		return objectEntry{}, err
+	}
+	return objectEntry{size: attrs.Size, modTime: attrs.Updated, etag: attrs.Etag}, nil
+}
+
+func (g gcsStore) list(ctx context.Context, prefix string, limit int) ([]objectEntry, error) {
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	if limit > 0 {
+		it.PageInfo().MaxSize = limit
+	}
+	var entries []objectEntry
+	for limit == 0 || len(entries) < limit {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case attrs.Prefix != "":
+			entries = append(entries, objectEntry{name: path.Base(strings.TrimSuffix(attrs.Prefix, "/")), dir: true})
+		case attrs.Name != prefix:
+			entries = append(entries, objectEntry{name: path.Base(attrs.Name), size: attrs.Size, modTime: attrs.Updated})
+		}
+	}
+	return entries, nil
+}
+
+func (g gcsStore) openRange(ctx context.Context, key string, off int64) (io.ReadCloser, error) {
+	return g.bucket.Object(key).NewRangeReader(ctx, off, -1)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// fakeGCS serves the parts of the cloud storage JSON and XML apis gcsStore uses, for the objects of fsys in bucket
+func fakeGCS(t *testing.T, bucket string, fsys fstest.MapFS) *httptest.Server {
+	t.Helper()
+	object := func(name string, f *fstest.MapFile) map[string]string {
+		return map[string]string{
+			"bucket":  bucket,
+			"name":    name,
+			"size":    strconv.Itoa(len(f.Data)),
+			"updated": f.ModTime.UTC().Format(time.RFC3339Nano),
+			"etag":    fmt.Sprintf("etag-%d", len(f.Data)),
+		}
+	}
+	notFound := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"code":404,"message":"Not Found"}}`)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api := "/storage/v1/b/" + bucket
+		switch p := r.URL.Path; {
+		case p == api:
+			json.NewEncoder(w).Encode(map[string]string{"name": bucket})
+		case p == api+"/o":
+			q := r.URL.Query()
+			prefix := q.Get("prefix")
+			var items []map[string]string
+			prefixes := map[string]bool{}
+			for name, f := range fsys {
+				rest, ok := strings.CutPrefix(name, prefix)
+				if !ok {
+					continue
+				}
+				if i := strings.Index(rest, "/"); i >= 0 && q.Get("delimiter") == "/" {
+					prefixes[prefix+rest[:i+1]] = true
+					continue
+				}
+				items = append(items, object(name, f))
+			}
+			resp := map[string]any{"kind": "storage#objects", "items": items, "prefixes": sortedKeys(prefixes)}
+			json.NewEncoder(w).Encode(resp)
+		case strings.HasPrefix(p, api+"/o/"):
+			name := strings.TrimPrefix(p, api+"/o/")
+			f, ok := fsys[name]
+			if !ok {
+				notFound(w)
+				return
+			}
+			json.NewEncoder(w).Encode(object(name, f))
+		case strings.HasPrefix(p, "/"+bucket+"/"):
+			f, ok := fsys[strings.TrimPrefix(p, "/"+bucket+"/")]
+			if !ok {
+				notFound(w)
+				return
+			}
+			w.Header().Set("X-Goog-Generation", "1")
+			w.Header().Set("Last-Modified", f.ModTime.UTC().Format(http.TimeFormat))
+			off := 0
+			if rng := r.Header.Get("Range"); rng != "" {
+				fmt.Sscanf(rng, "bytes=%d-", &off)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, len(f.Data)-1, len(f.Data)))
+				w.Header().Set("Content-Length", strconv.Itoa(len(f.Data)-off))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			w.Write(f.Data[off:])
+		default:
+			notFound(w)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// sortedKeys returns the keys of set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestGCSBackend(t *testing.T) {
+	layout := testLayout(t)
+	srv := fakeGCS(t, "modules", layout)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	fsys, err := gcsBackend{bucket: "modules"}.FS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]string, 0, len(layout))
+	for name := range layout {
+		want = append(want, name)
+	}
+	if err := fstest.TestFS(fsys, want...); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat(fsys, "acme/vpc/aws/1.0.0/vpc.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := fi.(objectETag); !ok || e.ETag() == "" {
+		t.Error("objects don't carry the ETag gcs assigned them")
+	}
+
+	// The registry serves from it unchanged
+	h := newTestRegistry(t, layout)
+	setGlobal(t, &s3fsys, fsys)
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	if want := `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"1.0.0"},{"version":"1.2.0"},{"version":"10.0.0"}]}]}` + "\n"; w.Body.String() != want {
+		t.Errorf("versions %s, want %s", w.Body, want)
+	}
+	archive := layout["acme/vpc/aws/1.0.0/vpc.tgz"].Data
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil); w.Code != http.StatusOK || w.Body.String() != string(archive) {
+		t.Errorf("download: status %d, or not the object's contents", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil, "Range", "bytes=4-"); w.Code != http.StatusPartialContent || w.Body.String() != string(archive[4:]) {
+		t.Errorf("range: status %d, or not a ranged read of the object", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/azure/versions", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing module: status %d, want 404", w.Code)
+	}
+
+	if _, err := (gcsBackend{bucket: "missing"}).FS(); err == nil {
+		t.Error("missing bucket: no error")
+	}
+}
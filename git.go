@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hashicorp/go-version"
+)
+
+// gitFetchInterval is how often the repository's tags are fetched again, so newly pushed tags get served
+const gitFetchInterval = time.Minute
+
+// gitArchives caches the archives generated from tags by commit and directory, the oldest entry is evicted first
+var gitArchives = &archiveCache{}
+
+// gitBackend serves modules from the tags of a git repository, without a separate publish step.
+// A semver tag (v1.2.3 or 1.2.3) is a version of module, the <namespace>/<name>/<provider> set by -git-module,
+// archiving the whole tree. A <name>/v1.2.3 tag is a version of the module <name> in the same namespace and provider,
+// archiving the <name> directory of the tree, e.g. for monorepos
+type gitBackend struct {
+	url    string
+	module Module
+	// token authenticates https urls, ssh urls authenticate through the ssh agent
+	token string
+}
+
+func (b gitBackend) Name() string {
+	return b.url
+}
+
+func (b gitBackend) FS() (fs.FS, error) {
+	g := &gitFS{module: b.module, root: prefix}
+	if b.token != "" {
+		g.auth = &githttp.BasicAuth{Username: "tf-registry", Password: b.token}
+	}
+	// Only the objects are needed to archive tags, so the clone is bare and kept in memory
+	repo, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{URL: b.url, Auth: g.auth, Tags: git.AllTags})
+	if err != nil {
+		return nil, err
+	}
+	g.repo = repo
+	if err := g.index(); err != nil {
+		return nil, err
+	}
+	go g.run(gitFetchInterval)
+	return g, nil
+}
+
+// gitFS is a read-only fs.FS laying out the tags of a git repository like the s3 bucket, below -prefix.
+// Directories are served from an index of the tags, rebuilt whenever tags are fetched,
+// archives are generated from a tag's tree when they're first opened
+type gitFS struct {
+	module Module
+	root   string
+	auth   transport.AuthMethod
+
+	// mu guards the repository's in memory storage, which a fetch writes to
+	mu   sync.RWMutex
+	repo *git.Repository
+
+	// indexMu guards the index, which is swapped while the storage is only read locked
+	indexMu  sync.RWMutex
+	tree     *monolithFS
+	archives map[string]gitArchive
+}
+
+// gitArchive is the tree a module archive is generated from, a tag's commit and the directory of it
+type gitArchive struct {
+	commit plumbing.Hash
+	dir    string
+}
+
+// run fetches the repository's tags every interval, logging failures
+func (g *gitFS) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := g.fetch(); err != nil {
+			logger.Warn("failed to fetch git tags", slog.Any("error", err))
+		}
+	}
+}
+
+// fetch fetches the repository's tags, including moved and deleted ones, and indexes them again
+func (g *gitFS) fetch() error {
+	g.mu.Lock()
+	err := g.repo.Fetch(&git.FetchOptions{
+		Auth:     g.auth,
+		RefSpecs: []config.RefSpec{"+refs/tags/*:refs/tags/*"},
+		Tags:     git.NoTags,
+		Prune:    true,
+	})
+	g.mu.Unlock()
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+	return g.index()
+}
+
+// index rebuilds the directory tree of the repository's tags. Tags that aren't versions are skipped,
+// as are tags whose module name isn't a valid coordinate
+func (g *gitFS) index() error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	tree := &monolithFS{
+		files:   map[string]monolithEntry{".": {name: ".", dir: true}},
+		entries: map[string][]fs.DirEntry{},
+	}
+	archives := map[string]gitArchive{}
+	tags, err := g.repo.Tags()
+	if err != nil {
+		return err
+	}
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		m, dir, ok := g.parseTag(ref.Name().Short())
+		if !ok {
+			return nil
+		}
+		commit, err := g.tagCommit(ref)
+		if err != nil {
+			logger.Warn("skipping git tag that doesn't point at a commit", slog.String("tag", ref.Name().Short()), slog.Any("error", err))
+			return nil
+		}
+		key := path.Join(".", g.root, m.Namespace, m.Name, m.Provider, m.Version, archiveName(m))
+		archives[key] = gitArchive{commit: commit.Hash, dir: dir}
+		tree.add(monolithEntry{name: path.Base(key), modTime: commit.Committer.When}, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entries := range tree.entries {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	g.indexMu.Lock()
+	g.tree, g.archives = tree, archives
+	g.indexMu.Unlock()
+	return nil
+}
+
+// snapshot returns the current index
+func (g *gitFS) snapshot() (*monolithFS, map[string]gitArchive) {
+	g.indexMu.RLock()
+	defer g.indexMu.RUnlock()
+	return g.tree, g.archives
+}
+
+// parseTag returns the module version a tag is, and the directory of the tree its archive is generated from
+func (g *gitFS) parseTag(tag string) (m Module, dir string, ok bool) {
+	m = g.module
+	v := tag
+	if name, rest, found := strings.Cut(tag, "/"); found {
+		if !validCoordinate(name) {
+			return m, "", false
+		}
+		m.Name, dir, v = name, name, rest
+	}
+	if _, err := version.NewSemver(v); err != nil {
+		return m, "", false
+	}
+	// Versions are served without the v prefix, as terraform expects
+	m.Version = strings.TrimPrefix(v, "v")
+	return m, dir, true
+}
+
+// tagCommit returns the commit a tag points at, peeling annotated tags
+func (g *gitFS) tagCommit(ref *plumbing.Reference) (*object.Commit, error) {
+	if tag, err := g.repo.TagObject(ref.Hash()); err == nil {
+		return tag.Commit()
+	}
+	return g.repo.CommitObject(ref.Hash())
+}
+
+// Open implements fs.FS
+func (g *gitFS) Open(name string) (fs.File, error) {
+	tree, archives := g.snapshot()
+	a, ok := archives[name]
+	if !ok {
+		return tree.Open(name)
+	}
+	e, err := tree.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := g.archive(a)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	e.size = int64(len(b))
+	return &gitFile{Reader: bytes.NewReader(b), entry: e}, nil
+}
+
+// Stat implements fs.StatFS, the size of an archive is only known once it's generated
+func (g *gitFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := g.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// ReadDir implements fs.ReadDirFS, archives are listed without their size
+func (g *gitFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	tree, _ := g.snapshot()
+	return tree.ReadDir(name)
+}
+
+// archive returns the gzipped tarball of a tag's tree, through the archive cache
+func (g *gitFS) archive(a gitArchive) ([]byte, error) {
+	cacheKey := a.commit.String() + ":" + a.dir
+	if b, ok := gitArchives.get(cacheKey); ok {
+		return b, nil
+	}
+	g.mu.RLock()
+	b, err := g.buildArchive(a)
+	g.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	gitArchives.put(cacheKey, b)
+	return b, nil
+}
+
+// buildArchive archives a tag's tree. Entries carry the commit's time rather than the time they're archived,
+// so the same tag always produces the same archive. Submodules aren't archived
+func (g *gitFS) buildArchive(a gitArchive) ([]byte, error) {
+	commit, err := g.repo.CommitObject(a.commit)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if a.dir != "" {
+		if tree, err = tree.Tree(a.dir); err != nil {
+			return nil, fmt.Errorf("directory %s of commit %s: %w", a.dir, a.commit, err)
+		}
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	modTime := commit.Committer.When
+	err = tree.Files().ForEach(func(f *object.File) error {
+		hdr := &tar.Header{Name: f.Name, ModTime: modTime, Mode: 0644, Typeflag: tar.TypeReg, Size: f.Size}
+		switch f.Mode {
+		case filemode.Executable:
+			hdr.Mode = 0755
+		case filemode.Symlink:
+			target, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			hdr.Mode, hdr.Typeflag, hdr.Size, hdr.Linkname = 0777, tar.TypeSymlink, 0, target
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gitFile is an opened archive of a gitFS, it's seekable so ranges can be served
+type gitFile struct {
+	*bytes.Reader
+	entry monolithEntry
+}
+
+func (f *gitFile) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *gitFile) Close() error               { return nil }
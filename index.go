@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// moduleIndex is an in memory list of every module coordinate in the backend,
+// it is rebuilt periodically by walking the whole registry
+type moduleIndex struct {
+	mu      sync.RWMutex
+	modules []Module
+}
+
+// refresh rebuilds the index from the backend, listings are paced by -index-delay
+func (idx *moduleIndex) refresh(fsys fs.FS, root string) error {
+	mods, err := walkModules(fsys, root, walkConcurrency, &listPacer{delay: indexDelay})
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	idx.modules = mods
+	idx.mu.Unlock()
+	return nil
+}
+
+// run refreshes the index every interval until the process exits
+func (idx *moduleIndex) run(fsys fs.FS, root string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := idx.refresh(fsys, root); err != nil {
+			logger.Error("failed to refresh module index", slog.Any("error", err))
+		}
+	}
+}
+
+// Modules returns the current list of indexed modules
+func (idx *moduleIndex) Modules() []Module {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.modules
+}
+
+// suggestModules returns up to max indexed module addresses ({namespace}/{name}/{provider}) that are
+// close to m by edit distance, closest first, from the namespaces readable allows. Only small typos are considered a match,
+// so that an unrelated module name yields no suggestions at all
+func suggestModules(idx *moduleIndex, m Module, max int, readable func(namespace string) bool) []string {
+	want := m.Namespace + "/" + m.Name + "/" + m.Provider
+	type match struct {
+		addr string
+		dist int
+	}
+	var matches []match
+	for _, c := range idx.Modules() {
+		if !readable(c.Namespace) {
+			continue
+		}
+		addr := c.Namespace + "/" + c.Name + "/" + c.Provider
+		d := editDistance(want, addr)
+		if d > 0 && d <= 3 && d*3 <= len(want) {
+			matches = append(matches, match{addr, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].addr < matches[j].addr
+	})
+	suggestions := []string{}
+	for i := 0; i < len(matches) && i < max; i++ {
+		suggestions = append(suggestions, matches[i].addr)
+	}
+	return suggestions
+}
+
+// editDistance returns the levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSuggestModules(t *testing.T) {
+	idx := &moduleIndex{modules: []Module{
+		{Namespace: "acme", Name: "vpc", Provider: "aws"},
+		{Namespace: "acme", Name: "vpn", Provider: "aws"},
+		{Namespace: "acme", Name: "database", Provider: "aws"},
+		{Namespace: "other", Name: "vpc", Provider: "aws"},
+	}}
+	all := func(string) bool { return true }
+	cases := []struct {
+		name string
+		m    Module
+		want []string
+	}{
+		{"near miss", Module{Namespace: "acme", Name: "vcp", Provider: "aws"}, []string{"acme/vpc/aws", "acme/vpn/aws"}},
+		{"typo in a long name", Module{Namespace: "acme", Name: "databse", Provider: "aws"}, []string{"acme/database/aws"}},
+		{"unrelated", Module{Namespace: "acme", Name: "kubernetes", Provider: "aws"}, []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := suggestModules(idx, c.m, 5, all); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+	if got := suggestModules(idx, Module{Namespace: "acme", Name: "vcp", Provider: "aws"}, 1, all); len(got) != 1 {
+		t.Errorf("max 1: got %q", got)
+	}
+	onlyOther := func(ns string) bool { return ns == "other" }
+	if got, want := suggestModules(idx, Module{Namespace: "othr", Name: "vpc", Provider: "aws"}, 5, onlyOther), []string{"other/vpc/aws"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readable namespaces: got %q, want %q", got, want)
+	}
+}
+
+// TestSuggestionsRespectAuth checks a public namespace's 404 only suggests modules the caller can read
+func TestSuggestionsRespectAuth(t *testing.T) {
+	setGlobal(t, &authTokens, &tokenStore{static: []string{"s3cret"}})
+	setGlobal(t, &publicNamespaces, map[string]bool{"public": true})
+	setGlobal(t, &maxSuggestions, 5)
+	setGlobal(t, &modIndex, &moduleIndex{modules: []Module{
+		{Namespace: "public", Name: "vpc", Provider: "aws"},
+		{Namespace: "publix", Name: "vpc", Provider: "aws"},
+	}})
+	h := newTestRegistry(t, testLayout(t))
+	suggestions := func(headers ...string) []string {
+		t.Helper()
+		w := serve(h, http.MethodGet, "/terraform/modules/v1/public/vpn/aws/versions", nil, headers...)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("status %d, want 404", w.Code)
+		}
+		var resp ErrorResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Suggestions
+	}
+	if got, want := suggestions(), []string{"public/vpc/aws"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without a token: got %q, want %q", got, want)
+	}
+	if got, want := suggestions("Authorization", "Bearer s3cret"), []string{"public/vpc/aws", "publix/vpc/aws"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with a token: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// limiterTolerance is how far above the best observed latency downloads may get before the limit is lowered
+	limiterTolerance = 2.0
+	// limiterBaselineDrift is how quickly the best observed latency is forgotten,
+	// so a backend that gets permanently slower doesn't pin the limit at its minimum
+	limiterBaselineDrift = 1.01
+)
+
+// downloadLimit tracks the current concurrency limit of the download limiter
+var downloadLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "tfregistry_download_concurrency_limit",
+	Help: "Current adaptive limit on concurrent module downloads.",
+})
+
+// adaptiveLimiter limits concurrent work to a limit that adapts to observed latency, additively increasing it
+// while latency stays close to the best seen and multiplicatively decreasing it once latency rises beyond that.
+// Latency is the backend's time to first byte, opening and stating the archive, so large archives or slow clients
+// streaming them aren't mistaken for a slow backend
+type adaptiveLimiter struct {
+	min, max int
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	baseline float64
+	waiters  []chan struct{}
+}
+
+// newAdaptiveLimiter returns a limiter whose limit starts at max and adapts between 1 and max
+func newAdaptiveLimiter(max int) *adaptiveLimiter {
+	l := &adaptiveLimiter{min: 1, max: max, limit: float64(max)}
+	downloadLimit.Set(l.limit)
+	return l
+}
+
+// acquire waits for a free slot, the returned error is the context's if the request is cancelled first
+func (l *adaptiveLimiter) acquire(r *http.Request) error {
+	l.mu.Lock()
+	if l.inflight < int(l.limit) {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-r.Context().Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, w := range l.waiters {
+			if w == ch {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				return r.Context().Err()
+			}
+		}
+		// The slot was handed over as the request was cancelled, so pass it on
+		l.inflight--
+		l.wake()
+		return r.Context().Err()
+	}
+}
+
+// release frees a slot, adjusting the limit from the backend latency of the finished download when it reached the backend
+func (l *adaptiveLimiter) release(lat *downloadTTFB) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if lat.observed {
+		l.observe(lat.ttfb.Seconds())
+	}
+	l.wake()
+}
+
+// observe adjusts the limit from a latency sample in seconds, l.mu must be held
+func (l *adaptiveLimiter) observe(latency float64) {
+	if l.baseline == 0 || latency < l.baseline {
+		l.baseline = latency
+	} else {
+		l.baseline *= limiterBaselineDrift
+	}
+	if latency > l.baseline*limiterTolerance {
+		l.limit *= 0.9
+	} else {
+		// roughly +1 for every limit's worth of downloads
+		l.limit += 1 / l.limit
+	}
+	if l.limit < float64(l.min) {
+		l.limit = float64(l.min)
+	}
+	if l.limit > float64(l.max) {
+		l.limit = float64(l.max)
+	}
+	downloadLimit.Set(l.limit)
+}
+
+// wake hands free slots to waiting requests in arrival order, l.mu must be held
+func (l *adaptiveLimiter) wake() {
+	for len(l.waiters) > 0 && l.inflight < int(l.limit) {
+		l.inflight++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// downloadTTFB is the backend's time to first byte for a download, reported by observeDownloadTTFB
+type downloadTTFB struct {
+	ttfb     time.Duration
+	observed bool
+}
+
+// downloadTTFBKey is the context key of a download's downloadTTFB
+type downloadTTFBKey struct{}
+
+// observeDownloadTTFB reports the backend's time to first byte for a download to its limiter, if it has one
+func observeDownloadTTFB(ctx context.Context, ttfb time.Duration) {
+	if lat, ok := ctx.Value(downloadTTFBKey{}).(*downloadTTFB); ok {
+		lat.ttfb, lat.observed = ttfb, true
+	}
+}
+
+// limitDownloads is a middleware limiting concurrent downloads with l, requests queue for a free slot.
+// Downloads that never reach the backend, e.g. redirects or cached transforms, don't adjust the limit
+func limitDownloads(l *adaptiveLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := l.acquire(r); err != nil {
+				renderError(w, r, http.StatusServiceUnavailable, err)
+				return
+			}
+			lat := &downloadTTFB{}
+			defer l.release(lat)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), downloadTTFBKey{}, lat)))
+		})
+	}
+}
+
+// unlimitedPaths are exempt from the in-flight request limit, so health checks and scrapes keep working under load
+var unlimitedPaths = map[string]bool{"/healthz": true, "/metrics": true, "/is_alive": true}
+
+// limitInFlight is a middleware limiting how many requests are served at once to limit. A request over the limit
+// queues for a free slot for up to wait, after which it gets a 503 with a Retry-After of wait
+func limitInFlight(limit int, wait time.Duration) func(http.Handler) http.Handler {
+	sem := make(chan struct{}, limit)
+	retryAfter := fmt.Sprint(max(1, int(math.Ceil(wait.Seconds()))))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if unlimitedPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			select {
+			case sem <- struct{}{}:
+			default:
+				timer := time.NewTimer(wait)
+				defer timer.Stop()
+				select {
+				case sem <- struct{}{}:
+				case <-timer.C:
+					w.Header().Set("Retry-After", retryAfter)
+					renderError(w, r, http.StatusServiceUnavailable, errors.New("too many requests in flight"))
+					return
+				case <-r.Context().Done():
+					renderError(w, r, http.StatusServiceUnavailable, r.Context().Err())
+					return
+				}
+			}
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
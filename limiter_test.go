@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// latencyFS is a backend taking delay to open objects
+type latencyFS struct {
+	fs.FS
+	delay *time.Duration
+}
+
+func (l latencyFS) Open(name string) (fs.File, error) {
+	time.Sleep(*l.delay)
+	return l.FS.Open(name)
+}
+
+func TestAdaptiveLimiterAdapts(t *testing.T) {
+	l := newAdaptiveLimiter(16)
+	observe := func(latency time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			if err := l.acquire(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			l.release(&downloadTTFB{ttfb: latency, observed: true})
+		}
+	}
+	observe(10*time.Millisecond, 20)
+	if l.limit != 16 {
+		t.Fatalf("limit %v at a steady latency, want the max 16", l.limit)
+	}
+	observe(100*time.Millisecond, 10)
+	lowered := l.limit
+	if lowered >= 16 || lowered < 1 {
+		t.Fatalf("limit %v once latency rose, want it lowered", lowered)
+	}
+	if got := testutil.ToFloat64(downloadLimit); got != lowered {
+		t.Errorf("limit metric %v, want %v", got, lowered)
+	}
+	observe(time.Second, 200)
+	if l.limit != 1 {
+		t.Errorf("limit %v under a sustained rise, want the min 1", l.limit)
+	}
+
+	// Downloads that don't reach the backend leave the limit alone
+	before := l.limit
+	l.acquire(httptest.NewRequest(http.MethodGet, "/", nil))
+	l.release(&downloadTTFB{})
+	if l.limit != before {
+		t.Errorf("limit %v after an unobserved download, want %v", l.limit, before)
+	}
+
+	observe(10*time.Millisecond, 400)
+	if l.limit <= before {
+		t.Errorf("limit %v once latency recovered, want it raised from %v", l.limit, before)
+	}
+}
+
+func TestDownloadLimitFollowsBackendLatency(t *testing.T) {
+	// Far enough above scheduling jitter that the fast backend's latency stays within the limiter's tolerance
+	delay := 5 * time.Millisecond
+	setGlobal(t, &maxDownloads, 8)
+	fsys := testLayout(t)
+	// A large archive from a fast backend takes long to stream, but isn't a slow backend
+	fsys["acme/big/aws/1.0.0/big.tgz"] = testFile(bytes.Repeat([]byte("x"), 8<<20))
+	h := newTestRegistry(t, fsys)
+	setGlobal(t, &s3fsys, fs.FS(latencyFS{FS: fsys, delay: &delay}))
+
+	download := func(p string, n int) {
+		for i := 0; i < n; i++ {
+			if w := serve(h, http.MethodGet, p, nil); w.Code != http.StatusOK {
+				t.Fatalf("%s: status %d", p, w.Code)
+			}
+		}
+	}
+	download("/download/acme/vpc/aws/1.0.0/vpc.tgz", 5)
+	download("/download/acme/big/aws/1.0.0/big.tgz", 5)
+	if got := testutil.ToFloat64(downloadLimit); got != 8 {
+		t.Fatalf("limit %v with a fast backend, want the max 8", got)
+	}
+	delay = 60 * time.Millisecond
+	download("/download/acme/vpc/aws/1.0.0/vpc.tgz", 5)
+	if got := testutil.ToFloat64(downloadLimit); got >= 8 {
+		t.Errorf("limit %v once the backend slowed down, want it lowered", got)
+	}
+}
+
+func TestLimitDownloadsKeepsTheWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	h := limitDownloads(newAdaptiveLimiter(1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streaming responses rely on the server's writer, e.g. flushing or io.ReaderFrom's sendfile
+		if w != http.ResponseWriter(rec) {
+			t.Errorf("handler got a %T, want the server's writer", w)
+		}
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("writer isn't a http.Flusher")
+		}
+	}))
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil))
+}
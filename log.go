@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// logger is the registry's structured logger, configured from flags in main
+var logger = slog.Default()
+
+// newLogger builds a logger writing to stderr at the named level, in the named format (text or json).
+// Lines logged within a traced request carry its trace and span ids
+func newLogger(level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(traceLogHandler{slog.NewTextHandler(os.Stderr, opts)}), nil
+	case "json":
+		return slog.New(traceLogHandler{slog.NewJSONHandler(os.Stderr, opts)}), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, must be one of text or json", format)
+}
+
+// requestLogger is a middleware logging one structured line per request once it has been served
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// Handlers may rewrite the path (e.g. archive fallback), the path requested is the one logged
+		method, path := r.Method, r.URL.Path
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		ip := clientIP(r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", method),
+			slog.String("path", path),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("remote_ip", ip),
+		)
+	})
+}
+
+// moduleAttrs returns the log attributes identifying a module
+func moduleAttrs(m Module) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("namespace", m.Namespace),
+		slog.String("name", m.Name),
+		slog.String("provider", m.Provider),
+	}
+	if m.Version != "" {
+		attrs = append(attrs, slog.String("version", m.Version))
+	}
+	return attrs
+}
+
+// logBackendAccess logs an access to the backend object key on behalf of module m.
+// Only the module coordinates are logged by default, the raw key exposes the bucket prefix layout
+// so it's only included when running at debug level or when -log-keys is set
+func logBackendAccess(ctx context.Context, level slog.Level, msg string, m Module, key string, attrs ...slog.Attr) {
+	logKeyAccess(ctx, level, msg, key, append(moduleAttrs(m), attrs...))
+}
+
+// logKeyAccess logs an access to the backend object key, with the raw key included only as described for logBackendAccess
+func logKeyAccess(ctx context.Context, level slog.Level, msg string, key string, attrs []slog.Attr) {
+	if logKeys || logger.Enabled(ctx, slog.LevelDebug) {
+		attrs = append(attrs, slog.String("key", key))
+	}
+	if id := middleware.GetReqID(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// parseDownloadPath splits a /download/* path into the module coordinates and archive file name it refers to
+func parseDownloadPath(p string) (Module, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(p, "/download/"), "/")
+	if len(parts) != 5 {
+		return Module{}, "", false
+	}
+	return Module{
+		Namespace: parts[0],
+		Name:      parts[1],
+		Provider:  parts[2],
+		Version:   parts[3],
+	}, parts[4], true
+}
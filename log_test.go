@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestLogBackendAccessFields checks the raw backend key is only logged at debug level or with -log-keys
+func TestLogBackendAccessFields(t *testing.T) {
+	m := Module{Namespace: "acme", Name: "vpc", Provider: "aws", Version: "1.0.0"}
+	cases := []struct {
+		name    string
+		level   slog.Level
+		logKeys bool
+		want    []string
+	}{
+		{"info", slog.LevelInfo, false, []string{"level", "msg", "name", "namespace", "provider", "time", "version"}},
+		{"info with -log-keys", slog.LevelInfo, true, []string{"key", "level", "msg", "name", "namespace", "provider", "time", "version"}},
+		{"debug", slog.LevelDebug, false, []string{"key", "level", "msg", "name", "namespace", "provider", "time", "version"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			setGlobal(t, &logger, slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: c.level})))
+			setGlobal(t, &logKeys, c.logKeys)
+			logBackendAccess(context.Background(), slog.LevelInfo, "served", m, "secret/prefix/acme/vpc/aws/1.0.0/vpc.tgz")
+			var line map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for k := range line {
+				fields = append(fields, k)
+			}
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, c.want) {
+				t.Errorf("fields %q, want %q", fields, c.want)
+			}
+		})
+	}
+}
@@ -1,38 +1,80 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
+	"log/slog"
+	"mime"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/jszwec/s3fs"
+	"github.com/hashicorp/go-version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // ModuleBasePath is the base v1 api path for the terraform registry
 const ModuleBasePath = "/terraform/modules/v1"
 
+// compressLevel is the gzip level of compressed JSON responses, a middle ground between cpu and size
+const compressLevel = 5
+
 // ServiceDiscoveryResp is our service discovery response struct
 type ServiceDiscoveryResp struct {
-	ModulesV1 string `json:"modules.v1"`
+	ModulesV1   string `json:"modules.v1"`
+	ProvidersV1 string `json:"providers.v1"`
 }
 
-// Module versions is a list of module version maps
+// Module versions is a list of module versions, source is the module's <namespace>/<name>/<provider> address
 type ModuleVersions struct {
-	Versions []map[string]string `json:"versions"`
+	Source   string          `json:"source"`
+	Versions []ModuleVersion `json:"versions"`
+}
+
+// ModuleVersion is a single available version of a module,
+// terraform only reads the version and ignores any other fields
+type ModuleVersion struct {
+	Version      string             `json:"version"`
+	Dependencies []ModuleDependency `json:"dependencies,omitempty"`
+	// PublishedAt is only set with -published-at
+	PublishedAt string `json:"published_at,omitempty"`
 }
 
 // ModuleVersionsResp is our module versions response struct
 type ModuleVersionsResp struct {
 	Modules []ModuleVersions `json:"modules"`
+	// Page is only set on paginated listings
+	Page *VersionsPage `json:"meta,omitempty"`
+	// listed is the number of versions found when the listing was truncated to -max-versions, otherwise 0
+	listed int
+}
+
+// errTooManyVersions is returned for modules with more than -max-versions versions with -max-versions-strict
+var errTooManyVersions = errors.New("module has too many versions")
+
+// ModuleProvidersResp is our module providers response struct
+type ModuleProvidersResp struct {
+	Providers []string `json:"providers"`
+}
+
+// ErrorResp is our error response struct
+type ErrorResp struct {
+	Errors      []string `json:"errors"`
+	Suggestions []string `json:"suggestions,omitempty"`
 }
 
 // Module respresents a terraform module
@@ -44,32 +86,107 @@ type Module struct {
 }
 
 // getModuleVersions is a helper function to look up all versions for a module
-func getModuleVersions(modPath string) (ModuleVersionsResp, error) {
-	m := ModuleVersions{}
-	versionDirs, err := fs.ReadDir(s3fsys, modPath)
+func getModuleVersions(ctx context.Context, mod Module) (ModuleVersionsResp, error) {
+	modPath := backendKey(ctx, mod.Namespace, mod.Name, mod.Provider)
+	_, span := startModuleSpan(ctx, "backend.list_versions", mod, modPath)
+	m := ModuleVersions{Source: mod.Namespace + "/" + mod.Name + "/" + mod.Provider}
+	// Read in pages keeping only the newest -max-versions, so a huge listing never has to fit in memory
+	kept := &boundedVersions{n: maxVersions, heap: versionHeap{newest: true}}
+	total, err := readVersionDirs(moduleFS(ctx), modPath, m.Source, kept)
+	endSpan(span, err)
 	if err != nil {
 		return ModuleVersionsResp{}, err
 	}
-	for _, v := range versionDirs {
-		vers := map[string]string{"version": v.Name()}
-		m.Versions = append(m.Versions, vers)
+	listed := 0
+	if kept.dropped {
+		if strictMaxVersions {
+			return ModuleVersionsResp{}, fmt.Errorf("%w, %d of at most %d", errTooManyVersions, total, maxVersions)
+		}
+		logger.Warn("truncating module versions to the newest -max-versions", slog.String("source", m.Source), slog.Int("versions", total), slog.Int("max_versions", maxVersions))
+		listed = total
+	}
+	// Backends list lexicographically (10.0.0 before 2.0.0), terraform expects versions in ascending semver order
+	semvers := kept.sorted()
+	m.Versions = make([]ModuleVersion, 0, len(semvers))
+	for _, sv := range semvers {
+		m.Versions = append(m.Versions, ModuleVersion{Version: sv.Original()})
 	}
 	return ModuleVersionsResp{
 		Modules: []ModuleVersions{m},
+		listed:  listed,
 	}, nil
 }
 
+// filterVersions returns the versions of a module's listing matching constraints, in the same order.
+// modVers is a shared cached listing, so the matches are copied rather than filtered in place
+func filterVersions(modVers ModuleVersionsResp, constraints version.Constraints) ModuleVersionsResp {
+	m := modVers.Modules[0]
+	matches := []ModuleVersion{}
+	for _, v := range m.Versions {
+		if sv, err := version.NewSemver(v.Version); err == nil && constraints.Check(sv) {
+			matches = append(matches, v)
+		}
+	}
+	m.Versions = matches
+	return ModuleVersionsResp{Modules: []ModuleVersions{m}}
+}
+
 ///////////////////
 // HTTP HANDLERS //
 ///////////////////
 
 // httpGetServiceDiscovery is a http handler for returning the
-// base path for the modules API provided by this registry
+// base path for the modules API provided by this registry.
+// The document only changes between deployments, so it's cacheable for -discovery-max-age and revalidated by ETag
 func httpGetServiceDiscovery(w http.ResponseWriter, r *http.Request) {
-	// Service discovery resp
-	s := ServiceDiscoveryResp{ModulesV1: ModuleBasePath}
+	// Service discovery resp, the trailing slash makes terraform resolve module paths below the base path
+	s := ServiceDiscoveryResp{ModulesV1: baseURL + ModuleBasePath + "/", ProvidersV1: baseURL + ProviderBasePath + "/"}
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+	etag := fmt.Sprintf(`"%x"`, sum[:16])
+	w.Header().Set("ETag", etag)
+	if discoveryMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(discoveryMaxAge.Seconds())))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// HealthResp is our healthcheck response struct
+type HealthResp struct {
+	Status string `json:"status"`
+}
+
+// httpHealthcheck is a http handler for readiness probes, it stats the -health-probe path in our fs.FS backend
+// and responds with a 503 describing the failure when the backend doesn't respond, e.g. expired credentials
+func httpHealthcheck(w http.ResponseWriter, r *http.Request) {
+	if _, err := fs.Stat(moduleFS(r.Context()), healthProbe); err != nil {
+		backendUp.Set(0)
+		renderError(w, r, http.StatusServiceUnavailable, fmt.Errorf("backend unavailable: %w", err))
+		return
+	}
+	backendUp.Set(1)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s)
+	json.NewEncoder(w).Encode(HealthResp{Status: "ok"})
+}
+
+// moduleVersions returns the versions of a module, through the versions cache
+func moduleVersions(ctx context.Context, m Module) (ModuleVersionsResp, error) {
+	modPath := backendKey(ctx, m.Namespace, m.Name, m.Provider)
+	return versionsCache.get(ctx, modPath, func(ctx context.Context) (ModuleVersionsResp, error) {
+		modVers, err := getModuleVersions(ctx, m)
+		if err == nil && includeDependencies {
+			err = addDependencies(ctx, m, modVers)
+		}
+		if err == nil && includePublished {
+			err = addPublishedTimes(ctx, m, modVers)
+		}
+		return modVers, err
+	})
 }
 
 // httpGetVersions is a http handler for retrieving a list of module versions
@@ -83,16 +200,209 @@ func httpGetVersions(w http.ResponseWriter, r *http.Request) {
 		Name:      chi.URLParam(r, "name"),
 		Provider:  chi.URLParam(r, "provider"),
 	}
-	modPath := filepath.Join(prefix, m.Namespace, m.Name, m.Provider)
-	modVers, err := getModuleVersions(modPath)
+	modPath := backendKey(r.Context(), m.Namespace, m.Name, m.Provider)
+	// Terraform never paginates, the page and per_page params are for registry UIs
+	page, perPage, paginate, err := parsePage(r.URL.Query())
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// The constraint param is for tooling, terraform filters versions itself
+	var constraints version.Constraints
+	if c := r.URL.Query().Get("constraint"); c != "" {
+		if constraints, err = version.NewConstraint(c); err != nil {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid constraint %q: %s", c, err))
+			return
+		}
+	}
+	modVers, err := moduleVersions(r.Context(), m)
 	if err != nil {
-		// TODO handle module not found with 404
-		http.Error(w, err.Error(), 500)
+		if errors.Is(err, errTooManyVersions) {
+			renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			resp := ErrorResp{Errors: []string{"module not found"}}
+			// The index only covers the configured prefix, suggesting from it would leak modules into tenants
+			if maxSuggestions > 0 && !isTenantRequest(r.Context()) {
+				// Only namespaces the caller can read are suggested, a public namespace's 404 mustn't reveal private modules
+				resp.Suggestions = suggestModules(modIndex, m, maxSuggestions, func(ns string) bool { return canRead(r, ns) })
+			}
+			renderErrorResp(w, r, http.StatusNotFound, resp)
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to list module versions", m, modPath, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	logBackendAccess(r.Context(), slog.LevelInfo, "listed module versions", m, modPath)
+	if modVers.listed > 0 {
+		w.Header().Set("Warning", fmt.Sprintf(`199 - "versions truncated to the newest %d of %d"`, maxVersions, modVers.listed))
+	}
+	if constraints != nil {
+		modVers = filterVersions(modVers, constraints)
+	}
+	if paginate {
+		modVers = paginateVersions(r, modVers, page, perPage)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(modVers)
 }
 
+// ModuleLatestResp is our latest version response struct
+type ModuleLatestResp struct {
+	Version string `json:"version"`
+}
+
+// latestVersion returns the greatest non pre-release version of a module's (sorted) versions, empty if there is none
+func latestVersion(versions []ModuleVersion) string {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if v, err := version.NewSemver(versions[i].Version); err == nil && v.Prerelease() == "" {
+			return versions[i].Version
+		}
+	}
+	return ""
+}
+
+// httpGetLatestVersion is a http handler for retrieving the greatest version of a module,
+// pre-releases are skipped as terraform never resolves a version constraint to one
+func httpGetLatestVersion(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+		Provider:  chi.URLParam(r, "provider"),
+	}
+	modPath := backendKey(r.Context(), m.Namespace, m.Name, m.Provider)
+	modVers, err := moduleVersions(r.Context(), m)
+	if err != nil {
+		if errors.Is(err, errTooManyVersions) {
+			renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module not found"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to list module versions", m, modPath, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	latest := latestVersion(modVers.Modules[0].Versions)
+	if latest == "" {
+		renderError(w, r, http.StatusNotFound, errors.New("module has no versions"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	logBackendAccess(r.Context(), slog.LevelInfo, "resolved latest module version", m, modPath)
+	json.NewEncoder(w).Encode(ModuleLatestResp{Version: latest})
+}
+
+// ReadmeFile is the optional README published alongside a module version's tarball
+const ReadmeFile = "README.md"
+
+// ModuleDetailsResp is our module version details response struct, the readme is empty
+// and the metadata null when the version directory has no README.md or metadata.json
+type ModuleDetailsResp struct {
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Provider  string          `json:"provider"`
+	Version   string          `json:"version"`
+	Readme    string          `json:"readme"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// httpGetModuleDetails is a http handler for retrieving the details of a module version,
+// i.e. the README.md and metadata.json stored alongside its tarball in the version directory
+func httpGetModuleDetails(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+		Provider:  chi.URLParam(r, "provider"),
+		Version:   chi.URLParam(r, "version"),
+	}
+	versionPath := backendKey(r.Context(), m.Namespace, m.Name, m.Provider, m.Version)
+	fi, err := fs.Stat(moduleFS(r.Context()), versionPath)
+	if err == nil && !fi.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module version not found"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to stat module version", m, versionPath, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+
+	resp := ModuleDetailsResp{
+		Namespace: m.Namespace,
+		Name:      m.Name,
+		Provider:  m.Provider,
+		Version:   m.Version,
+		Metadata:  json.RawMessage("null"),
+	}
+	readme, err := fs.ReadFile(moduleFS(r.Context()), path.Join(versionPath, ReadmeFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to read module readme", m, versionPath, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	resp.Readme = string(readme)
+	metadata, err := fs.ReadFile(moduleFS(r.Context()), path.Join(versionPath, MetadataFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to read module metadata", m, versionPath, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	if err == nil {
+		if !json.Valid(metadata) {
+			logBackendAccess(r.Context(), slog.LevelError, "module metadata is not valid json", m, versionPath)
+			renderError(w, r, 500, errors.New(MetadataFile+" is not valid json"))
+			return
+		}
+		resp.Metadata = metadata
+	}
+	logBackendAccess(r.Context(), slog.LevelInfo, "served module details", m, versionPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// httpGetProviders is a http handler for retrieving the providers a module name is published for,
+// i.e. the provider sub-directories of {registry_namespace}/{module_name}/ in our fs.FS backend
+func httpGetProviders(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+	}
+	namePath := backendKey(r.Context(), m.Namespace, m.Name)
+	providers, err := providersCache.get(r.Context(), namePath, func(ctx context.Context) ([]string, error) {
+		entries, err := fs.ReadDir(moduleFS(ctx), namePath)
+		if err != nil {
+			return nil, err
+		}
+		providers := []string{}
+		for _, e := range entries {
+			if e.IsDir() {
+				providers = append(providers, e.Name())
+			}
+		}
+		return providers, nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to list module providers", m, namePath, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	if len(providers) == 0 {
+		renderError(w, r, http.StatusNotFound, errors.New("module not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	logBackendAccess(r.Context(), slog.LevelInfo, "listed module providers", m, namePath)
+	json.NewEncoder(w).Encode(ModuleProvidersResp{Providers: providers})
+}
+
 // httpGetDownLoadURL is a http handler for retrieving the final download URL for a terraform module,
 // the terraform client expects an empty response (204),
 // the download URL is set in the header X-Terraform-Get
@@ -103,43 +413,514 @@ func httpGetDownloadURL(w http.ResponseWriter, r *http.Request) {
 		Provider:  chi.URLParam(r, "provider"),
 		Version:   chi.URLParam(r, "version"),
 	}
-	tfGetHeader := filepath.Join(
+	file, ok := resolveDownload(w, r, m, archiveName(m))
+	if !ok {
+		return
+	}
+	// Archives holding several modules point terraform at the module's directory within them
+	subdir, err := archiveSubdir(r.Context(), m)
+	if err != nil {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to read module archive subdir", m, backendKey(r.Context(), m.Namespace, m.Name, m.Provider, m.Version, MetadataFile), slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	// Terraform verifies the archive it downloads against a checksum query param, which go-getter strips before fetching
+	var checksumQuery string
+	// Redirected modules are served from elsewhere, so the archive isn't expected in our backend
+	if _, redirected := redirectFor(m); !redirected {
+		key := backendKey(r.Context(), m.Namespace, m.Name, m.Provider, m.Version, file)
+		if _, err := fs.Stat(moduleFS(r.Context()), key); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				renderError(w, r, http.StatusNotFound, errors.New("module not found"))
+				return
+			}
+			logBackendAccess(r.Context(), slog.LevelError, "failed to look up module archive", m, key, slog.Any("error", err))
+			renderError(w, r, 500, err)
+			return
+		}
+		// Transformed archives no longer match the published checksum
+		transformed := len(transformsFor(m, file)) > 0
+		if !transformed {
+			sum, err := archiveChecksum(r.Context(), m, file)
+			if err != nil {
+				logBackendAccess(r.Context(), slog.LevelError, "failed to read module archive checksum", m, key, slog.Any("error", err))
+				renderError(w, r, 500, err)
+				return
+			}
+			if sum == "" {
+				logBackendAccess(r.Context(), slog.LevelWarn, "module archive has no published checksum", m, key)
+			} else {
+				checksumQuery = "checksum=sha256:" + sum
+			}
+		}
+		// Send terraform straight to the backend rather than proxying the archive through /download,
+		// transformed archives only exist once they've been through the proxy
+		if downloadSigner != nil && !transformed {
+			_, span := startModuleSpan(r.Context(), "backend.presign", m, key)
+			signed, err := downloadSigner.presign(key, presignTTL)
+			endSpan(span, err)
+			if err != nil {
+				logBackendAccess(r.Context(), slog.LevelError, "failed to presign module download", m, key, slog.Any("error", err))
+				renderError(w, r, 500, err)
+				return
+			}
+			if checksumQuery != "" {
+				signed += "&" + checksumQuery
+			}
+			logBackendAccess(r.Context(), slog.LevelInfo, "presigned module download", m, key)
+			w.Header().Set("X-Terraform-Get", withSubdir(signed, subdir))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	tfGetHeader := path.Join(
 		"/download",
 		m.Namespace,
 		m.Name,
 		m.Provider,
 		m.Version,
-		m.Name+".tgz",
+		file,
 	)
-	w.Header().Set("X-Terraform-Get", tfGetHeader)
+	if subdir != "" {
+		tfGetHeader += "//" + subdir
+	}
+	if checksumQuery != "" {
+		tfGetHeader += "?" + checksumQuery
+	}
+	w.Header().Set("X-Terraform-Get", baseURL+tenantPath(r.Context())+tfGetHeader)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// httpGetChangelog is a http handler for retrieving the CHANGELOG.md of a module version,
+// the changelog is extracted from the root of the version's tarball and returned as markdown
+func httpGetChangelog(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+		Provider:  chi.URLParam(r, "provider"),
+		Version:   chi.URLParam(r, "version"),
+	}
+	key, ok := statArchive(w, r, m)
+	if !ok {
+		return
+	}
+	changelog, err := readArchiveFile(moduleFS(r.Context()), key, "CHANGELOG.md")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("changelog not found"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to read changelog", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Write(changelog)
+}
+
 // httpGetModule is a http handler for retrieving a terraform module
 // we use an s3 based implementation of go's fs.FS interface,
-// which is compatible with the built in http.FilServer
+// archives are served with http.ServeContent and anything else below /download/ is a 404
 func httpGetModule(w http.ResponseWriter, r *http.Request) {
-	// Force Content-* headers that terraform client expects
-	w.Header().Set("Content-Encoding", "application/octet-stream")
+	// Force the Content-Type header that terraform client expects
 	w.Header().Set("Content-Type", "application/x-gzip")
-	fs := http.StripPrefix("/download/", http.FileServer(http.FS(s3fsys)))
-	fs.ServeHTTP(w, r)
+	if m, file, ok := parseDownloadPath(r.URL.Path); ok {
+		resolved, ok := resolveDownload(w, r, m, file)
+		if !ok {
+			return
+		}
+		if resolved != file {
+			file = resolved
+			r.URL.Path = path.Join("/download", m.Namespace, m.Name, m.Provider, m.Version, file)
+		}
+		w.Header().Set("Content-Type", archiveContentType(file))
+		key := backendKey(r.Context(), m.Namespace, m.Name, m.Provider, m.Version, file)
+		if target, ok := redirectFor(m); ok {
+			logBackendAccess(r.Context(), slog.LevelInfo, "redirecting module download", m, key, slog.String("location", target))
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		if contentDisposition {
+			w.Header().Set("Content-Disposition", downloadDisposition(m, file))
+		}
+		if verifySums {
+			if status, err := verifyArchiveSum(r.Context(), m, file); err != nil {
+				logBackendAccess(r.Context(), slog.LevelError, "module checksum verification failed", m, key, slog.Any("error", err))
+				renderError(w, r, status, err)
+				return
+			}
+		}
+		if steps := transformsFor(m, file); len(steps) > 0 {
+			logBackendAccess(r.Context(), slog.LevelInfo, "serving transformed module download", m, key)
+			serveTransformed(w, r, m, key, steps)
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelInfo, "serving module download", m, key)
+		serveArchive(w, r, m, key)
+		return
+	}
+	// Only archives are served, other paths below /download/ could reach into other modules' or tenants' trees
+	renderError(w, r, http.StatusNotFound, errors.New("module archive not found"))
+}
+
+// httpHeadModule is a http handler for HEAD requests of module archives, it answers with the archive's
+// Content-Length, Content-Type, ETag and Last-Modified from a stat of the backend object, without opening it.
+// Transformed archives only have a length once they've been built, so they're left to httpGetModule like other files
+func httpHeadModule(w http.ResponseWriter, r *http.Request) {
+	m, file, ok := parseDownloadPath(r.URL.Path)
+	if !ok || len(transformsFor(m, file)) > 0 {
+		httpGetModule(w, r)
+		return
+	}
+	if file, ok = resolveDownload(w, r, m, file); !ok {
+		return
+	}
+	key := backendKey(r.Context(), m.Namespace, m.Name, m.Provider, m.Version, file)
+	if target, ok := redirectFor(m); ok {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	_, span := startModuleSpan(r.Context(), "backend.stat", m, key)
+	fi, err := fs.Stat(moduleFS(r.Context()), key)
+	endSpan(span, err)
+	if err == nil && fi.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module archive not found"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to stat module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	etag := archiveETag(r.Context(), key, fi)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if contentDisposition {
+		w.Header().Set("Content-Disposition", downloadDisposition(m, file))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", archiveContentType(file))
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	logBackendAccess(r.Context(), slog.LevelInfo, "served module download metadata", m, key)
+	w.WriteHeader(http.StatusOK)
+}
+
+// archiveContentType returns the Content-Type of a module archive download, terraform expects gzipped tarballs
+// to be application/x-gzip
+func archiveContentType(file string) string {
+	if strings.HasSuffix(file, ".zip") {
+		return "application/zip"
+	}
+	return "application/x-gzip"
+}
+
+// downloadDisposition returns the Content-Disposition of a module download, naming the file after the module's
+// coordinates (e.g. nalbury-vpc-aws-1.0.0.tgz) rather than the archive name, which is usually the same for every version
+func downloadDisposition(m Module, file string) string {
+	ext := ".tgz"
+	for _, e := range []string{".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(file, e) {
+			ext = e
+			break
+		}
+	}
+	name := strings.Join([]string{m.Namespace, m.Name, m.Provider, m.Version}, "-") + ext
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+// verifyArchiveSum checks a module archive against its published checksum, if it has one.
+// The returned status is the http status to respond with when verification fails
+func verifyArchiveSum(ctx context.Context, m Module, file string) (int, error) {
+	key := backendKey(ctx, m.Namespace, m.Name, m.Provider, m.Version, file)
+	want, err := archiveChecksum(ctx, m, file)
+	if err != nil {
+		return 500, err
+	}
+	if want == "" {
+		logBackendAccess(ctx, slog.LevelWarn, "module archive has no published checksum", m, key)
+		return 0, nil
+	}
+	got, err := fileSHA256(moduleFS(ctx), key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return http.StatusNotFound, err
+		}
+		return 500, err
+	}
+	if got != want {
+		return 500, fmt.Errorf("checksum mismatch for %s/%s: expected %s, got %s", m.Version, file, want, got)
+	}
+	return 0, nil
+}
+
+// checkPrefix makes sure the configured prefix exists in the backend and contains at least one namespace
+func checkPrefix(fsys fs.FS, prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	entries, err := fs.ReadDir(fsys, prefix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("listing prefix %s: %w", prefix, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("prefix %s does not exist or is empty", prefix)
+	}
+	return nil
 }
 
 // Globals
 var (
-	bucket  string
-	profile string
-	prefix  string
-	port    string
-	s3fsys  fs.FS
+	configFile string
+	bucket     string
+	profile    string
+	roleARN    string
+	externalID string
+	prefix     string
+
+	s3Region         string
+	s3Endpoint       string
+	s3ForcePathStyle bool
+
+	backend         string
+	gcsProject      string
+	azureAccount    string
+	localDir        string
+	gitURL          string
+	gitModule       string
+	gitToken        string
+	archiveFile     string
+	strictPrefix    bool
+	validateOnly    bool
+	secondaryBucket string
+	healthProbe     string
+
+	providerBackend string
+	providerBucket  string
+	providerDir     string
+	providerPrefix  string
+	providerfsys    fs.FS
+	baseURL         string
+	basePath        string
+	bindAddr        string
+	port            string
+	adminPort       string
+	defaultProvider string
+	discoveryMaxAge time.Duration
+	shutdownTimeout time.Duration
+	s3fsys          fs.FS
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	tlsCert      string
+	tlsKey       string
+	useTLS       bool
+	redirectPort string
+	hstsMaxAge   time.Duration
+
+	allowedOrigins string
+
+	logLevel   string
+	logFormat  string
+	logKeys    bool
+	showBanner bool
+
+	correlationHeader string
+
+	tokens           string
+	tokenFile        string
+	authTokens       = &tokenStore{}
+	publicNamespaces = map[string]bool{}
+	publicNS         string
+
+	providerTokenList string
+	providerTokens    = &tokenStore{}
+	publicProviders   bool
+
+	verifySums         bool
+	contentDisposition bool
+
+	transforms          string
+	globalTransforms    []transformStep
+	moduleTransforms    map[string][]transformStep
+	transformedArchives = &archiveCache{}
+	validateETagOnServe bool
+
+	enableCatalog bool
+	enableBrowse  bool
+	enableSearch  bool
+	enableBatch   bool
+	enableMetrics bool
+	otelEndpoint  string
+
+	coordinateCase string
+
+	normalizeSlashes bool
+
+	deprecated      string
+	deprecatedPaths []deprecatedPath
+
+	archiveNameTmpl          string
+	providerArchiveNameTmpls string
+	archiveNames             archiveTemplates
+	archiveFallback          bool
+
+	redirects       string
+	moduleRedirects map[string]*template.Template
+	tenants         string
+	tenantPrefixes  map[string]string
+
+	versionsCache         = &listingCache[ModuleVersionsResp]{name: "versions"}
+	providersCache        = &listingCache[[]string]{name: "providers"}
+	providerVersionsCache = &listingCache[ProviderVersionsResp]{name: "provider_versions"}
+	modulesCache          = &listingCache[[]Module]{name: "modules"}
+	includeDependencies   bool
+	includePublished      bool
+	maxVersions           int
+	strictMaxVersions     bool
+
+	presignDownloads bool
+	presignTTL       time.Duration
+	downloadSigner   presigner
+	publishModules   bool
+	requireOwners    bool
+	moduleWriter     WritableBackend
+	objectETags      etagger
+
+	maxDownloads    int
+	downloadTimeout time.Duration
+	maxConcurrent   int
+	concurrentWait  time.Duration
+
+	rateLimitPerMinute int
+	rateBurst          int
+
+	webhookURL    string
+	webhookSecret string
+	webhooks      *webhookSender
+
+	adminToken            string
+	startInMaintenance    bool
+	maintenanceRetryAfter time.Duration
+
+	walkConcurrency int
+	listConcurrency int
+	maxSuggestions  int
+	indexInterval   time.Duration
+	indexDelay      time.Duration
+	modIndex        = &moduleIndex{}
 )
 
 func init() {
-	flag.StringVar(&bucket, "bucket", "", "aws s3 bucket name containing terraform modules")
+	flag.StringVar(&configFile, "config", "", "YAML config file of bucket, prefix, port, aws profile and role, backend, dir and auth settings, TFREG_ environment variables (e.g. TFREG_BUCKET) override it and flags override both")
+	flag.StringVar(&backend, "backend", BackendS3, "storage backend modules are served from, one of s3, gcs (the -bucket, with application default credentials), azure (the -bucket container of -azure-account, with DefaultAzureCredential), local (the directory set by -dir) or git (the tags of -git-url)")
+	flag.StringVar(&azureAccount, "azure-account", "", "azure storage account of the -bucket container with -backend azure")
+	flag.StringVar(&gcsProject, "gcs-project", "", "optional google cloud project billed for gcs requests, e.g. for requester pays buckets")
+	flag.StringVar(&localDir, "dir", "", "directory modules are served from with -backend local, laid out like the s3 bucket")
+	flag.StringVar(&gitURL, "git-url", "", "url of the git repository whose tags modules are served from with -backend git, ssh urls authenticate through the ssh agent")
+	flag.StringVar(&gitModule, "git-module", "", "<namespace>/<name>/<provider> of the module semver tags (v1.2.3) of -git-url are versions of, <name>/v1.2.3 tags are versions of the module <name> (its directory of the tree) in the same namespace and provider")
+	flag.StringVar(&gitToken, "git-token", "", "optional token authenticating to an https -git-url")
+	flag.Int64Var(&gitArchives.max, "git-archive-cache-bytes", 256<<20, "maximum total size in bytes of the archives generated from git tags cached in memory, 0 disables caching")
+	flag.StringVar(&bucket, "bucket", "", "aws s3 bucket name (or gcs bucket, or azure container) containing terraform modules, ignored with -backend local")
 	flag.StringVar(&profile, "profile", "default", "aws named profile to assume")
+	flag.StringVar(&roleARN, "role-arn", "", "optional aws iam role to assume non-interactively with the profile's credentials, e.g. for cross-account buckets")
+	flag.StringVar(&externalID, "external-id", "", "external id passed when assuming -role-arn, for roles whose trust policy requires one")
+	flag.StringVar(&s3Region, "s3-region", "", "optional aws region of the bucket, overriding the profile's")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "optional s3 endpoint url overriding aws's, for s3 compatible stores such as minio, ceph or wasabi")
+	flag.BoolVar(&s3ForcePathStyle, "s3-force-path-style", false, "address the bucket in the url path rather than as a subdomain, which most s3 compatible stores require")
 	flag.StringVar(&prefix, "prefix", "", "optional path prefix for modules in s3")
+	flag.StringVar(&providerBackend, "provider-backend", "", "storage backend providers are served from, one of s3, gcs, azure or local, sharing the module backend's credentials. Providers are served from the module backend when empty")
+	flag.StringVar(&providerBucket, "provider-bucket", "", "bucket (or container) providers are served from with -provider-backend, defaults to -bucket")
+	flag.StringVar(&providerDir, "provider-dir", "", "directory providers are served from with -provider-backend local, defaults to -dir")
+	flag.StringVar(&providerPrefix, "provider-prefix", "", "path prefix of the providers directory in the provider backend, defaults to -prefix")
+	flag.StringVar(&archiveFile, "archive-file", "", "serve modules from this local tar of the whole registry tree instead of s3, e.g. for air-gapped installs")
+	flag.BoolVar(&strictPrefix, "strict-prefix", false, "refuse to start if -prefix does not exist or is empty, rather than only warning")
+	flag.BoolVar(&validateOnly, "validate", false, "check the backend layout (non-semver version directories, missing archives) below -prefix and every tenant's prefix, then exit non-zero if there are problems instead of serving")
+	flag.StringVar(&secondaryBucket, "secondary-bucket", "", "optional read-only replica bucket used when the primary bucket returns retryable errors")
+	flag.StringVar(&baseURL, "base-url", "", "url (e.g. https://example.com/registry) or path (e.g. /registry) the registry is served at behind a proxy, included in service discovery, download and pagination urls")
+	flag.StringVar(&healthProbe, "health-probe", ".", "backend path stat'd by the /healthz readiness check, relative to the bucket root")
+	flag.StringVar(&bindAddr, "bind", "0.0.0.0", "address to listen on, e.g. 127.0.0.1 to only accept local connections")
 	flag.StringVar(&port, "port", "3000", "port for HTTP server")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "how long clients are given to send request headers, 0 disables")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Minute, "how long clients are given to send a whole request, including its body, 0 disables")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Minute, "maximum duration of a response, including module downloads, 0 disables")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long in-flight requests are given to finish on SIGTERM or SIGINT before the server exits")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file to serve https with, requires -tls-key, the certificate is reloaded on SIGHUP")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file for -tls-cert")
+	flag.StringVar(&adminPort, "admin-port", "", "serve /healthz, /version, /metrics and the admin endpoints over plain http on this port instead of -port, leaving only the terraform protocol endpoints on -port")
+	flag.DurationVar(&discoveryMaxAge, "discovery-max-age", time.Hour, "how long clients and CDNs may cache the service discovery document (Cache-Control max-age), 0 omits the header")
+	flag.StringVar(&defaultProvider, "default-provider", "", "provider of module requests without one, serving GET /terraform/modules/v1/:namespace/:name/versions for single provider registries")
+	flag.StringVar(&redirectPort, "http-redirect-port", "", "when serving https, also listen for plain http on this port and redirect it to https")
+	flag.StringVar(&allowedOrigins, "allowed-origins", "", "comma separated list of origins (e.g. https://registry-ui.example.com, or * for any) browser apps may call the registry from, CORS is disabled when empty")
+	flag.DurationVar(&hstsMaxAge, "hsts-max-age", 0, "when serving https, set a Strict-Transport-Security header with this max age, 0 disables")
+	flag.StringVar(&logLevel, "log-level", "info", "log level, one of debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "log format, one of text or json (one object per line, e.g. for log aggregators)")
+	flag.BoolVar(&showBanner, "startup-banner", true, "log the effective configuration and registered routes at startup")
+	flag.BoolVar(&logKeys, "log-keys", false, "include raw backend keys (including the prefix) in logs, keys are always logged at debug level")
+	flag.BoolVar(&normalizeSlashes, "collapse-slashes", false, "collapse duplicate slashes in request paths before routing (download paths only up to /download/)")
+	flag.StringVar(&deprecated, "deprecated-paths", "", "comma separated list of <old>=<new>[@<sunset date>] path prefixes, old paths keep working with Deprecation and Sunset headers")
+	flag.StringVar(&coordinateCase, "coordinate-case", CaseSensitive, "how module namespaces, names and providers, and provider namespaces and types, that aren't lowercase are handled, one of sensitive, lower (lowercased before lookup), lower-fallback (lowercased, unless only the path as requested exists) or reject")
+	flag.StringVar(&archiveNameTmpl, "archive-name", DefaultArchiveName, "go template for the file name of module tarballs, executed against the module's Namespace, Name, Provider and Version")
+	flag.StringVar(&providerArchiveNameTmpls, "provider-archive-names", "", "comma separated list of <provider>=<template> overrides of -archive-name")
+	flag.BoolVar(&archiveFallback, "archive-fallback", true, "when a version's archive is missing, serve the .tgz, .tar.gz or .zip in its directory instead (the first by extension then name if there are several)")
+	flag.StringVar(&tenants, "tenants", "", "comma separated list of <tenant>=<prefix> tenants, whose modules are served from their own prefix below /t/<tenant>/")
+	flag.StringVar(&redirects, "redirects", "", "comma separated list of <namespace>/<name>/<provider>=<url template> modules whose downloads are redirected to an external host, the template is executed like -archive-name")
+	flag.StringVar(&transforms, "transforms", "", "semicolon separated list of [<namespace>/<name>/<provider>=]<kind>:<args> transforms applied to downloaded tarballs (zip archives are served as stored), e.g. strip:.git or inject:provider.tf=/path/to/provider.tf")
+	flag.BoolVar(&validateETagOnServe, "validate-etag-on-serve", false, "confirm a transformed archive's source is unchanged before serving and caching it, rebuilding it if it was overwritten mid-transform")
+	flag.Int64Var(&transformedArchives.max, "transform-cache-bytes", 256<<20, "maximum total size in bytes of the transformed archives cached in memory, 0 disables caching")
+	flag.StringVar(&correlationHeader, "correlation-header", "X-Correlation-ID", "request header adopted as the logged request ID and echoed back, empty to always generate IDs")
+	flag.StringVar(&tokens, "token", "", "comma separated list of bearer tokens accepted on module routes (defaults to $TFREG_TOKEN), authentication is disabled when empty")
+	flag.StringVar(&tokenFile, "token-file", "", "file of bearer tokens accepted on module routes (one per line), reloaded whenever it changes")
+	flag.StringVar(&publicNS, "public-namespaces", "", "comma separated list of namespaces readable without a token when authentication is enabled")
+	flag.StringVar(&providerTokenList, "provider-tokens", "", "comma separated list of bearer tokens accepted on provider routes instead of the module routes' tokens, provider routes are authenticated like module routes when empty")
+	flag.BoolVar(&publicProviders, "public-providers", false, "serve provider routes without a token, even when module routes require one")
+	flag.BoolVar(&verifySums, "verify-checksums", false, "verify module downloads against their published checksum, a .sha256 file alongside the archive or the SHA256SUMS file in their provider directory, responding with a 500 on mismatch")
+	flag.BoolVar(&verifySums, "verify-sums", false, "alias of -verify-checksums")
+	flag.BoolVar(&contentDisposition, "content-disposition", false, "set a Content-Disposition header on downloads, naming the file after the module's coordinates for browser downloads")
+	flag.BoolVar(&enableCatalog, "enable-catalog", true, "enable the catalog endpoints (module details, changelog, schema, release) used by registry UIs")
+	flag.BoolVar(&enableBrowse, "enable-browse", true, "enable the browse endpoints (namespace listings, a module's providers, latest version)")
+	flag.BoolVar(&enableSearch, "enable-search", true, "enable the module search endpoint")
+	flag.BoolVar(&enableBatch, "enable-batch", true, "enable the bulk version endpoints (versions:batch, versions/stream) used by tooling")
+	flag.BoolVar(&enableMetrics, "metrics", false, "expose prometheus metrics at /metrics")
+	flag.StringVar(&otelEndpoint, "otel-endpoint", "", "OTLP/HTTP collector url traces are exported to, e.g. http://otel-collector:4318, tracing is disabled when empty")
+	flag.DurationVar(&versionsCache.ttl, "cache-ttl", 0, "how long version, provider and search listings are cached, 0 disables caching")
+	flag.DurationVar(&versionsCache.stale, "cache-stale", time.Minute, "how long an expired listing is still served while it's refreshed in the background")
+	flag.IntVar(&dependencyCache.max, "archive-content-cache", 4096, "maximum number of module versions whose dependencies and release notes, parsed from their archives, are cached in memory, 0 disables caching")
+	flag.DurationVar(&dependencyCache.ttl, "archive-content-cache-ttl", 24*time.Hour, "how long parsed dependencies and release notes are cached for, 0 caches them until they're evicted")
+	flag.BoolVar(&includeDependencies, "dependencies", false, "include the registry modules each version depends on in version listings (requires reading every version's tarball)")
+	flag.BoolVar(&includePublished, "published-at", false, "include when each version was published in version listings, as the RFC3339 modification time of its archive (requires a stat of every version's archive)")
+	flag.IntVar(&maxVersions, "max-versions", 0, "maximum number of versions listed for a module, modules with more are truncated to their newest versions with a Warning header, 0 disables the limit")
+	flag.BoolVar(&strictMaxVersions, "max-versions-strict", false, "respond with a 400 for modules with more than -max-versions versions rather than truncating the listing")
+	flag.BoolVar(&publishModules, "publish", false, "serve PUT /terraform/modules/v1/:namespace/:name/:provider/:version, publishing the gzipped tarball in the body as a module version (requires -admin-token, and -backend s3 or local)")
+	flag.BoolVar(&requireOwners, "require-owners", false, "require every published module version to list its owners (email addresses or team handles) in the owners field of a metadata.json at the root of its archive, -validate reports versions without them")
+	flag.BoolVar(&presignDownloads, "presign", false, "point terraform at pre-signed s3 urls for downloads instead of proxying them, bypassing -verify-checksums, download limits and webhooks (requires -backend s3, modules with -transforms are still proxied)")
+	flag.DurationVar(&presignTTL, "presign-ttl", 15*time.Minute, "how long pre-signed download urls are valid for")
+	flag.IntVar(&rateLimitPerMinute, "rate-limit", 0, "requests per minute each client ip may make to module and provider routes, over the limit they get a 429, 0 disables limiting")
+	flag.IntVar(&rateBurst, "rate-burst", 20, "requests each client ip may make at once with -rate-limit, before being held to the rate")
+	flag.IntVar(&maxDownloads, "max-downloads", 0, "upper bound of the adaptive limit on concurrent module downloads, lowered automatically as backend latency rises, 0 disables limiting")
+	flag.DurationVar(&downloadTimeout, "download-timeout", 0, "maximum duration of a module download, slower downloads are cut short, 0 disables")
+	flag.IntVar(&maxConcurrent, "max-concurrent", 0, "maximum number of requests served at once (besides /healthz and /metrics), further requests queue for -max-concurrent-wait and then get a 503, 0 disables limiting")
+	flag.DurationVar(&concurrentWait, "max-concurrent-wait", 5*time.Second, "how long a request over -max-concurrent queues for a free slot before getting a 503")
+	flag.StringVar(&webhookURL, "webhook-url", "", "url a JSON event is POSTed to for every module download and publish, delivered in the background with retries")
+	flag.StringVar(&webhookSecret, "webhook-secret", "", "secret the webhook payload is signed with (HMAC-SHA256, sent as X-TF-Registry-Signature)")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token required on admin endpoints, admin endpoints are disabled when empty")
+	flag.BoolVar(&startInMaintenance, "maintenance", false, "start in maintenance mode, with write and admin endpoints returning 503 until it's left through the admin api")
+	flag.DurationVar(&maintenanceRetryAfter, "maintenance-retry-after", 0, "Retry-After sent with 503s in maintenance mode, 0 omits the header")
+	flag.IntVar(&maxSuggestions, "suggestions", 0, "maximum number of similar modules suggested when a module isn't found, 0 disables (requires indexing the whole registry)")
+	flag.DurationVar(&indexInterval, "index-interval", 5*time.Minute, "how often the module index is rebuilt")
+	flag.DurationVar(&indexDelay, "index-delay", 0, "minimum delay between backend listings while indexing, backed off further when the backend throttles")
+	flag.IntVar(&walkConcurrency, "walk-concurrency", 8, "maximum number of concurrent backend listings when walking the whole registry")
+	flag.IntVar(&listConcurrency, "list-concurrency", 8, "maximum number of concurrent backend listings of a namespace listing or search request, e.g. resolving each module's latest version")
 }
 func usage() {
 	fmt.Fprint(flag.CommandLine.Output(), "Terraform Registry Server\n\n")
@@ -153,50 +934,344 @@ func main() {
 	// Parse flags and args
 	flag.Parse()
 
-	// Make sure we have a bucketname set
-	if bucket == "" {
-		fmt.Printf("bucket name not set!!!\n\n")
+	// Flags not set on the command line can come from the environment or a config file
+	cfg, err := loadConfig(configFile)
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	logger, err = newLogger(logLevel, logFormat)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	shutdownTracing := func(context.Context) error { return nil }
+	if otelEndpoint != "" {
+		if shutdownTracing, err = initTracing(otelEndpoint); err != nil {
+			fmt.Printf("invalid -otel-endpoint: %s\n\n", err)
+			usage()
+			os.Exit(1)
+		}
+	}
+
+	prefix = normalizePrefix(prefix)
+	providerPrefixSet := false
+	flag.Visit(func(f *flag.Flag) { providerPrefixSet = providerPrefixSet || f.Name == "provider-prefix" })
+	if providerPrefixSet {
+		providerPrefix = normalizePrefix(providerPrefix)
+	} else {
+		providerPrefix = prefix
+	}
+	providersCache.ttl, providersCache.stale = versionsCache.ttl, versionsCache.stale
+	providerVersionsCache.ttl, providerVersionsCache.stale = versionsCache.ttl, versionsCache.stale
+	modulesCache.ttl, modulesCache.stale = versionsCache.ttl, versionsCache.stale
+	releaseCache.max, releaseCache.ttl = dependencyCache.max, dependencyCache.ttl
+	baseURL, basePath, err = parseBaseURL(baseURL)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		fmt.Printf("-tls-cert and -tls-key must be set together\n\n")
+		usage()
+		os.Exit(1)
+	}
+	useTLS = tlsCert != ""
+	if defaultProvider != "" && !validCoordinate(defaultProvider) {
+		fmt.Printf("invalid -default-provider %q\n\n", defaultProvider)
+		usage()
+		os.Exit(1)
+	}
+	if publishModules && adminToken == "" {
+		fmt.Printf("-publish requires -admin-token\n\n")
+		usage()
+		os.Exit(1)
+	}
+	if rateLimitPerMinute > 0 && rateBurst < 1 {
+		fmt.Printf("-rate-burst must be at least 1 with -rate-limit\n\n")
+		usage()
+		os.Exit(1)
+	}
+	maintenanceMode.Store(startInMaintenance)
+
+	authTokens.static = splitList(tokens)
+	if tokenFile != "" {
+		if err := authTokens.loadFile(tokenFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := authTokens.watch(tokenFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	for _, ns := range splitList(publicNS) {
+		publicNamespaces[ns] = true
+	}
+	providerTokens.static = splitList(providerTokenList)
+
+	archiveNames, err = parseArchiveTemplates(archiveNameTmpl, providerArchiveNameTmpls)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	coordinateCase, err = parseCasePolicy(coordinateCase)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	if webhookURL != "" {
+		if err := validRedirectURL(webhookURL); err != nil {
+			fmt.Printf("invalid webhook url: %s\n\n", err)
+			usage()
+			os.Exit(1)
+		}
+		webhooks = newWebhookSender(webhookURL, webhookSecret)
+	}
+	deprecatedPaths, err = parseDeprecatedPaths(deprecated)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	moduleRedirects, err = parseRedirects(redirects)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	tenantPrefixes, err = parseTenants(tenants)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	globalTransforms, moduleTransforms, err = parseTransforms(transforms)
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
 		usage()
 		os.Exit(1)
 	}
 
-	fmt.Printf("Starting tf-registry webserver on 0.0.0.0:%s...\n", port)
+	if !validateOnly {
+		build := buildInfo()
+		fmt.Printf("Starting tf-registry webserver on %s...\n", listenAddr(port))
+		fmt.Printf("Build %s, commit %s, built %s\n", build.Version, build.Commit, build.Date)
+	}
 	fmt.Printf("Connecting to storage backend...\n")
 
-	// Create an AWS client session
-	sessionOptions := session.Options{
-		Profile:                 profile,
-		SharedConfigState:       session.SharedConfigEnable,
-		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	b, err := newBackend()
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		usage()
+		os.Exit(1)
 	}
-	sess, err := session.NewSessionWithOptions(sessionOptions)
+	s3fsys, err = b.FS()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	// Create an fs.FS interface for our s3 bucket
-	// TODO the implementation of fs.FS we're importing here is functional,
-	// but its a simple pkg and would be neat to implement directly.
-	// Would also allow for additional backend options (google cloud, azure, local fs etc.)
-	s3fsys = s3fs.New(s3.New(sess), bucket)
-	bucketRoot := filepath.Join(".")
-	_, err = fs.Stat(s3fsys, bucketRoot)
+	fmt.Printf("Connection successful, serving terraform registry from: %s/%s\n", b.Name(), prefix)
+	providerfsys = s3fsys
+	pb, err := newProviderBackend()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Printf("%s\n\n", err)
+		usage()
 		os.Exit(1)
 	}
-	fmt.Printf("Connection successful, serving terraform registry from: s3://%s/%s\n", bucket, prefix)
+	if pb != nil {
+		if providerfsys, err = pb.FS(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Serving providers from: %s/%s\n", pb.Name(), path.Join(providerPrefix, ProvidersDir))
+	}
+	if presignDownloads {
+		p, ok := b.(presigner)
+		if !ok {
+			fmt.Printf("-presign is not supported by the %s backend\n\n", b.Name())
+			usage()
+			os.Exit(1)
+		}
+		downloadSigner = p
+	}
+	objectETags, _ = b.(etagger)
+	if wb, ok := b.(WritableBackend); ok {
+		moduleWriter = maintenanceWriter{wb}
+	}
+	// -validate is a pre-flight check of the layout, the registry exits rather than serving
+	if validateOnly {
+		os.Exit(runValidation())
+	}
+	// A missing prefix (e.g. a typo) would otherwise only show up as every module 404ing
+	if err := checkPrefix(s3fsys, prefix); err != nil {
+		if strictPrefix {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		logger.Warn("modules prefix looks wrong, no modules will be found", slog.Any("error", err))
+	}
+
+	// Record backend latencies when metrics are enabled
+	if enableMetrics {
+		registerMetrics()
+		s3fsys = instrumentedFS{fsys: s3fsys}
+		providerfsys = instrumentedFS{fsys: providerfsys}
+	}
+
+	// Suggestions are resolved against an index of the whole registry
+	if maxSuggestions > 0 {
+		fmt.Printf("Indexing modules...\n")
+		if err := modIndex.refresh(s3fsys, prefix); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Indexed %d modules\n", len(modIndex.Modules()))
+		go modIndex.run(s3fsys, prefix, indexInterval)
+	}
+
+	r, ops := newRouter()
+
+	// Summarize the effective configuration and routes for operators
+	if showBanner {
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "tf-registry configured", startupBanner(r, ops)...)
+	}
+
+	// Run http server, over TLS when a certificate is configured
+	// Requests are traced from before routing, so the server span covers every middleware
+	handler := http.Handler(r)
+	if otelEndpoint != "" {
+		handler = traceRequests(r)
+	}
+	srv := newServer(listenAddr(port), handler)
+	servers := []*http.Server{srv}
+	if useTLS {
+		certs, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	}
+	go func() {
+		var err error
+		if useTLS {
+			// The certificate comes from TLSConfig, so it can be reloaded
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
+	if adminPort != "" {
+		adminSrv := newServer(listenAddr(adminPort), ops)
+		servers = append(servers, adminSrv)
+		go func() {
+			if err := adminSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}()
+	}
+	if useTLS && redirectPort != "" {
+		redirectSrv := newServer(listenAddr(redirectPort), httpsRedirect(port))
+		servers = append(servers, redirectSrv)
+		go func() {
+			if err := redirectSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("https redirect listener failed", slog.Any("error", err))
+			}
+		}()
+	}
 
-	// Configure a go-chi router
-	r := chi.NewRouter()
+	// Drain in-flight requests (e.g. module downloads) on SIGTERM/SIGINT rather than cutting them off mid-response
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	logger.Info("shutting down, draining in-flight requests", slog.Duration("timeout", shutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to drain in-flight requests", slog.Any("error", err))
+		}
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces", slog.Any("error", err))
+	}
+	logger.Info("shutdown complete")
+}
+
+// newRouter configures the go-chi router serving the registry from the parsed flags, and the router of the
+// operational endpoints, which is the same router unless -admin-port is set
+func newRouter() (r *chi.Mux, ops chi.Router) {
+	// Configure a go-chi router, unrouted requests get the same JSON errors as the routes
+	r = chi.NewRouter()
+	r.NotFound(httpNotFound)
+	r.MethodNotAllowed(methodNotAllowed(r))
 	r.Use(middleware.RealIP)
-	r.Use(middleware.RequestID)
+	r.Use(correlationID(correlationHeader))
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Logger)
+	r.Use(requestLogger)
+	if enableMetrics {
+		r.Use(instrumentRequests)
+	}
+	if otelEndpoint != "" {
+		r.Use(nameSpans)
+	}
+	if origins := splitList(allowedOrigins); len(origins) > 0 {
+		r.Use(allowCORS(origins))
+	}
 	r.Use(middleware.GetHead)
-	// TODO implement a real healthcheck here
+	if basePath != "" {
+		r.Use(stripBasePath(basePath))
+	}
+	if len(tenantPrefixes) > 0 {
+		r.Use(routeTenants(tenantPrefixes))
+	}
+	if normalizeSlashes {
+		r.Use(collapseSlashes)
+	}
+	if len(deprecatedPaths) > 0 {
+		r.Use(deprecatePaths(deprecatedPaths))
+	}
+	if useTLS && hstsMaxAge > 0 {
+		r.Use(hsts(int(hstsMaxAge.Seconds())))
+	}
+	// Limited after the base path is stripped, so the exempt paths match however they're reached
+	if maxConcurrent > 0 {
+		r.Use(limitInFlight(maxConcurrent, concurrentWait))
+	}
+	// Only JSON is compressed, module archives are already gzipped (or zipped) and pass through untouched,
+	// which also keeps their ranges and Content-Length intact
+	r.Use(middleware.Compress(compressLevel, "application/json"))
+	// /is_alive is a pure liveness check, /healthz below checks the backend for readiness
 	r.Use(middleware.Heartbeat("/is_alive"))
 
+	// Operational endpoints (health, metrics and admin) are served from their own router on -admin-port when it's set,
+	// so they're never exposed along with an internet facing registry
+	ops = chi.Router(r)
+	if adminPort != "" {
+		ops = chi.NewRouter()
+		ops.NotFound(httpNotFound)
+		ops.MethodNotAllowed(methodNotAllowed(ops))
+		ops.Use(middleware.RealIP)
+		ops.Use(correlationID(correlationHeader))
+		ops.Use(middleware.Recoverer)
+		ops.Use(requestLogger)
+		ops.Use(middleware.Heartbeat("/is_alive"))
+	}
+
 	////////////
 	// ROUTES //
 	////////////
@@ -207,15 +1282,153 @@ func main() {
 	r.Get("/", httpGetServiceDiscovery)
 	// GET /.well-known/terraform.json returns our static service discovery resp
 	r.Get("/.well-known/terraform.json", httpGetServiceDiscovery)
+	// GET /healthz returns a 200 only while the backend is reachable
+	ops.Get("/healthz", httpHealthcheck)
+	// GET /version returns the version, commit and date of the running build
+	ops.Get("/version", httpGetBuildInfo)
+	// GET /terraform/modules/v1/ returns the protocol versions and optional features this registry serves
+	r.Get(ModuleBasePath+"/", httpGetCapabilities)
 
-	// GET /:namespace/:name/:provider/versions returns a list of versions for the specified module path
-	r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/versions", httpGetVersions)
-	// GET /:namespace/:name/:provider/:version/download responds with a 204 and X-Terraform-Get header pointing to the download path
-	r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}/download", httpGetDownloadURL)
+	// GET /metrics exposes prometheus metrics
+	if enableMetrics {
+		ops.Handle("/metrics", promhttp.Handler())
+	}
 
-	// GET /download/ provides an http fileserver for downloading modules as gzipped tarballs
-	r.Get("/download/*", httpGetModule)
+	// Module, provider and publish routes share a single limiter, so a client's budget covers all of them
+	var limiter *rateLimiter
+	if rateLimitPerMinute > 0 {
+		limiter = newRateLimiter(rateLimitPerMinute, rateBurst)
+	}
+
+	// Module routes require a bearer token when auth is enabled, unless their namespace is public
+	r.Group(func(r chi.Router) {
+		if limiter != nil {
+			r.Use(rateLimit(limiter))
+		}
+		r.Use(validateCoordinates)
+		r.Use(normalizeCase)
+		r.Use(hideTenantPrefixes)
+		r.Use(requireToken)
+
+		// GET /:namespace/:name/:provider/versions returns a list of versions for the specified module path
+		r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/versions", httpGetVersions)
+		// GET /:namespace/:name/versions returns the versions of a module of the default provider,
+		// it's only registered with -default-provider so a missing provider is never mistaken for another route
+		if defaultProvider != "" {
+			r.With(withDefaultProvider).Get(ModuleBasePath+"/{namespace}/{name}/versions", httpGetVersions)
+		}
+		// GET /:namespace/:name/:provider/:version/download responds with a 204 and X-Terraform-Get header pointing to the download path
+		r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}/download", httpGetDownloadURL)
+		// HEAD is registered explicitly rather than left to middleware.GetHead,
+		// so it's guaranteed to respond with the same 204 and X-Terraform-Get header as GET
+		r.Head(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}/download", httpGetDownloadURL)
+
+		// GET /download/ provides an http fileserver for downloading modules as gzipped tarballs
+		r.Group(func(r chi.Router) {
+			if maxDownloads > 0 {
+				r.Use(limitDownloads(newAdaptiveLimiter(maxDownloads)))
+			}
+			if webhookURL != "" {
+				r.Use(notifyDownloads(webhooks))
+			}
+			if downloadTimeout > 0 {
+				r.Use(downloadDeadline(downloadTimeout))
+			}
+			r.Get("/download/*", httpGetModule)
+		})
+		// HEAD /download/ answers with an archive's size and freshness from a stat, outside of download limits and webhooks
+		r.Head("/download/*", httpHeadModule)
+
+		// Optional endpoint groups, these aren't part of the terraform registry protocol.
+		// Browse endpoints list what the registry holds
+		if enableBrowse {
+			// GET /:namespace returns every module of a namespace at its latest version
+			r.Get(ModuleBasePath+"/{namespace}", httpGetNamespace)
+			// GET /:namespace/:name/providers returns the providers a module is available for
+			r.Get(ModuleBasePath+"/{namespace}/{name}/providers", httpGetProviders)
+			// GET /:namespace/:name/:provider/latest returns the greatest version of a module
+			r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/latest", httpGetLatestVersion)
+		}
+		if enableSearch {
+			// GET /search returns the modules whose namespace or name contains the q param
+			r.Get(ModuleBasePath+"/search", httpGetModuleSearch)
+		}
+		// Batch endpoints retrieve versions in bulk for tooling
+		if enableBatch {
+			// POST /versions:batch returns the versions of every module in the request body
+			r.Post(ModuleBasePath+"/versions:batch", httpPostVersionsBatch)
+			// GET /:namespace/:name/:provider/versions/stream streams the versions of modules with too many to list at once
+			r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/versions/stream", httpGetVersionsStream)
+		}
+		// Catalog endpoints expose module documentation for registry UIs
+		if enableCatalog {
+			// GET /:namespace/:name/:provider/:version returns the readme and metadata of a module version
+			r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}", httpGetModuleDetails)
+			// GET /:namespace/:name/:provider/:version/changelog returns the CHANGELOG.md from the module's tarball
+			r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}/changelog", httpGetChangelog)
+			// GET /:namespace/:name/:provider/:version/schema returns the module's inputs and outputs
+			r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}/schema", httpGetSchema)
+			// GET /:namespace/:name/:provider/:version/release returns the changelog, readme summary and metadata in one response
+			r.Get(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}/release", httpGetRelease)
+		}
+	})
+
+	// Provider routes are served from the provider backend, and are authenticated like module routes
+	// unless -provider-tokens or -public-providers configure them separately
+	r.Group(func(r chi.Router) {
+		if limiter != nil {
+			r.Use(rateLimit(limiter))
+		}
+		r.Use(validateCoordinates)
+		r.Use(normalizeCase)
+		r.Use(requireProviderToken)
+
+		// GET /terraform/providers/v1/:namespace/:type/versions returns the releases of a provider and their platforms
+		r.Get(ProviderBasePath+"/{namespace}/{type}/versions", httpGetProviderVersions)
+		// GET /terraform/providers/v1/:namespace/:type/:version/download/:os/:arch returns a release's package for a platform
+		r.Get(ProviderBasePath+"/{namespace}/{type}/{version}/download/{os}/{arch}", httpGetProviderPackage)
+		// GET /providers/download/ serves the packages, checksums and signatures of provider releases
+		r.Get("/providers/download/{namespace}/{type}/{version}/*", httpGetProviderFile)
+	})
+
+	// Publishing is authenticated with the admin token rather than the module routes' tokens,
+	// and like other write endpoints it's unavailable in maintenance mode
+	if publishModules {
+		r.Group(func(r chi.Router) {
+			if limiter != nil {
+				r.Use(rateLimit(limiter))
+			}
+			r.Use(validateCoordinates)
+			r.Use(normalizeCase)
+			r.Use(hideTenantPrefixes)
+			r.Use(requireAdminToken)
+			r.Use(blockInMaintenance)
+
+			// PUT /:namespace/:name/:provider/:version publishes the gzipped tarball in the body as a module version
+			r.Put(ModuleBasePath+"/{namespace}/{name}/{provider}/{version}", httpPutModule)
+		})
+	}
+
+	// Admin endpoints are only served when an admin token is configured
+	if adminToken != "" {
+		ops.Route("/admin", func(r chi.Router) {
+			r.Use(requireAdminToken)
+
+			// GET, PUT and DELETE /admin/maintenance report, enter and leave maintenance mode,
+			// they stay available in maintenance mode so that it can be left again
+			r.Get("/maintenance", httpMaintenance)
+			r.Put("/maintenance", httpMaintenance)
+			r.Delete("/maintenance", httpMaintenance)
+
+			// Write and admin endpoints below are unavailable in maintenance mode
+			r.Group(func(r chi.Router) {
+				r.Use(blockInMaintenance)
+
+				// POST /admin/cache/flush drops cached listings, optionally only those of a module
+				r.Post("/cache/flush", httpFlushCache)
+			})
+		})
+	}
 
-	// Run http server
-	http.ListenAndServe(":"+port, r)
+	return r, ops
 }
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// setGlobal sets a package level setting for the duration of a test, restoring it afterwards
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// testTarball returns a gzipped tarball holding files, written in name order
+func testTarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testFile returns a MapFS file with data and a fixed modification time
+func testFile(data []byte) *fstest.MapFile {
+	return &fstest.MapFile{Data: data, Mode: 0644, ModTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+// testLayout is a representative backend layout: a module with several versions (listed out of semver order
+// by a lexicographic backend), a second provider, a non-semver directory and a provider release
+func testLayout(t *testing.T) fstest.MapFS {
+	t.Helper()
+	archive := testTarball(t, map[string]string{"main.tf": `variable "cidr" {}`})
+	return fstest.MapFS{
+		"acme/vpc/aws/1.0.0/vpc.tgz":       testFile(archive),
+		"acme/vpc/aws/1.2.0/vpc.tgz":       testFile(archive),
+		"acme/vpc/aws/10.0.0/vpc.tgz":      testFile(archive),
+		"acme/vpc/aws/notsemver/README.md": testFile([]byte("not a version")),
+		"acme/vpc/google/0.1.0/vpc.tgz":    testFile(archive),
+		"providers/acme/signing-keys.json": testFile([]byte(`{"gpg_public_keys":[]}`)),
+		"providers/acme/foo/1.0.0/linux_amd64/terraform-provider-foo_1.0.0_linux_amd64.zip": testFile([]byte("zip")),
+	}
+}
+
+// newTestRegistry serves fsys as both the module and provider backend through the full router,
+// with listing caches emptied so tests don't see each other's listings
+func newTestRegistry(t *testing.T, fsys fstest.MapFS) http.Handler {
+	t.Helper()
+	setGlobal(t, &s3fsys, fs.FS(fsys))
+	setGlobal(t, &providerfsys, fs.FS(fsys))
+	all := func(string) bool { return true }
+	flushListings(all)
+	t.Cleanup(func() { flushListings(all) })
+	r, _ := newRouter()
+	return r
+}
+
+// serve sends a request through h and returns the recorded response, headers are given as name, value pairs
+func serve(h http.Handler, method, target string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	for _, p := range []string{"/.well-known/terraform.json", "/"} {
+		w := serve(h, http.MethodGet, p, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, want 200", p, w.Code)
+		}
+		want := `{"modules.v1":"/terraform/modules/v1/","providers.v1":"/terraform/providers/v1/"}` + "\n"
+		if got := w.Body.String(); got != want {
+			t.Errorf("GET %s: body %q, want %q", p, got, want)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s: Content-Type %q, want application/json", p, ct)
+		}
+	}
+}
+
+func TestVersionsDocument(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	want := `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"1.0.0"},{"version":"1.2.0"},{"version":"10.0.0"}]}]}` + "\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("body %q, want %q", got, want)
+	}
+}
+
+func TestVersionsSemverOrder(t *testing.T) {
+	var buf bytes.Buffer
+	setGlobal(t, &logger, slog.New(slog.NewJSONHandler(&buf, nil)))
+	setGlobal(t, &enableBatch, true)
+	fsys := fstest.MapFS{}
+	for _, v := range []string{"10.0.0", "2.0.0", "1.10.0", "1.9.0", "1.0.0", "1.0.0-beta.1", "latest"} {
+		fsys["acme/vpc/aws/"+v+"/vpc.tgz"] = testFile([]byte("tgz"))
+	}
+	h := newTestRegistry(t, fsys)
+	for _, target := range []string{"/terraform/modules/v1/acme/vpc/aws/versions", "/terraform/modules/v1/acme/vpc/aws/versions/stream"} {
+		buf.Reset()
+		w := serve(h, http.MethodGet, target, nil)
+		want := `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"1.0.0-beta.1"},{"version":"1.0.0"},{"version":"1.9.0"},` +
+			`{"version":"1.10.0"},{"version":"2.0.0"},{"version":"10.0.0"}]}]}` + "\n"
+		if got := w.Body.String(); got != want {
+			t.Errorf("%s: body %s, want %s", target, got, want)
+		}
+		if !strings.Contains(buf.String(), "isn't valid semver") || !strings.Contains(buf.String(), `"version":"latest"`) {
+			t.Errorf("%s: the skipped directory wasn't logged: %s", target, buf.String())
+		}
+	}
+
+	// The stream cursor is compared as semver too, 10.0.0 comes after 2.0.0
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions/stream?after=1.9.0", nil)
+	want := `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"1.10.0"},{"version":"2.0.0"},{"version":"10.0.0"}]}]}` + "\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("after 1.9.0: body %s, want %s", got, want)
+	}
+}
+
+func TestDownloadURL(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/1.2.0/download", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204: %s", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("X-Terraform-Get"), "/download/acme/vpc/aws/1.2.0/vpc.tgz"; got != want {
+		t.Errorf("X-Terraform-Get %q, want %q", got, want)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body %q, want none", w.Body)
+	}
+
+	w = serve(h, http.MethodGet, "/download/acme/vpc/aws/1.2.0/vpc.tgz", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("archive status %d, want 200", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), testLayout(t)["acme/vpc/aws/1.2.0/vpc.tgz"].Data) {
+		t.Error("archive body differs from the backend object")
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	base, path, err := parseBaseURL("https://example.com/registry/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &baseURL, base)
+	setGlobal(t, &basePath, path)
+	setGlobal(t, &enableSearch, true)
+	h := newTestRegistry(t, testLayout(t))
+
+	// Requests work whether or not the proxy strips the base path
+	for _, prefix := range []string{"/registry", ""} {
+		w := serve(h, http.MethodGet, prefix+"/.well-known/terraform.json", nil)
+		var discovery ServiceDiscoveryResp
+		if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+			t.Fatal(err)
+		}
+		if discovery.ModulesV1 != "https://example.com/registry/terraform/modules/v1/" || discovery.ProvidersV1 != "https://example.com/registry/terraform/providers/v1/" {
+			t.Errorf("%q: discovery %+v, want the base url", prefix, discovery)
+		}
+		w = serve(h, http.MethodGet, prefix+"/terraform/modules/v1/acme/vpc/aws/1.0.0/download", nil)
+		if got, want := w.Header().Get("X-Terraform-Get"), "https://example.com/registry/download/acme/vpc/aws/1.0.0/vpc.tgz"; got != want {
+			t.Errorf("%q: X-Terraform-Get %q, want %q", prefix, got, want)
+		}
+	}
+	if w := serve(h, http.MethodGet, "/registry/download/acme/vpc/aws/1.0.0/vpc.tgz", nil); w.Code != http.StatusOK {
+		t.Errorf("download below the base path: status %d, want 200", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/registryx/terraform/modules/v1/acme/vpc/aws/versions", nil); w.Code != http.StatusNotFound {
+		t.Errorf("a path merely starting like the base: status %d, want 404", w.Code)
+	}
+
+	// Pagination links point below the base url too
+	var versions ModuleVersionsResp
+	w := serve(h, http.MethodGet, "/registry/terraform/modules/v1/acme/vpc/aws/versions?page=2&per_page=1", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions.Page == nil ||
+		versions.Page.Next != "https://example.com/registry/terraform/modules/v1/acme/vpc/aws/versions?page=3&per_page=1" ||
+		versions.Page.Prev != "https://example.com/registry/terraform/modules/v1/acme/vpc/aws/versions?page=1&per_page=1" {
+		t.Errorf("versions page %+v, want links below the base url", versions.Page)
+	}
+	var search ModuleSearchResp
+	w = serve(h, http.MethodGet, "/registry/terraform/modules/v1/search?q=vpc&limit=1&offset=1", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &search); err != nil {
+		t.Fatal(err)
+	}
+	if search.Meta.PrevURL != "https://example.com/registry/terraform/modules/v1/search?limit=1&offset=0&q=vpc" || search.Meta.NextURL != "" {
+		t.Errorf("search meta %+v, want a prev url below the base url and no next", search.Meta)
+	}
+	w = serve(h, http.MethodGet, "/terraform/modules/v1/search?q=vpc&limit=1", nil)
+	search = ModuleSearchResp{}
+	if err := json.Unmarshal(w.Body.Bytes(), &search); err != nil {
+		t.Fatal(err)
+	}
+	if search.Meta.NextURL != "https://example.com/registry/terraform/modules/v1/search?limit=1&offset=1&q=vpc" {
+		t.Errorf("search next url %q, want it below the base url", search.Meta.NextURL)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	for _, p := range []string{
+		"/terraform/modules/v1/acme/nope/aws/versions",
+		"/terraform/modules/v1/nobody/vpc/aws/versions",
+		"/terraform/modules/v1/acme/vpc/aws/9.9.9/download",
+		"/terraform/modules/v1/acme/nope/aws/1.0.0/download",
+		"/download/acme/vpc/aws/9.9.9/vpc.tgz",
+	} {
+		w := serve(h, http.MethodGet, p, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s: Content-Type %q, want the JSON error", p, ct)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	setGlobal(t, &authTokens, &tokenStore{static: []string{"s3cret"}})
+	h := newTestRegistry(t, testLayout(t))
+	const versions = "/terraform/modules/v1/acme/vpc/aws/versions"
+	cases := []struct {
+		name    string
+		headers []string
+		want    int
+	}{
+		{"no token", nil, http.StatusUnauthorized},
+		{"not a bearer token", []string{"Authorization", "Basic czNjcmV0"}, http.StatusUnauthorized},
+		{"wrong token", []string{"Authorization", "Bearer guess"}, http.StatusForbidden},
+		{"valid token", []string{"Authorization", "Bearer s3cret"}, http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := serve(h, http.MethodGet, versions, nil, c.headers...)
+			if w.Code != c.want {
+				t.Fatalf("status %d, want %d", w.Code, c.want)
+			}
+			if c.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Error("missing WWW-Authenticate challenge")
+			}
+		})
+	}
+	// Service discovery stays unauthenticated so terraform can find the credentials host
+	if w := serve(h, http.MethodGet, "/.well-known/terraform.json", nil); w.Code != http.StatusOK {
+		t.Errorf("discovery status %d, want 200", w.Code)
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Request and access logs would drown out test failures
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+func TestChangelog(t *testing.T) {
+	fsys := testLayout(t)
+	fsys["acme/vpc/aws/2.0.0/vpc.tgz"] = testFile(testTarball(t, map[string]string{
+		"./CHANGELOG.md": "# 2.0.0\n\n- breaking change\n",
+		"./main.tf":      "",
+	}))
+	h := newTestRegistry(t, fsys)
+
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/2.0.0/changelog", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("present: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got, want := w.Body.String(), "# 2.0.0\n\n- breaking change\n"; got != want {
+		t.Errorf("present: body %q, want %q", got, want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/markdown; charset=utf-8" {
+		t.Errorf("present: Content-Type %q", ct)
+	}
+
+	// A version without a changelog and a version that doesn't exist are both a 404
+	for _, v := range []string{"1.0.0", "3.0.0"} {
+		if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/"+v+"/changelog", nil); w.Code != http.StatusNotFound {
+			t.Errorf("absent %s: status %d, want 404", v, w.Code)
+		}
+	}
+}
+
+func TestDownloadURLHead(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	const download = "/terraform/modules/v1/acme/vpc/aws/1.2.0/download"
+	get := serve(h, http.MethodGet, download, nil)
+	head := serve(h, http.MethodHead, download, nil)
+	if head.Code != get.Code || head.Code != http.StatusNoContent {
+		t.Errorf("HEAD status %d, GET status %d, want 204 for both", head.Code, get.Code)
+	}
+	if got, want := head.Header().Get("X-Terraform-Get"), get.Header().Get("X-Terraform-Get"); got != want || got == "" {
+		t.Errorf("HEAD X-Terraform-Get %q, GET %q", got, want)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD body %q, want none", head.Body)
+	}
+}
+
+func TestCheckPrefix(t *testing.T) {
+	fsys := fstest.MapFS{
+		"registry/modules/acme/vpc/aws/1.0.0/vpc.tgz": testFile(nil),
+		"empty": &fstest.MapFile{Mode: fs.ModeDir},
+	}
+	for _, c := range []struct {
+		prefix string
+		ok     bool
+	}{
+		{"", true},
+		{"registry", true},
+		{"registry/modules", true},
+		{"registry/module", false},
+		{"missing", false},
+		{"empty", false},
+	} {
+		err := checkPrefix(fsys, c.prefix)
+		if (err == nil) != c.ok {
+			t.Errorf("checkPrefix(%q) = %v, want ok %t", c.prefix, err, c.ok)
+		}
+	}
+	if err := checkPrefix(failingFS{err: fs.ErrPermission}, "registry"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("checkPrefix with a failing backend = %v, want the listing's error", err)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	const download = "/download/acme/vpc/aws/1.2.0/vpc.tgz"
+	if w := serve(newTestRegistry(t, testLayout(t)), http.MethodGet, download, nil); w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("Content-Disposition %q without -content-disposition", w.Header().Get("Content-Disposition"))
+	}
+
+	setGlobal(t, &contentDisposition, true)
+	fsys := testLayout(t)
+	fsys["acme/vpc/azure/2.0.0/module.zip"] = testFile([]byte("zip"))
+	h := newTestRegistry(t, fsys)
+	for _, c := range []struct{ method, target, want string }{
+		{http.MethodGet, download, `attachment; filename=acme-vpc-aws-1.2.0.tgz`},
+		{http.MethodHead, download, `attachment; filename=acme-vpc-aws-1.2.0.tgz`},
+		{http.MethodGet, "/download/acme/vpc/azure/2.0.0/module.zip", `attachment; filename=acme-vpc-azure-2.0.0.zip`},
+	} {
+		w := serve(h, c.method, c.target, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d, want 200", c.method, c.target, w.Code)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != c.want {
+			t.Errorf("%s %s: Content-Disposition %q, want %q", c.method, c.target, got, c.want)
+		}
+	}
+}
+
+func TestModuleProviders(t *testing.T) {
+	setGlobal(t, &enableBrowse, true)
+	setGlobal(t, &providersCache.ttl, time.Minute)
+	fsys := testLayout(t)
+	// a file next to the providers isn't one
+	fsys["acme/vpc/README.md"] = testFile([]byte("readme"))
+	h := newTestRegistry(t, fsys)
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/providers", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if got, want := w.Body.String(), `{"providers":["aws","google"]}`+"\n"; got != want {
+		t.Errorf("providers %s, want %s", got, want)
+	}
+
+	// The listing is cached, a provider added since is listed once the cache is flushed
+	fsys["acme/vpc/azure/1.0.0/vpc.tgz"] = fsys["acme/vpc/aws/1.0.0/vpc.tgz"]
+	if got := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/providers", nil).Body.String(); got != `{"providers":["aws","google"]}`+"\n" {
+		t.Errorf("providers %s, want the cached listing", got)
+	}
+	flushListings(func(string) bool { return true })
+	if got := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/providers", nil).Body.String(); got != `{"providers":["aws","azure","google"]}`+"\n" {
+		t.Errorf("providers %s after a flush, want azure listed", got)
+	}
+
+	for _, p := range []string{"/terraform/modules/v1/acme/missing/providers", "/terraform/modules/v1/nobody/vpc/providers"} {
+		if w := serve(h, http.MethodGet, p, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, w.Code)
+		}
+	}
+	// A name holding nothing but files has no providers either
+	fsys["acme/empty/README.md"] = testFile([]byte("readme"))
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/empty/providers", nil); w.Code != http.StatusNotFound {
+		t.Errorf("name without providers: status %d, want 404", w.Code)
+	}
+}
+
+// TestProtocolGolden decodes the registry protocol documents in testdata/protocol, trimmed to the fields terraform reads
+// from the public registry's responses, into our response structs and checks they encode back to the same JSON.
+// Unknown fields are rejected, so a field we're missing or naming differently fails the test
+func TestProtocolGolden(t *testing.T) {
+	for file, v := range map[string]any{
+		"discovery.json":         &ServiceDiscoveryResp{},
+		"module-versions.json":   &ModuleVersionsResp{},
+		"provider-versions.json": &ProviderVersionsResp{},
+		"provider-package.json":  &ProviderPackageResp{},
+	} {
+		golden, err := os.ReadFile(filepath.Join("testdata", "protocol", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(golden))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(v); err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		got, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bytes.Buffer
+		if err := json.Compact(&want, golden); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("%s: encoded as\n%s\nwant\n%s", file, got, want.Bytes())
+		}
+	}
+}
+
+// testVersionNames returns n version names in the lexicographic order a backend lists them in
+func testVersionNames(n int) []string {
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		names = append(names, fmt.Sprintf("%d.%d.%d", i/100, i/10%10, i%10))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mapVersions builds a version list the way getModuleVersions did before ModuleVersion, with a map per version
+func mapVersions(names []string) map[string]any {
+	versions := []map[string]string{}
+	for _, name := range names {
+		versions = append(versions, map[string]string{"version": name})
+	}
+	return map[string]any{"modules": []map[string]any{{"source": "acme/vpc/aws", "versions": versions}}}
+}
+
+// structVersions builds a version list as getModuleVersions does
+func structVersions(names []string) ModuleVersionsResp {
+	m := ModuleVersions{Source: "acme/vpc/aws", Versions: make([]ModuleVersion, 0, len(names))}
+	for _, name := range names {
+		m.Versions = append(m.Versions, ModuleVersion{Version: name})
+	}
+	return ModuleVersionsResp{Modules: []ModuleVersions{m}}
+}
+
+func TestVersionListEncoding(t *testing.T) {
+	names := testVersionNames(250)
+	want, err := json.Marshal(mapVersions(names))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(structVersions(names))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("struct versions encode as\n%s\nthe map versions as\n%s", got, want)
+	}
+}
+
+// Building and encoding the version list of a module with 1000 versions, before (map) and after (struct)
+// versions became ModuleVersion structs (go1.27, linux/amd64):
+//
+//	BenchmarkVersionList/map       2000   1195193 ns/op   386493 B/op   4030 allocs/op
+//	BenchmarkVersionList/struct    2000    313833 ns/op    57490 B/op      4 allocs/op
+func BenchmarkVersionList(b *testing.B) {
+	names := testVersionNames(1000)
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			json.NewEncoder(io.Discard).Encode(mapVersions(names))
+		}
+	})
+	b.Run("struct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			json.NewEncoder(io.Discard).Encode(structVersions(names))
+		}
+	})
+}
+
+func BenchmarkGetModuleVersions(b *testing.B) {
+	fsys := fstest.MapFS{}
+	for _, name := range testVersionNames(1000) {
+		fsys["acme/vpc/aws/"+name+"/vpc.tgz"] = testFile(nil)
+	}
+	old := s3fsys
+	s3fsys = fsys
+	defer func() { s3fsys = old }()
+	m := Module{Namespace: "acme", Name: "vpc", Provider: "aws"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		modVers, err := getModuleVersions(context.Background(), m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		json.NewEncoder(io.Discard).Encode(modVers)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	layout := testLayout(t)
+	h := newTestRegistry(t, layout)
+
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil, "Accept-Encoding", "gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("versions: Content-Encoding %q, want gzip", got)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"1.0.0"},{"version":"1.2.0"},{"version":"10.0.0"}]}]}` + "\n"; string(b) != want {
+		t.Errorf("versions %s, want %s", b, want)
+	}
+
+	// Tarballs are already gzipped, they pass through as they're stored with their length and ranges intact
+	archive := layout["acme/vpc/aws/1.0.0/vpc.tgz"].Data
+	w = serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil, "Accept-Encoding", "gzip")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), archive) {
+		t.Fatalf("download: status %d, or not the tarball as stored", w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("download: Content-Encoding %q, want none", got)
+	}
+	if got, want := w.Header().Get("Content-Length"), fmt.Sprint(len(archive)); got != want {
+		t.Errorf("download: Content-Length %s, want %s", got, want)
+	}
+	w = serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil, "Accept-Encoding", "gzip", "Range", "bytes=4-")
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), archive[4:]) || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("range: status %d, or not an uncompressed ranged read of the tarball", w.Code)
+	}
+}
+
+func TestMaxVersions(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for _, v := range testVersionNames(1000) {
+		fsys["acme/vpc/aws/"+v+"/vpc.tgz"] = testFile(nil)
+	}
+	fsys["acme/vpc/aws/SHA256SUMS"] = testFile(nil)
+	setGlobal(t, &maxVersions, 3)
+	h := newTestRegistry(t, fsys)
+	var pages []int
+	setGlobal(t, &s3fsys, fs.FS(pagedFS{MapFS: fsys, pages: &pages}))
+
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	if want := `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"9.9.7"},{"version":"9.9.8"},{"version":"9.9.9"}]}]}` + "\n"; w.Body.String() != want {
+		t.Errorf("versions %s, want the newest 3 %s", w.Body, want)
+	}
+	if got, want := w.Header().Get("Warning"), `199 - "versions truncated to the newest 3 of 1000"`; got != want {
+		t.Errorf("Warning %q, want %q", got, want)
+	}
+	// The directory is read a page at a time rather than all at once
+	if len(pages) < 1000/versionsPageSize {
+		t.Errorf("listed in %d pages, want at least %d", len(pages), 1000/versionsPageSize)
+	}
+	for _, n := range pages {
+		if n != versionsPageSize {
+			t.Fatalf("listed a page of %d, want pages of %d", n, versionsPageSize)
+		}
+	}
+
+	// Listings within the limit are untouched
+	setGlobal(t, &maxVersions, 1000)
+	flushListings(func(string) bool { return true })
+	w = serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	var resp ModuleVersionsResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Modules) != 1 {
+		t.Fatalf("within the limit: %v: %s", err, w.Body)
+	}
+	if n := len(resp.Modules[0].Versions); n != 1000 || w.Header().Get("Warning") != "" {
+		t.Errorf("within the limit: %d versions, Warning %q", n, w.Header().Get("Warning"))
+	}
+
+	setGlobal(t, &maxVersions, 3)
+	setGlobal(t, &strictMaxVersions, true)
+	flushListings(func(string) bool { return true })
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("strict: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backendLatency tracks tail latency of backend operations,
+// it's labeled by operation only (list, open or stat) so cardinality stays bounded regardless of bucket size
+var backendLatency = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+	Name:       "tfregistry_backend_operation_duration_seconds",
+	Help:       "Latency of storage backend operations.",
+	Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+}, []string{"operation"})
+
+// httpRequests and httpRequestDuration are labeled by chi route pattern rather than raw path,
+// so every module shares the same series
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tfregistry_http_requests_total",
+		Help: "HTTP requests served, by method, route pattern and status.",
+	}, []string{"method", "path", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tfregistry_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path"})
+)
+
+// cacheLookups counts listing cache lookups by cache and result (hit, stale or miss), to help tune -cache-ttl
+var cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfregistry_cache_lookups_total",
+	Help: "Listing cache lookups, by cache and result (hit, stale or miss).",
+}, []string{"cache", "result"})
+
+// backendUp is 1 while the healthcheck reaches the backend and 0 while it doesn't
+var backendUp = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "tfregistry_backend_up",
+	Help: "Whether the storage backend was reachable at the last healthcheck.",
+})
+
+// registerMetrics registers the registry's collectors with the default prometheus registry
+func registerMetrics() {
+	prometheus.MustRegister(backendLatency, downloadLimit, httpRequests, httpRequestDuration, cacheLookups, backendUp)
+}
+
+// instrumentRequests is a middleware recording the count and latency of every request by route pattern,
+// requests that don't match a route are recorded under "unmatched"
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		pattern := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			pattern = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, pattern, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, pattern).Observe(time.Since(start).Seconds())
+	})
+}
+
+// instrumentedFS is an fs.FS that records the latency of every operation against the wrapped backend
+type instrumentedFS struct {
+	fsys fs.FS
+}
+
+// observe records the time elapsed since start for op
+func (f instrumentedFS) observe(op string, start time.Time) {
+	backendLatency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// withContext implements contextBinder
+func (f instrumentedFS) withContext(ctx context.Context) fs.FS {
+	return instrumentedFS{fsys: bindContext(f.fsys, ctx)}
+}
+
+// Open implements fs.FS, the listings of opened directories are recorded too
+func (f instrumentedFS) Open(name string) (fs.File, error) {
+	defer f.observe("open", time.Now())
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// Only directories are wrapped, files stay seekable for http.ServeContent
+	if dir, ok := file.(fs.ReadDirFile); ok {
+		if fi, err := file.Stat(); err == nil && fi.IsDir() {
+			return instrumentedDir{ReadDirFile: dir, fsys: f}, nil
+		}
+	}
+	return file, nil
+}
+
+// Stat implements fs.StatFS
+func (f instrumentedFS) Stat(name string) (fs.FileInfo, error) {
+	defer f.observe("stat", time.Now())
+	return fs.Stat(f.fsys, name)
+}
+
+// ReadDir implements fs.ReadDirFS
+func (f instrumentedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	defer f.observe("list", time.Now())
+	return fs.ReadDir(f.fsys, name)
+}
+
+// instrumentedDir is a directory opened from an instrumentedFS, recording the latency of each page of its listing
+type instrumentedDir struct {
+	fs.ReadDirFile
+	fsys instrumentedFS
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d instrumentedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	defer d.fsys.observe("list", time.Now())
+	return d.ReadDirFile.ReadDir(n)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	// Collectors register with the default registry served on /metrics, which only happens once per process
+	registerMetrics()
+	setGlobal(t, &enableMetrics, true)
+	h := newTestRegistry(t, testLayout(t))
+	setGlobal(t, &s3fsys, fs.FS(instrumentedFS{fsys: s3fsys}))
+
+	serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil)
+	serve(h, http.MethodGet, "/no/such/route", nil)
+
+	w := serve(h, http.MethodGet, "/metrics", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics status %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, series := range []string{
+		// Backend latency percentiles are recorded per operation
+		`tfregistry_backend_operation_duration_seconds{operation="list",quantile="0.99"}`,
+		`tfregistry_backend_operation_duration_seconds_count{operation="list"}`,
+		`tfregistry_backend_operation_duration_seconds_count{operation="open"}`,
+		// Requests are labeled by route pattern, not by raw path
+		`tfregistry_http_requests_total{method="GET",path="/terraform/modules/v1/{namespace}/{name}/{provider}/versions",status="200"} 1`,
+		`tfregistry_http_requests_total{method="GET",path="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("missing %s", series)
+		}
+	}
+	if strings.Contains(body, "acme/vpc") {
+		t.Error("metrics carry raw module paths")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
+)
+
+// maxCorrelationIDLen bounds the size of client supplied correlation IDs we're willing to log
+const maxCorrelationIDLen = 128
+
+// correlationID is a middleware that adopts the request's correlation header as its request ID,
+// requests without one get an ID generated by middleware.RequestID. Either way the ID is echoed back in the header
+func correlationID(header string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if header == "" {
+			return middleware.RequestID(next)
+		}
+		generated := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(header, middleware.GetReqID(r.Context()))
+			next.ServeHTTP(w, r)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !validCorrelationID(id) {
+				generated.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set(header, id)
+			ctx := context.WithValue(r.Context(), middleware.RequestIDKey, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// clientIP returns the ip of the client making a request,
+// middleware.RealIP replaces RemoteAddr with the bare client ip, otherwise it still carries the port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// validCorrelationID reports whether a client supplied correlation ID is safe to adopt,
+// i.e. non empty, reasonably short and printable ascii
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBaseURL parses the -base-url flag, an absolute http(s) url or a path starting with /,
+// returning it without a trailing slash along with its path
+func parseBaseURL(s string) (base string, basePath string, err error) {
+	if s == "" {
+		return "", "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme == "" && !strings.HasPrefix(s, "/")) || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") ||
+		(u.Scheme != "" && u.Host == "") || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", fmt.Errorf("invalid base url %q, must be an http(s) url or a path starting with /", s)
+	}
+	return strings.TrimSuffix(s, "/"), strings.TrimSuffix(u.Path, "/"), nil
+}
+
+// stripBasePath is a middleware removing the -base-url path from request paths before routing,
+// so the registry works behind proxies whether or not they strip the path themselves
+func stripBasePath(base string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rest, ok := strings.CutPrefix(r.URL.Path, base); ok && (rest == "" || rest[0] == '/') {
+				if rest == "" {
+					rest = "/"
+				}
+				r.URL.Path = rest
+				// chi routes on the escaped path when there is one, keep it so escaped params stay escaped
+				if raw, ok := strings.CutPrefix(r.URL.RawPath, base); ok {
+					r.URL.RawPath = raw
+				} else {
+					r.URL.RawPath = ""
+				}
+				if rctx := chi.RouteContext(r.Context()); rctx != nil {
+					rctx.RoutePath = r.URL.EscapedPath()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// collapseSlashes is a middleware collapsing duplicate slashes in the request path before routing,
+// so that e.g. /terraform/modules/v1/ns//name/aws/versions doesn't resolve to the wrong backend key.
+// Paths below /download/ are left alone past that prefix, as the rest of the path is the backend key
+func collapseSlashes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := collapsePath(r.URL.Path); p != r.URL.Path {
+			r.URL.Path = p
+			r.URL.RawPath = ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				rctx.RoutePath = p
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// collapsePath collapses runs of slashes in p, up to the /download/ prefix if p is a download path
+func collapsePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+		if b.String() == "/download/" {
+			// the run of slashes ending the prefix is still collapsed, the key starts after it
+			b.WriteString(strings.TrimLeft(p[i+1:], "/"))
+			break
+		}
+	}
+	return b.String()
+}
+
+// coordinateParams are the chi URL params holding module coordinates, in path order
+var coordinateParams = []string{"namespace", "name", "provider", "type", "version", "os", "arch"}
+
+// downloadSegments are the segments of a /download/* path
+var downloadSegments = []string{"namespace", "name", "provider", "version", "archive"}
+
+// validateCoordinates is a middleware rejecting module requests with an empty (or . or ..) coordinate segment with a 400,
+// before any backend key is built from them. Such segments would otherwise resolve to a different level of the tree
+func validateCoordinates(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var invalid []string
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			for _, k := range coordinateParams {
+				for i, key := range rctx.URLParams.Keys {
+					if key == k && !validCoordinate(rctx.URLParams.Values[i]) {
+						invalid = append(invalid, k)
+					}
+				}
+			}
+		}
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/download/"); ok {
+			parts := strings.Split(rest, "/")
+			for i, k := range downloadSegments {
+				if i >= len(parts) || !validCoordinate(parts[i]) {
+					invalid = append(invalid, k)
+				}
+			}
+		}
+		if len(invalid) > 0 {
+			renderError(w, r, http.StatusBadRequest, errors.New("missing or invalid module "+strings.Join(invalid, ", ")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowCORS is a middleware letting browser apps on the given origins call the registry, answering their preflight requests.
+// Terraform isn't a browser and never sends an Origin, so it's unaffected
+func allowCORS(origins []string) func(http.Handler) http.Handler {
+	headers := []string{"Authorization", "Content-Type", "If-None-Match", "Range"}
+	// Without these, scripts can't read the download url or the cache and pagination headers
+	exposed := []string{"X-Terraform-Get", "ETag", "Link", "Deprecation", "Sunset", "Retry-After"}
+	if correlationHeader != "" {
+		headers = append(headers, correlationHeader)
+		exposed = append(exposed, correlationHeader)
+	}
+	return cors.Handler(cors.Options{
+		AllowedOrigins: origins,
+		AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost},
+		AllowedHeaders: headers,
+		ExposedHeaders: exposed,
+		MaxAge:         300,
+	})
+}
+
+// withDefaultProvider is a middleware for module routes without a provider segment,
+// adding -default-provider as the provider URL param so the route resolves like the full three segment address
+func withDefaultProvider(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			rctx.URLParams.Add("provider", defaultProvider)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCorrelationID(t *testing.T) {
+	var buf bytes.Buffer
+	setGlobal(t, &logger, slog.New(slog.NewJSONHandler(&buf, nil)))
+	h := newTestRegistry(t, testLayout(t))
+	loggedID := func() string {
+		t.Helper()
+		var line struct {
+			RequestID string `json:"request_id"`
+		}
+		// The request line is the last one logged
+		lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+		if err := json.Unmarshal(lines[len(lines)-1], &line); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		return line.RequestID
+	}
+
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil, "X-Correlation-ID", "ci-run-42")
+	if got := w.Header().Get("X-Correlation-ID"); got != "ci-run-42" {
+		t.Errorf("echoed %q, want the incoming id", got)
+	}
+	if got := loggedID(); got != "ci-run-42" {
+		t.Errorf("logged request_id %q, want the incoming id", got)
+	}
+
+	// Requests without a usable id get a generated one, which is echoed and logged the same way
+	for _, id := range []string{"", "has spaces", string(bytes.Repeat([]byte("x"), maxCorrelationIDLen+1))} {
+		w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil, "X-Correlation-ID", id)
+		got := w.Header().Get("X-Correlation-ID")
+		if got == "" || got == id {
+			t.Errorf("incoming %q: echoed %q, want a generated id", id, got)
+		}
+		if logged := loggedID(); logged != got {
+			t.Errorf("incoming %q: logged %q, echoed %q", id, logged, got)
+		}
+	}
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	for _, s := range []*bool{&enableBrowse, &enableSearch, &enableBatch, &enableCatalog} {
+		setGlobal(t, s, true)
+	}
+	fsys := testLayout(t)
+	for k, v := range testProviderRelease("") {
+		fsys[k] = v
+	}
+	routes := []string{
+		"/.well-known/terraform.json",
+		"/terraform/modules/v1/acme/vpc/aws/versions",
+		"/terraform/modules/v1/acme/vpc/aws/1.0.0/download",
+		"/terraform/modules/v1/acme",
+		"/terraform/modules/v1/acme/vpc/providers",
+		"/terraform/modules/v1/acme/vpc/aws/latest",
+		"/terraform/modules/v1/acme/vpc/aws/versions/stream",
+		"/terraform/modules/v1/acme/vpc/aws/1.0.0",
+		"/terraform/modules/v1/acme/vpc/aws/1.0.0/schema",
+		"/terraform/providers/v1/acme/foo/versions",
+		"/terraform/providers/v1/acme/foo/1.0.0/download/linux/amd64",
+		"/providers/download/acme/foo/1.0.0/linux_amd64/terraform-provider-foo_1.0.0_linux_amd64.zip",
+	}
+	// doubled returns p with its i'th slash doubled
+	doubled := func(p string, i int) string {
+		n := 0
+		for j := range p {
+			if p[j] == '/' {
+				if n == i {
+					return p[:j] + "/" + p[j:]
+				}
+				n++
+			}
+		}
+		return p
+	}
+
+	setGlobal(t, &normalizeSlashes, true)
+	h := newTestRegistry(t, fsys)
+	for _, route := range routes {
+		want := serve(h, http.MethodGet, route, nil)
+		if want.Code >= 300 {
+			t.Fatalf("GET %s status %d, want it served", route, want.Code)
+		}
+		for i := 0; i < strings.Count(route, "/"); i++ {
+			p := doubled(route, i)
+			w := serve(h, http.MethodGet, p, nil)
+			if w.Code != want.Code || w.Body.String() != want.Body.String() {
+				t.Errorf("GET %s: status %d, want %d and the response of %s", p, w.Code, want.Code, route)
+			}
+		}
+	}
+
+	// Download paths are only collapsed up to /download/, the rest is the backend key
+	const download = "/download/acme/vpc/aws/1.0.0/vpc.tgz"
+	if w := serve(h, http.MethodGet, "//download//acme/vpc/aws/1.0.0/vpc.tgz", nil); w.Code != http.StatusOK {
+		t.Errorf("doubled slashes before the key: status %d, want 200", w.Code)
+	}
+	for i := 2; i < strings.Count(download, "/"); i++ {
+		p := doubled(download, i)
+		if w := serve(h, http.MethodGet, p, nil); w.Code < 400 {
+			t.Errorf("GET %s: status %d, want the key left alone and not found", p, w.Code)
+		}
+	}
+
+	// Without -collapse-slashes an empty coordinate is rejected, rather than resolving to another level of the tree
+	setGlobal(t, &normalizeSlashes, false)
+	h = newTestRegistry(t, fsys)
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme//vpc/aws/versions", nil); w.Code < 400 {
+		t.Errorf("without collapsing: status %d, want an error", w.Code)
+	}
+}
+
+func TestEmptyCoordinates(t *testing.T) {
+	setGlobal(t, &enableBrowse, true)
+	h := newTestRegistry(t, testLayout(t))
+	// the backend fails every read, so a 400 is only returned if the request is rejected before reaching it
+	setGlobal(t, &s3fsys, fs.FS(failingFS{errors.New("backend read")}))
+	setGlobal(t, &providerfsys, fs.FS(failingFS{errors.New("backend read")}))
+	for _, c := range []struct{ target, missing string }{
+		{"/terraform/modules/v1/acme//aws/versions", "name"},
+		{"/terraform/modules/v1/acme/vpc//versions", "provider"},
+		{"/terraform/modules/v1//vpc/aws/versions", "namespace"},
+		{"/terraform/modules/v1/acme//aws/1.0.0/download", "name"},
+		{"/terraform/modules/v1/acme/vpc//1.0.0/download", "provider"},
+		{"/terraform/modules/v1/acme/vpc//latest", "provider"},
+		{"/terraform/modules/v1/acme/../aws/versions", "name"},
+		{"/download/acme//aws/1.0.0/vpc.tgz", "name"},
+		{"/download/acme/vpc//1.0.0/vpc.tgz", "provider"},
+		{"/download/acme/vpc/aws/1.0.0/", "archive"},
+		{"/terraform/providers/v1/acme//versions", "type"},
+	} {
+		w := serve(h, http.MethodGet, c.target, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", c.target, w.Code)
+			continue
+		}
+		var resp ErrorResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Errors) != 1 || resp.Errors[0] != "missing or invalid module "+c.missing {
+			t.Errorf("GET %s: errors %v, want the missing %s named", c.target, resp.Errors, c.missing)
+		}
+	}
+}
+
+func TestPathTraversal(t *testing.T) {
+	setGlobal(t, &enableBrowse, true)
+	setGlobal(t, &enableBatch, true)
+	h := newTestRegistry(t, testLayout(t))
+	// the backend fails every read, so a 400 is only returned if the request is rejected before reaching it
+	setGlobal(t, &s3fsys, fs.FS(failingFS{errors.New("backend read")}))
+	setGlobal(t, &providerfsys, fs.FS(failingFS{errors.New("backend read")}))
+	for _, target := range []string{
+		"/terraform/modules/v1/acme/../../etc/versions",
+		"/terraform/modules/v1/../../../etc/passwd/versions",
+		"/terraform/modules/v1/acme/vpc/aws/../../../../etc/download",
+		"/terraform/modules/v1/acme/%2e%2e/aws/versions",
+		"/terraform/modules/v1/acme/%2E%2E/aws/versions",
+		"/terraform/modules/v1/acme/..%2f..%2fetc/aws/versions",
+		"/terraform/modules/v1/acme/..%5c..%5cetc/aws/versions",
+		"/terraform/modules/v1/acme/%252e%252e/aws/versions",
+		"/terraform/modules/v1/acme/vpc%00/aws/versions",
+		"/terraform/modules/v1/acme/vpc%0a/aws/versions",
+		"/terraform/modules/v1/acme/vpc/aws/..%2f1.0.0/download",
+		"/terraform/modules/v1/acme/vpc/providers/..",
+		"/download/acme/../../etc/1.0.0/passwd",
+		"/download/acme/vpc/aws/../../../../etc/passwd",
+		"/download/acme/vpc/aws/%2e%2e/vpc.tgz",
+		"/download/acme/vpc/aws/1.0.0/..%2f..%2f..%2fetc%2fpasswd",
+		"/download/acme/vpc%5c..%5c..%5cetc/aws/1.0.0/vpc.tgz",
+		"/terraform/providers/v1/acme/..%2f..%2fetc/versions",
+		"/terraform/providers/v1/acme/foo/../../download/linux/amd64",
+		"/providers/download/acme/foo/1.0.0/../../../../etc/passwd",
+		"/providers/download/acme/foo/1.0.0/..%2f..%2fetc%2fpasswd",
+	} {
+		w := serve(h, http.MethodGet, target, nil)
+		if w.Code < 400 || w.Code >= 500 {
+			t.Errorf("GET %s: status %d, want it rejected before the backend is read", target, w.Code)
+		}
+	}
+
+	body := strings.NewReader(`{"modules":[{"namespace":"acme","name":"../../etc","provider":"aws"}]}`)
+	if w := serve(h, http.MethodPost, "/terraform/modules/v1/versions:batch", body); w.Code != http.StatusBadRequest {
+		t.Errorf("batch: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// monolithFS is a read-only fs.FS over a single uncompressed tar holding the whole registry tree,
+// i.e. a tar of every <namespace>/<name>/<provider>/<version>/<archive> tarball.
+// The tar is indexed once when opened, files are then read straight from their offset within it
+type monolithFS struct {
+	f       *os.File
+	files   map[string]monolithEntry
+	entries map[string][]fs.DirEntry
+}
+
+// monolithEntry is an indexed file or directory of a monolithFS, it's both its fs.FileInfo and fs.DirEntry
+type monolithEntry struct {
+	name    string
+	offset  int64
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (e monolithEntry) Name() string       { return e.name }
+func (e monolithEntry) Size() int64        { return e.size }
+func (e monolithEntry) ModTime() time.Time { return e.modTime }
+func (e monolithEntry) IsDir() bool        { return e.dir }
+func (e monolithEntry) Sys() any           { return nil }
+func (e monolithEntry) Type() fs.FileMode  { return e.Mode().Type() }
+
+func (e monolithEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e monolithEntry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// openMonolith opens and indexes a monolithic registry tar
+func openMonolith(name string) (*monolithFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	m := &monolithFS{
+		f:       f,
+		files:   map[string]monolithEntry{".": {name: ".", dir: true}},
+		entries: map[string][]fs.DirEntry{},
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("indexing %s: %w", name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// the tar reader has consumed exactly the entry's headers, so the file is positioned at its data
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("indexing %s: %w", name, err)
+		}
+		p := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(p) || p == "." {
+			continue
+		}
+		m.add(monolithEntry{name: path.Base(p), offset: offset, size: hdr.Size, modTime: hdr.ModTime}, p)
+	}
+	for _, entries := range m.entries {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return m, nil
+}
+
+// add indexes a file at p, along with any parent directories not yet seen
+func (m *monolithFS) add(e monolithEntry, p string) {
+	dir := path.Dir(p)
+	if _, ok := m.files[p]; ok {
+		// like tar itself, a later entry replaces an earlier one
+		m.files[p] = e
+		for i, de := range m.entries[dir] {
+			if de.Name() == e.name {
+				m.entries[dir][i] = e
+			}
+		}
+		return
+	}
+	m.files[p] = e
+	m.entries[dir] = append(m.entries[dir], e)
+	if _, ok := m.files[dir]; !ok {
+		m.add(monolithEntry{name: path.Base(dir), modTime: e.modTime, dir: true}, dir)
+	}
+}
+
+// Open implements fs.FS
+func (m *monolithFS) Open(name string) (fs.File, error) {
+	e, err := m.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		return &monolithDir{entry: e, entries: m.entries[name]}, nil
+	}
+	return &monolithFile{SectionReader: io.NewSectionReader(m.f, e.offset, e.size), entry: e}, nil
+}
+
+// Stat implements fs.StatFS
+func (m *monolithFS) Stat(name string) (fs.FileInfo, error) {
+	return m.stat("stat", name)
+}
+
+// ReadDir implements fs.ReadDirFS
+func (m *monolithFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := m.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return append([]fs.DirEntry{}, m.entries[name]...), nil
+}
+
+// stat looks up an indexed entry
+func (m *monolithFS) stat(op string, name string) (monolithEntry, error) {
+	if !fs.ValidPath(name) {
+		return monolithEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := m.files[name]
+	if !ok {
+		return monolithEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// monolithFile is an open file of a monolithFS, it's seekable so http.FileServer can serve ranges of it
+type monolithFile struct {
+	*io.SectionReader
+	entry monolithEntry
+}
+
+func (f *monolithFile) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *monolithFile) Close() error               { return nil }
+
+// monolithDir is an open directory of a monolithFS
+type monolithDir struct {
+	entry   monolithEntry
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *monolithDir) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *monolithDir) Close() error               { return nil }
+
+func (d *monolithDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *monolithDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.read:]
+	if n <= 0 {
+		d.read = len(d.entries)
+		return append([]fs.DirEntry{}, rest...), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.read += n
+	return append([]fs.DirEntry{}, rest[:n]...), nil
+}
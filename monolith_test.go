@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// testMonolith writes an uncompressed tar holding files by path and returns its name
+func testMonolith(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "registry.tar")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for p, b := range files {
+		hdr := &tar.Header{Name: p, Mode: 0644, Size: int64(len(b)), ModTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestMonolithFS(t *testing.T) {
+	files := map[string][]byte{
+		"acme/vpc/aws/1.0.0/vpc.tgz": testTarball(t, map[string]string{"main.tf": "1.0.0"}),
+		"acme/vpc/aws/1.2.0/vpc.tgz": testTarball(t, map[string]string{"main.tf": "1.2.0"}),
+		// long enough to need a PAX header, which mustn't throw the data offsets off
+		"acme/vpc/aws/1.2.0/" + strings.Repeat("x", 120) + ".md": []byte("long name"),
+		"acme/dns/google/0.1.0/dns.tgz":                          testTarball(t, map[string]string{"main.tf": "dns"}),
+	}
+	m, err := openMonolith(testMonolith(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]string, 0, len(files))
+	for p := range files {
+		want = append(want, p)
+	}
+	if err := fstest.TestFS(m, want...); err != nil {
+		t.Fatal(err)
+	}
+	for p, b := range files {
+		got, err := fs.ReadFile(m, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(b) {
+			t.Errorf("%s: contents differ from the contained file", p)
+		}
+	}
+
+	if _, err := openMonolith(filepath.Join(t.TempDir(), "missing.tar")); err == nil {
+		t.Error("missing archive: no error")
+	}
+}
+
+func TestMonolithRegistry(t *testing.T) {
+	archive := testTarball(t, map[string]string{"main.tf": "module"})
+	m, err := openMonolith(testMonolith(t, map[string][]byte{
+		"acme/vpc/aws/1.0.0/vpc.tgz": testTarball(t, map[string]string{"main.tf": "old"}),
+		"acme/vpc/aws/1.2.0/vpc.tgz": archive,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestRegistry(t, fstest.MapFS{})
+	setGlobal(t, &s3fsys, fs.FS(m))
+
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("versions: status %d, want 200", w.Code)
+	}
+	if got, want := w.Body.String(), `{"modules":[{"source":"acme/vpc/aws","versions":[{"version":"1.0.0"},{"version":"1.2.0"}]}]}`; strings.TrimSpace(got) != want {
+		t.Errorf("versions %s, want %s", got, want)
+	}
+	w = serve(h, http.MethodGet, "/download/acme/vpc/aws/1.2.0/vpc.tgz", nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(archive) {
+		t.Errorf("download: status %d, or the contained tarball wasn't served", w.Code)
+	}
+	w = serve(h, http.MethodGet, "/download/acme/vpc/aws/1.2.0/vpc.tgz", nil, "Range", "bytes=2-9")
+	if w.Code != http.StatusPartialContent || w.Body.String() != string(archive[2:10]) {
+		t.Errorf("range: status %d, body %q, want 206 and %q", w.Code, w.Body, archive[2:10])
+	}
+	if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/2.0.0/vpc.tgz", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing version: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NamespaceModule is a module of a namespace listing
+type NamespaceModule struct {
+	Name          string `json:"name"`
+	Provider      string `json:"provider"`
+	LatestVersion string `json:"latest_version"`
+}
+
+// namespaceModules lists the name/provider directories of a namespace, sorted by name and provider
+func namespaceModules(ctx context.Context, namespace string) ([]Module, error) {
+	nsPath := backendKey(ctx, namespace)
+	names, err := fs.ReadDir(moduleFS(ctx), nsPath)
+	if err != nil {
+		return nil, err
+	}
+	var mods []Module
+	var dirs []string
+	for _, e := range names {
+		if e.IsDir() {
+			mods = append(mods, Module{Namespace: namespace, Name: e.Name()})
+			dirs = append(dirs, backendKey(ctx, namespace, e.Name()))
+		}
+	}
+	providers, err := readDirs(moduleFS(ctx), dirs, listConcurrency, nil)
+	if err != nil {
+		return nil, err
+	}
+	var found []Module
+	for i, m := range mods {
+		for _, e := range providers[i] {
+			if e.IsDir() {
+				m.Provider = e.Name()
+				found = append(found, m)
+			}
+		}
+	}
+	return found, nil
+}
+
+// httpGetNamespace is a http handler listing every module of a namespace at its latest version.
+// A namespace without modules lists none, one without a directory is a 404
+func httpGetNamespace(w http.ResponseWriter, r *http.Request) {
+	namespace := chi.URLParam(r, "namespace")
+	nsPath := backendKey(r.Context(), namespace)
+	var mods []Module
+	err := fs.ErrNotExist
+	// The providers directory holds the provider registry, not a module namespace
+	if namespace != ProvidersDir {
+		mods, err = namespaceModules(r.Context(), namespace)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		renderError(w, r, http.StatusNotFound, errors.New("namespace not found"))
+		return
+	}
+	if err != nil {
+		logKeyAccess(r.Context(), slog.LevelError, "failed to list namespace modules", nsPath, []slog.Attr{slog.String("namespace", namespace), slog.Any("error", err)})
+		renderError(w, r, 500, err)
+		return
+	}
+	versions, err := fanOut(r.Context(), mods, listConcurrency, func(m Module) string { return listedVersion(r.Context(), m) })
+	if err != nil {
+		// The client went away, there's no one left to respond to
+		return
+	}
+	resp := make([]NamespaceModule, 0, len(mods))
+	for i, m := range mods {
+		resp = append(resp, NamespaceModule{Name: m.Name, Provider: m.Provider, LatestVersion: versions[i]})
+	}
+	logKeyAccess(r.Context(), slog.LevelInfo, "listed namespace modules", nsPath, []slog.Attr{slog.String("namespace", namespace)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// objectStore is a flat object store, e.g. a gcs bucket or an azure blob container, presented as an fs.FS by objectFS.
+// Like s3, object stores have no directories, a directory is any prefix (ending in /) that objects exist below
+type objectStore interface {
+	// attrs looks up the object named key, returning fs.ErrNotExist when there's none
+	attrs(ctx context.Context, key string) (objectEntry, error)
+	// list lists the objects and prefixes directly below prefix, which is empty or ends in /, named by their base names.
+	// At most limit entries are listed unless it's 0.
+	// A zero length object named after the prefix is the console's placeholder for an empty folder and isn't listed
+	list(ctx context.Context, prefix string, limit int) ([]objectEntry, error)
+	// openRange reads the object named key from offset off to its end
+	openRange(ctx context.Context, key string, off int64) (io.ReadCloser, error)
+}
+
+// objectFS is a read-only fs.FS over an objectStore. Its calls to the store are made with ctx, which contextFS binds
+// to the request they're made for so they're cancelled with it, and with context.Background() when it's unset
+type objectFS struct {
+	store objectStore
+	ctx   context.Context
+}
+
+// withContext implements contextBinder
+func (o objectFS) withContext(ctx context.Context) fs.FS {
+	o.ctx = ctx
+	return o
+}
+
+// context returns the context calls to the store are made with
+func (o objectFS) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// objectEntry is an object or prefix of an objectStore, it's both its fs.FileInfo and fs.DirEntry
+type objectEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	// etag is the ETag the store assigned the object
+	etag string
+}
+
+func (e objectEntry) Name() string       { return e.name }
+func (e objectEntry) Size() int64        { return e.size }
+func (e objectEntry) ModTime() time.Time { return e.modTime }
+func (e objectEntry) IsDir() bool        { return e.dir }
+func (e objectEntry) Sys() any           { return nil }
+func (e objectEntry) ETag() string       { return e.etag }
+func (e objectEntry) Type() fs.FileMode  { return e.Mode().Type() }
+
+func (e objectEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e objectEntry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// Open implements fs.FS
+func (o objectFS) Open(name string) (fs.File, error) {
+	e, err := o.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		entries, err := o.list("open", name)
+		if err != nil {
+			return nil, err
+		}
+		return &objectDir{entry: e, entries: entries}, nil
+	}
+	return &objectFile{store: o.store, ctx: o.context(), key: name, entry: e}, nil
+}
+
+// Stat implements fs.StatFS
+func (o objectFS) Stat(name string) (fs.FileInfo, error) {
+	return o.stat("stat", name)
+}
+
+// ReadDir implements fs.ReadDirFS
+func (o objectFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := o.list("readdir", name)
+	if err == nil && len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries, err
+}
+
+// stat looks up name as an object, falling back to a prefix
+func (o objectFS) stat(op string, name string) (objectEntry, error) {
+	if !fs.ValidPath(name) {
+		return objectEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return objectEntry{name: ".", dir: true}, nil
+	}
+	ctx := o.context()
+	e, err := o.store.attrs(ctx, name)
+	if err == nil {
+		e.name = path.Base(name)
+		return e, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return objectEntry{}, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	below, err := o.store.list(ctx, name+"/", 1)
+	if err == nil && len(below) == 0 {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return objectEntry{}, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return objectEntry{name: path.Base(name), dir: true}, nil
+}
+
+// list lists the entries of the directory name, sorted by name
+func (o objectFS) list(op string, name string) ([]fs.DirEntry, error) {
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+	listed, err := o.store.list(o.context(), prefix, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, len(listed))
+	for i, e := range listed {
+		entries[i] = e
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// objectFile is an open object of an objectFS. It's seekable, reads are ranged reads from the seeked offset,
+// so ranges of an object are served without downloading all of it
+type objectFile struct {
+	store objectStore
+	ctx   context.Context
+	key   string
+	entry objectEntry
+
+	r   io.ReadCloser
+	off int64
+}
+
+func (f *objectFile) Stat() (fs.FileInfo, error) { return f.entry, nil }
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.off >= f.entry.size {
+		return 0, io.EOF
+	}
+	if f.r == nil {
+		r, err := f.store.openRange(f.ctx, f.key, f.off)
+		if err != nil {
+			return 0, err
+		}
+		f.r = r
+	}
+	n, err := f.r.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker, the next read starts a new ranged read when the offset changes
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.entry.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.key, Err: fs.ErrInvalid}
+	}
+	if offset != f.off && f.r != nil {
+		f.r.Close()
+		f.r = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *objectFile) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	return f.r.Close()
+}
+
+// objectDir is an open directory of an objectFS
+type objectDir struct {
+	entry   objectEntry
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *objectDir) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *objectDir) Close() error               { return nil }
+
+func (d *objectDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *objectDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.read:]
+	if n <= 0 {
+		d.read = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.read += n
+	return rest[:n], nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// mapStore is an objectStore of the files of a MapFS, recording the contexts it's called with.
+// With block set, calls wait for their context to be done
+type mapStore struct {
+	fsys  fstest.MapFS
+	block bool
+
+	mu   sync.Mutex
+	ctxs []context.Context
+}
+
+func (s *mapStore) called(ctx context.Context) error {
+	s.mu.Lock()
+	s.ctxs = append(s.ctxs, ctx)
+	s.mu.Unlock()
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *mapStore) attrs(ctx context.Context, key string) (objectEntry, error) {
+	if err := s.called(ctx); err != nil {
+		return objectEntry{}, err
+	}
+	f, ok := s.fsys[key]
+	if !ok {
+		return objectEntry{}, fs.ErrNotExist
+	}
+	return objectEntry{size: int64(len(f.Data)), modTime: f.ModTime, etag: "etag"}, nil
+}
+
+func (s *mapStore) list(ctx context.Context, prefix string, limit int) ([]objectEntry, error) {
+	if err := s.called(ctx); err != nil {
+		return nil, err
+	}
+	var entries []objectEntry
+	seen := map[string]bool{}
+	for name, f := range s.fsys {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		if dir, _, ok := strings.Cut(rest, "/"); ok {
+			if !seen[dir] {
+				seen[dir] = true
+				entries = append(entries, objectEntry{name: dir, dir: true})
+			}
+			continue
+		}
+		entries = append(entries, objectEntry{name: path.Base(name), size: int64(len(f.Data)), modTime: f.ModTime})
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (s *mapStore) openRange(ctx context.Context, key string, off int64) (io.ReadCloser, error) {
+	if err := s.called(ctx); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(s.fsys[key].Data[off:])), nil
+}
+
+// requestKey marks the contexts of test requests
+type requestKey struct{}
+
+func TestObjectFSContext(t *testing.T) {
+	layout := testLayout(t)
+	primary, secondary := &mapStore{fsys: layout}, &mapStore{fsys: layout}
+	backend := instrumentedFS{fsys: failoverFS{primary: objectFS{store: primary}, secondary: objectFS{store: secondary}}}
+	want := make([]string, 0, len(layout))
+	for name := range layout {
+		want = append(want, name)
+	}
+	if err := fstest.TestFS(backend, want...); err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range primary.ctxs {
+		if ctx != context.Background() {
+			t.Fatal("an unbound objectFS didn't call its store with context.Background()")
+		}
+	}
+
+	// Bound to a request, through every wrapper, each call to the store is made with the request's context
+	primary.ctxs = nil
+	ctx := context.WithValue(context.Background(), requestKey{}, "request")
+	fsys := contextFS{fsys: backend, ctx: ctx}
+	if _, err := fs.ReadDir(fsys, "acme/vpc/aws"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "acme/vpc/aws/1.0.0/vpc.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "acme/vpc/aws/1.0.0/vpc.tgz"); err != nil || !bytes.Equal(b, layout["acme/vpc/aws/1.0.0/vpc.tgz"].Data) {
+		t.Fatalf("read %d bytes, %v", len(b), err)
+	}
+	if len(primary.ctxs) < 3 {
+		t.Fatalf("%d store calls, want the listing, stat and read", len(primary.ctxs))
+	}
+	for _, c := range primary.ctxs {
+		if c.Value(requestKey{}) != "request" {
+			t.Fatal("a store call wasn't made with the request's context")
+		}
+	}
+}
+
+func TestObjectFSCancelledWithRequest(t *testing.T) {
+	h := newTestRegistry(t, testLayout(t))
+	store := &mapStore{fsys: testLayout(t), block: true}
+	setGlobal(t, &s3fsys, fs.FS(objectFS{store: store}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	// wait for the download to reach the store before the client goes away
+	eventually(t, "the download calls the store", func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.ctxs) > 0
+	})
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the store call outlived its request")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+)
+
+// teamHandle matches the team handles accepted as owners, e.g. @platform or @mycorp/platform
+var teamHandle = regexp.MustCompile(`^@[A-Za-z0-9][A-Za-z0-9_-]*(/[A-Za-z0-9][A-Za-z0-9_-]*)?$`)
+
+// validOwner reports whether s is an email address or a team handle
+func validOwner(s string) bool {
+	if teamHandle.MatchString(s) {
+		return true
+	}
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// metadataOwners returns the owners field of a module version's metadata object, which is empty without one
+func metadataOwners(metadata []byte) ([]string, error) {
+	var meta struct {
+		Owners []string `json:"owners"`
+	}
+	if err := json.Unmarshal(metadata, &meta); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", MetadataFile, err)
+	}
+	return meta.Owners, nil
+}
+
+// checkOwners validates the owners of a module version's metadata object for -require-owners,
+// there must be at least one and every owner must be an email address or a team handle
+func checkOwners(metadata []byte) error {
+	if metadata == nil {
+		return fmt.Errorf("missing %s, owners are required", MetadataFile)
+	}
+	owners, err := metadataOwners(metadata)
+	if err != nil {
+		return err
+	}
+	if len(owners) == 0 {
+		return errors.New("missing owners, at least one email address or team handle is required")
+	}
+	for _, o := range owners {
+		if !validOwner(o) {
+			return fmt.Errorf("invalid owner %q, must be an email address or a team handle (e.g. @mycorp/platform)", o)
+		}
+	}
+	return nil
+}
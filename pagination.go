@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// defaultPerPage is the page size of paginated version listings without a per_page param
+	defaultPerPage = 50
+	// maxPerPage bounds the page size of paginated version listings
+	maxPerPage = 500
+)
+
+// VersionsPage is the pagination metadata of a paginated version listing,
+// next and prev are the urls of the neighbouring pages and omitted on the last and first page
+type VersionsPage struct {
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+	Total   int    `json:"total"`
+	Next    string `json:"next,omitempty"`
+	Prev    string `json:"prev,omitempty"`
+}
+
+// parsePage parses the page and per_page query params of a version listing, ok is false when neither is set
+// and the full listing should be returned, as terraform expects
+func parsePage(q url.Values) (page int, perPage int, ok bool, err error) {
+	if !q.Has("page") && !q.Has("per_page") {
+		return 0, 0, false, nil
+	}
+	page, perPage = 1, defaultPerPage
+	if v := q.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, true, fmt.Errorf("invalid page %q, must be a positive integer", v)
+		}
+	}
+	if v := q.Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 || perPage > maxPerPage {
+			return 0, 0, true, fmt.Errorf("invalid per_page %q, must be between 1 and %d", v, maxPerPage)
+		}
+	}
+	return page, perPage, true, nil
+}
+
+// paginateVersions returns a single page of a module's (sorted) versions, with links to the neighbouring pages of r.
+// modVers is a shared cached listing, so it's copied rather than sliced in place
+func paginateVersions(r *http.Request, modVers ModuleVersionsResp, page int, perPage int) ModuleVersionsResp {
+	m := modVers.Modules[0]
+	total := len(m.Versions)
+	start := min((page-1)*perPage, total)
+	end := min(start+perPage, total)
+	m.Versions = m.Versions[start:end:end]
+
+	meta := &VersionsPage{Page: page, PerPage: perPage, Total: total}
+	pageURL := func(p int) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("per_page", strconv.Itoa(perPage))
+		return baseURL + tenantPath(r.Context()) + r.URL.Path + "?" + q.Encode()
+	}
+	if end < total {
+		meta.Next = pageURL(page + 1)
+	}
+	if page > 1 {
+		meta.Prev = pageURL(max(1, min(page-1, (total+perPage-1)/perPage)))
+	}
+	return ModuleVersionsResp{Modules: []ModuleVersions{m}, Page: meta}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hashicorp/go-version"
+)
+
+// ProviderBasePath is the base v1 api path for the terraform provider registry
+const ProviderBasePath = "/terraform/providers/v1"
+
+// ProvidersDir is the top level backend directory providers are stored under, laid out like modules:
+//
+//	providers/{namespace}/{type}/{version}/{os}_{arch}/terraform-provider-{type}_{version}_{os}_{arch}.zip
+//	providers/{namespace}/{type}/{version}/terraform-provider-{type}_{version}_SHA256SUMS
+//	providers/{namespace}/{type}/{version}/terraform-provider-{type}_{version}_SHA256SUMS.sig
+//	providers/{namespace}/signing-keys.json
+//
+// A terraform-provider-{type}_{version}_manifest.json (as written by goreleaser) may list the plugin protocol versions
+// a release supports, releases without one are assumed to support protocol 5.0
+const ProvidersDir = "providers"
+
+// SigningKeysFile is the name of a provider namespace's signing keys, in the registry protocol's signing_keys format
+const SigningKeysFile = "signing-keys.json"
+
+// defaultProviderProtocols are the plugin protocol versions of provider releases without a manifest
+var defaultProviderProtocols = []string{"5.0"}
+
+// Provider respresents a terraform provider release for a single platform
+type Provider struct {
+	Namespace string
+	Type      string
+	Version   string
+	OS        string
+	Arch      string
+}
+
+// ProviderPlatform is an os and architecture a provider release is available for
+type ProviderPlatform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// ProviderVersion is a provider release
+type ProviderVersion struct {
+	Version   string             `json:"version"`
+	Protocols []string           `json:"protocols"`
+	Platforms []ProviderPlatform `json:"platforms"`
+}
+
+// ProviderVersionsResp is our provider versions response struct
+type ProviderVersionsResp struct {
+	Versions []ProviderVersion `json:"versions"`
+}
+
+// GPGPublicKey is an ascii armored public key provider releases are signed with
+type GPGPublicKey struct {
+	KeyID      string `json:"key_id"`
+	ASCIIArmor string `json:"ascii_armor"`
+}
+
+// SigningKeys are the keys a provider namespace's releases are signed with
+type SigningKeys struct {
+	GPGPublicKeys []GPGPublicKey `json:"gpg_public_keys"`
+}
+
+// ProviderPackageResp is our provider package response struct
+type ProviderPackageResp struct {
+	Protocols           []string    `json:"protocols"`
+	OS                  string      `json:"os"`
+	Arch                string      `json:"arch"`
+	Filename            string      `json:"filename"`
+	DownloadURL         string      `json:"download_url"`
+	SHASumsURL          string      `json:"shasums_url"`
+	SHASumsSignatureURL string      `json:"shasums_signature_url"`
+	SHASum              string      `json:"shasum"`
+	SigningKeys         SigningKeys `json:"signing_keys"`
+}
+
+// providerKey builds the provider backend key of a file below the providers directory of a request,
+// which is below its tenant's prefix for tenant requests and -provider-prefix otherwise
+func providerKey(ctx context.Context, elem ...string) string {
+	root := providerPrefix
+	if t, ok := requestTenant(ctx); ok {
+		root = t.prefix
+	}
+	return path.Join(append([]string{".", root, ProvidersDir}, elem...)...)
+}
+
+// providerFilePrefix is the prefix of every file name of a provider release
+func providerFilePrefix(p Provider) string {
+	return "terraform-provider-" + p.Type + "_" + p.Version
+}
+
+// providerProtocols returns the plugin protocol versions a provider release supports, from its manifest if it has one
+func providerProtocols(ctx context.Context, p Provider) ([]string, error) {
+	b, err := fs.ReadFile(providerFS(ctx), providerKey(ctx, p.Namespace, p.Type, p.Version, providerFilePrefix(p)+"_manifest.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return defaultProviderProtocols, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Metadata struct {
+			ProtocolVersions []string `json:"protocol_versions"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil || len(manifest.Metadata.ProtocolVersions) == 0 {
+		return defaultProviderProtocols, nil
+	}
+	return manifest.Metadata.ProtocolVersions, nil
+}
+
+// getProviderVersions is a helper function to look up all releases of a provider and the platforms they're available for,
+// sorted in ascending semver order
+func getProviderVersions(ctx context.Context, namespace string, typ string) (ProviderVersionsResp, error) {
+	versionDirs, err := fs.ReadDir(providerFS(ctx), providerKey(ctx, namespace, typ))
+	if err != nil {
+		return ProviderVersionsResp{}, err
+	}
+	type release struct {
+		v  ProviderVersion
+		sv *version.Version
+	}
+	var releases []release
+	for _, d := range versionDirs {
+		if !d.IsDir() {
+			continue
+		}
+		sv, err := version.NewSemver(d.Name())
+		if err != nil {
+			logger.Warn("skipping provider version directory that isn't valid semver", slog.String("namespace", namespace), slog.String("type", typ), slog.String("version", d.Name()))
+			continue
+		}
+		p := Provider{Namespace: namespace, Type: typ, Version: d.Name()}
+		platformDirs, err := fs.ReadDir(providerFS(ctx), providerKey(ctx, namespace, typ, p.Version))
+		if err != nil {
+			return ProviderVersionsResp{}, err
+		}
+		v := ProviderVersion{Version: p.Version, Platforms: []ProviderPlatform{}}
+		for _, pd := range platformDirs {
+			goos, arch, ok := strings.Cut(pd.Name(), "_")
+			if pd.IsDir() && ok {
+				v.Platforms = append(v.Platforms, ProviderPlatform{OS: goos, Arch: arch})
+			}
+		}
+		if v.Protocols, err = providerProtocols(ctx, p); err != nil {
+			return ProviderVersionsResp{}, err
+		}
+		releases = append(releases, release{v, sv})
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].sv.LessThan(releases[j].sv) })
+	resp := ProviderVersionsResp{Versions: make([]ProviderVersion, len(releases))}
+	for i, r := range releases {
+		resp.Versions[i] = r.v
+	}
+	return resp, nil
+}
+
+// httpGetProviderVersions is a http handler for retrieving the releases of a provider,
+// the registry server expects them to be sub-directories of providers/{namespace}/{type}/ in our fs.FS backend
+func httpGetProviderVersions(w http.ResponseWriter, r *http.Request) {
+	namespace, typ := chi.URLParam(r, "namespace"), chi.URLParam(r, "type")
+	key := providerKey(r.Context(), namespace, typ)
+	resp, err := providerVersionsCache.get(r.Context(), key, func(ctx context.Context) (ProviderVersionsResp, error) {
+		return getProviderVersions(ctx, namespace, typ)
+	})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("provider not found"))
+			return
+		}
+		logProviderAccess(r, slog.LevelError, "failed to list provider versions", key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	logProviderAccess(r, slog.LevelInfo, "listed provider versions", key)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// httpGetProviderPackage is a http handler for retrieving the package of a provider release for a single platform,
+// the package's urls are relative, terraform resolves them against the registry
+func httpGetProviderPackage(w http.ResponseWriter, r *http.Request) {
+	p := Provider{
+		Namespace: chi.URLParam(r, "namespace"),
+		Type:      chi.URLParam(r, "type"),
+		Version:   chi.URLParam(r, "version"),
+		OS:        chi.URLParam(r, "os"),
+		Arch:      chi.URLParam(r, "arch"),
+	}
+	platform := p.OS + "_" + p.Arch
+	filename := providerFilePrefix(p) + "_" + platform + ".zip"
+	sumsName := providerFilePrefix(p) + "_" + SumsFile
+	key := providerKey(r.Context(), p.Namespace, p.Type, p.Version, platform, filename)
+	if _, err := fs.Stat(providerFS(r.Context()), key); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("provider not found"))
+			return
+		}
+		logProviderAccess(r, slog.LevelError, "failed to look up provider package", key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+
+	// Terraform refuses packages that aren't signed, so the checksums, their signature and the keys are all required
+	resp := ProviderPackageResp{
+		OS:                  p.OS,
+		Arch:                p.Arch,
+		Filename:            filename,
+		DownloadURL:         providerDownloadPath(r.Context(), p, platform, filename),
+		SHASumsURL:          providerDownloadPath(r.Context(), p, sumsName),
+		SHASumsSignatureURL: providerDownloadPath(r.Context(), p, sumsName+".sig"),
+	}
+	var err error
+	if resp.Protocols, err = providerProtocols(r.Context(), p); err != nil {
+		logProviderAccess(r, slog.LevelError, "failed to read provider manifest", key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	b, err := fs.ReadFile(providerFS(r.Context()), providerKey(r.Context(), p.Namespace, p.Type, p.Version, sumsName))
+	if err == nil {
+		var sums map[string]string
+		if sums, err = parseSums(b); err == nil {
+			resp.SHASum = sums[filename]
+		}
+	}
+	if err != nil || resp.SHASum == "" {
+		logProviderAccess(r, slog.LevelError, "provider release has no checksum for package", key, slog.Any("error", err))
+		renderError(w, r, 500, errors.New("provider release has no checksum for "+filename))
+		return
+	}
+	b, err = fs.ReadFile(providerFS(r.Context()), providerKey(r.Context(), p.Namespace, SigningKeysFile))
+	if err == nil {
+		err = json.Unmarshal(b, &resp.SigningKeys)
+	}
+	if err != nil {
+		logProviderAccess(r, slog.LevelError, "failed to read provider signing keys", key, slog.Any("error", err))
+		renderError(w, r, 500, errors.New("provider namespace has no valid "+SigningKeysFile))
+		return
+	}
+	logProviderAccess(r, slog.LevelInfo, "resolved provider package", key)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// providerDownloadPath returns the path a file of a provider release is downloaded from, below the request's tenant
+func providerDownloadPath(ctx context.Context, p Provider, elem ...string) string {
+	return baseURL + tenantPath(ctx) + strings.Join(append([]string{"/providers/download", p.Namespace, p.Type, p.Version}, elem...), "/")
+}
+
+// httpGetProviderFile is a http handler for downloading the files of a provider release,
+// i.e. its platform packages, checksums and their signature
+func httpGetProviderFile(w http.ResponseWriter, r *http.Request) {
+	rest := chi.URLParam(r, "*")
+	if !fs.ValidPath(rest) || rest == "." || slices.ContainsFunc(strings.Split(rest, "/"), func(s string) bool { return !validCoordinate(s) }) {
+		renderError(w, r, http.StatusBadRequest, errors.New("invalid provider file path"))
+		return
+	}
+	key := providerKey(r.Context(), chi.URLParam(r, "namespace"), chi.URLParam(r, "type"), chi.URLParam(r, "version"), rest)
+	if strings.HasSuffix(key, ".zip") {
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	// Only files are served, http.ServeFileFS would otherwise list directories
+	fi, err := fs.Stat(providerFS(r.Context()), key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logProviderAccess(r, slog.LevelError, "failed to stat provider file", key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	if err != nil || !fi.Mode().IsRegular() {
+		renderError(w, r, http.StatusNotFound, errors.New("provider file not found"))
+		return
+	}
+	logProviderAccess(r, slog.LevelInfo, "serving provider download", key)
+	http.ServeFileFS(w, r, providerFS(r.Context()), key)
+}
+
+// logProviderAccess logs an access to the backend object key on behalf of a provider request,
+// identifying the provider by its URL params
+func logProviderAccess(r *http.Request, level slog.Level, msg string, key string, attrs ...slog.Attr) {
+	coords := []slog.Attr{
+		slog.String("namespace", chi.URLParam(r, "namespace")),
+		slog.String("type", chi.URLParam(r, "type")),
+	}
+	if v := chi.URLParam(r, "version"); v != "" {
+		coords = append(coords, slog.String("version", v))
+	}
+	logKeyAccess(r.Context(), level, msg, key, append(coords, attrs...))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testProviderRelease returns a backend holding a signed release of the acme/foo provider for linux_amd64 below root
+func testProviderRelease(root string) fstest.MapFS {
+	const sums = "5d41402abc4b2a76b9719d911017c592ae76c9e4c6b5a1e0c6d7a2b6f0e1d2c3  terraform-provider-foo_1.0.0_linux_amd64.zip\n"
+	return fstest.MapFS{
+		root + "providers/acme/signing-keys.json":                                                  testFile([]byte(`{"gpg_public_keys":[{"key_id":"ABCD","ascii_armor":"-----BEGIN PGP PUBLIC KEY BLOCK-----"}]}`)),
+		root + "providers/acme/foo/1.0.0/linux_amd64/terraform-provider-foo_1.0.0_linux_amd64.zip": testFile([]byte("zip")),
+		root + "providers/acme/foo/1.0.0/terraform-provider-foo_1.0.0_SHA256SUMS":                  testFile([]byte(sums)),
+		root + "providers/acme/foo/1.0.0/terraform-provider-foo_1.0.0_SHA256SUMS.sig":              testFile([]byte("sig")),
+	}
+}
+
+func TestModuleAndProviderRegistries(t *testing.T) {
+	// Modules and providers are served from their own backends, prefixes and tokens
+	setGlobal(t, &authTokens, &tokenStore{static: []string{"module-token"}})
+	setGlobal(t, &providerTokens, &tokenStore{static: []string{"provider-token"}})
+	setGlobal(t, &providerPrefix, "releases")
+	modules := testLayout(t)
+	for key := range modules {
+		if strings.HasPrefix(key, ProvidersDir+"/") {
+			delete(modules, key)
+		}
+	}
+	h := newTestRegistry(t, modules)
+	setGlobal(t, &providerfsys, fs.FS(testProviderRelease("releases/")))
+	moduleAuth := []string{"Authorization", "Bearer module-token"}
+	providerAuth := []string{"Authorization", "Bearer provider-token"}
+
+	w := serve(h, http.MethodGet, "/.well-known/terraform.json", nil)
+	var discovery ServiceDiscoveryResp
+	if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if discovery.ModulesV1 == "" || discovery.ProvidersV1 == "" {
+		t.Fatalf("discovery %s doesn't advertise both protocols", w.Body)
+	}
+
+	// Modules
+	w = serve(h, http.MethodGet, discovery.ModulesV1+"acme/vpc/aws/versions", nil, moduleAuth...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("module versions status %d, want 200: %s", w.Code, w.Body)
+	}
+	w = serve(h, http.MethodGet, discovery.ModulesV1+"acme/vpc/aws/1.0.0/download", nil, moduleAuth...)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("module download url status %d, want 204: %s", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodGet, w.Header().Get("X-Terraform-Get"), nil, moduleAuth...); w.Code != http.StatusOK {
+		t.Fatalf("module download status %d, want 200", w.Code)
+	}
+
+	// Providers
+	w = serve(h, http.MethodGet, discovery.ProvidersV1+"acme/foo/versions", nil, providerAuth...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("provider versions status %d, want 200: %s", w.Code, w.Body)
+	}
+	if want := `{"versions":[{"version":"1.0.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"}]}]}` + "\n"; w.Body.String() != want {
+		t.Errorf("provider versions %s, want %s", w.Body, want)
+	}
+	w = serve(h, http.MethodGet, discovery.ProvidersV1+"acme/foo/1.0.0/download/linux/amd64", nil, providerAuth...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("provider package status %d, want 200: %s", w.Code, w.Body)
+	}
+	var pkg ProviderPackageResp
+	if err := json.Unmarshal(w.Body.Bytes(), &pkg); err != nil {
+		t.Fatal(err)
+	}
+	if pkg.SHASum != "5d41402abc4b2a76b9719d911017c592ae76c9e4c6b5a1e0c6d7a2b6f0e1d2c3" || len(pkg.SigningKeys.GPGPublicKeys) != 1 {
+		t.Errorf("provider package %s", w.Body)
+	}
+	for _, u := range []string{pkg.DownloadURL, pkg.SHASumsURL, pkg.SHASumsSignatureURL} {
+		if w := serve(h, http.MethodGet, u, nil, providerAuth...); w.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d, want 200", u, w.Code)
+		}
+	}
+
+	// Each protocol only accepts its own tokens
+	if w := serve(h, http.MethodGet, discovery.ModulesV1+"acme/vpc/aws/versions", nil, providerAuth...); w.Code != http.StatusForbidden {
+		t.Errorf("module versions with the provider token: status %d, want 403", w.Code)
+	}
+	if w := serve(h, http.MethodGet, discovery.ProvidersV1+"acme/foo/versions", nil, moduleAuth...); w.Code != http.StatusForbidden {
+		t.Errorf("provider versions with the module token: status %d, want 403", w.Code)
+	}
+}
+
+func TestProviderFile(t *testing.T) {
+	h := newTestRegistry(t, testProviderRelease(""))
+	const files = "/providers/download/acme/foo/1.0.0/"
+	w := serve(h, http.MethodGet, files+"linux_amd64/terraform-provider-foo_1.0.0_linux_amd64.zip", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "zip" {
+		t.Fatalf("package: status %d, body %q, want 200 and the package", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/zip" {
+		t.Errorf("package Content-Type %q, want application/zip", got)
+	}
+	if w := serve(h, http.MethodGet, files+"terraform-provider-foo_1.0.0_SHA256SUMS", nil); w.Code != http.StatusOK {
+		t.Errorf("checksums: status %d, want 200", w.Code)
+	}
+
+	// Directories aren't files, they're never listed
+	for _, p := range []string{files + "linux_amd64", files + "missing.zip"} {
+		w := serve(h, http.MethodGet, p, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "terraform-provider-foo") {
+			t.Errorf("GET %s: the directory was listed: %s", p, w.Body)
+		}
+	}
+
+	if w := serve(h, http.MethodGet, files+"linux_amd64/", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("directory path: status %d, want 400", w.Code)
+	}
+
+	setGlobal(t, &providerfsys, fs.FS(failingFS{errors.New("backend unreachable")}))
+	if w := serve(h, http.MethodGet, files+"terraform-provider-foo_1.0.0_SHA256SUMS", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("failing backend: status %d, want 500", w.Code)
+	}
+}
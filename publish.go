@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/hashicorp/go-version"
+)
+
+// maxPublishBody is the largest module archive accepted for publishing
+const maxPublishBody = 64 << 20
+
+// WritableBackend is implemented by backends modules can be published to
+type WritableBackend interface {
+	// Put writes the object at key, replacing it if it exists
+	Put(key string, r io.Reader) error
+}
+
+// PublishResp is our module publish response struct
+type PublishResp struct {
+	Source   string `json:"source"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+	// Owners are the owners from the archive's metadata object
+	Owners []string `json:"owners,omitempty"`
+}
+
+// validateArchive checks that b is a gzipped tarball terraform can unpack,
+// returning the metadata object at its root if it has one
+func validateArchive(b []byte) ([]byte, error) {
+	files, err := readTarFiles(bytes.NewReader(b), func(name string) bool { return name == MetadataFile })
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := files[MetadataFile]
+	if ok && !json.Valid(metadata) {
+		return nil, fmt.Errorf("%s is not valid json", MetadataFile)
+	}
+	return metadata, nil
+}
+
+// httpPutModule is a http handler publishing the gzipped tarball in the request body as a module version,
+// written to the version's archive path along with its checksum file. A metadata.json at the root of the archive
+// is written alongside as the version's metadata object, and with -require-owners it must list the module's owners.
+// An existing version is only replaced with the overwrite=true param. Backends that can't be written to respond with a 501
+func httpPutModule(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+		Provider:  chi.URLParam(r, "provider"),
+		Version:   chi.URLParam(r, "version"),
+	}
+	if moduleWriter == nil {
+		renderError(w, r, http.StatusNotImplemented, errors.New("the backend is read-only, modules can't be published to it"))
+		return
+	}
+	if _, err := version.NewSemver(m.Version); err != nil {
+		renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid version %q, must be semver", m.Version))
+		return
+	}
+	key := archivePath(r.Context(), m)
+	// Any archive in the version directory is an existing version, whatever its name or format,
+	// e.g. one uploaded out-of-band or under a different -archive-name
+	if r.URL.Query().Get("overwrite") != "true" {
+		versionPath := path.Dir(key)
+		entries, err := fs.ReadDir(moduleFS(r.Context()), versionPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logBackendAccess(r.Context(), slog.LevelError, "failed to list module version", m, versionPath, slog.Any("error", err))
+			renderError(w, r, 500, err)
+			return
+		}
+		for _, e := range entries {
+			if !e.IsDir() && (e.Name() == path.Base(key) || isArchive(e.Name())) {
+				renderError(w, r, http.StatusConflict, fmt.Errorf("module version already exists as %s, set overwrite=true to replace it", e.Name()))
+				return
+			}
+		}
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPublishBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			renderError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("module archives are limited to %d bytes", maxPublishBody))
+			return
+		}
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	metadata, err := validateArchive(b)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid module archive, expected a gzipped tarball: %s", err))
+		return
+	}
+	if requireOwners {
+		if err := checkOwners(metadata); err != nil {
+			renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	var owners []string
+	if metadata != nil {
+		if owners, err = metadataOwners(metadata); err != nil {
+			renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	sum := sha256.Sum256(b)
+	checksum := hex.EncodeToString(sum[:])
+	// The archive is written first, so a version never has a checksum file without its archive
+	if err := moduleWriter.Put(key, bytes.NewReader(b)); err != nil {
+		if errors.Is(err, errMaintenance) {
+			renderMaintenance(w, r)
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to publish module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	sumLine := fmt.Sprintf("%s  %s\n", checksum, path.Base(key))
+	if err := moduleWriter.Put(key+ChecksumExt, bytes.NewReader([]byte(sumLine))); err != nil {
+		if errors.Is(err, errMaintenance) {
+			renderMaintenance(w, r)
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to publish module checksum", m, key+ChecksumExt, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	if metadata != nil {
+		metaKey := path.Join(path.Dir(key), MetadataFile)
+		if err := moduleWriter.Put(metaKey, bytes.NewReader(metadata)); err != nil {
+			if errors.Is(err, errMaintenance) {
+				renderMaintenance(w, r)
+				return
+			}
+			logBackendAccess(r.Context(), slog.LevelError, "failed to publish module metadata", m, metaKey, slog.Any("error", err))
+			renderError(w, r, 500, err)
+			return
+		}
+	}
+	// The new version is listed right away rather than once cached listings expire
+	flushListings(listingsOf(backendKey(r.Context(), m.Namespace, m.Name, m.Provider)))
+	logBackendAccess(r.Context(), slog.LevelInfo, "published module version", m, key, slog.Int("bytes", len(b)))
+	webhooks.send(WebhookEvent{
+		Event:     EventPublish,
+		Namespace: m.Namespace,
+		Name:      m.Name,
+		Provider:  m.Provider,
+		Version:   m.Version,
+		Checksum:  checksum,
+		Time:      time.Now().UTC(),
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PublishResp{
+		Source:   m.Namespace + "/" + m.Name + "/" + m.Provider,
+		Version:  m.Version,
+		Checksum: checksum,
+		Owners:   owners,
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// mapWriter publishes to a MapFS, so published versions are served by the registry reading it
+type mapWriter struct {
+	mu   sync.Mutex
+	fsys fstest.MapFS
+}
+
+func (m *mapWriter) Put(key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fsys[key] = testFile(b)
+	return nil
+}
+
+// newPublishRegistry serves fsys with publishing enabled to it, authenticated with the admin token "admin"
+func newPublishRegistry(t *testing.T, fsys fstest.MapFS) http.Handler {
+	t.Helper()
+	setGlobal(t, &publishModules, true)
+	setGlobal(t, &enableCatalog, true)
+	setGlobal(t, &adminToken, "admin")
+	setGlobal(t, &moduleWriter, WritableBackend(maintenanceWriter{&mapWriter{fsys: fsys}}))
+	return newTestRegistry(t, fsys)
+}
+
+func TestPublishOwners(t *testing.T) {
+	setGlobal(t, &requireOwners, true)
+	fsys := testLayout(t)
+	h := newPublishRegistry(t, fsys)
+
+	cases := []struct {
+		name     string
+		metadata string
+		want     int
+	}{
+		{"without metadata", "", http.StatusBadRequest},
+		{"without owners", `{"description":"vpc"}`, http.StatusBadRequest},
+		{"empty owners", `{"owners":[]}`, http.StatusBadRequest},
+		{"invalid owner", `{"owners":["platform team"]}`, http.StatusBadRequest},
+		{"with owners", `{"owners":["ops@example.com","@acme/platform"]}`, http.StatusCreated},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			files := map[string]string{"main.tf": ""}
+			if c.metadata != "" {
+				files[MetadataFile] = c.metadata
+			}
+			w := serve(h, http.MethodPut, "/terraform/modules/v1/acme/vpc/aws/3.0.0", bytes.NewReader(testTarball(t, files)), "Authorization", "Bearer admin")
+			if w.Code != c.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.want, w.Body)
+			}
+			if c.want != http.StatusCreated {
+				if _, ok := fsys["acme/vpc/aws/3.0.0/vpc.tgz"]; ok {
+					t.Error("rejected archive was written")
+				}
+				return
+			}
+			var resp PublishResp
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"ops@example.com", "@acme/platform"}
+			if !reflect.DeepEqual(resp.Owners, want) {
+				t.Errorf("published owners %v, want %v", resp.Owners, want)
+			}
+
+			// The owners are served with the rest of the version's metadata
+			w = serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/3.0.0", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("details status %d, want 200: %s", w.Code, w.Body)
+			}
+			var details ModuleDetailsResp
+			if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+				t.Fatal(err)
+			}
+			owners, err := metadataOwners(details.Metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(owners, want) {
+				t.Errorf("details owners %v, want %v", owners, want)
+			}
+		})
+	}
+}
+
+func TestPublishWithoutRequiredOwners(t *testing.T) {
+	fsys := testLayout(t)
+	h := newPublishRegistry(t, fsys)
+	w := serve(h, http.MethodPut, "/terraform/modules/v1/acme/vpc/aws/3.0.0", bytes.NewReader(testTarball(t, map[string]string{"main.tf": ""})), "Authorization", "Bearer admin")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d, want 201 without -require-owners: %s", w.Code, w.Body)
+	}
+	if _, ok := fsys["acme/vpc/aws/3.0.0/vpc.tgz"]; !ok {
+		t.Error("archive wasn't written")
+	}
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions", nil); !bytes.Contains(w.Body.Bytes(), []byte(`"3.0.0"`)) {
+		t.Errorf("published version isn't listed: %s", w.Body)
+	}
+}
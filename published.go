@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// addPublishedTimes is a helper function to fill in when every version in a versions response was published,
+// from the modification time of its archive. Backends like s3 have no directory times, so the archive is stated rather
+// than the version directory. A version whose archive can't be stated is still listed, just without its time,
+// the listing only fails when ctx is done before every archive was stated
+func addPublishedTimes(ctx context.Context, m Module, modVers ModuleVersionsResp) error {
+	// Redirected modules' archives live elsewhere
+	if _, ok := redirectFor(m); ok {
+		return nil
+	}
+	for _, mod := range modVers.Modules {
+		times, err := fanOut(ctx, mod.Versions, listConcurrency, func(v ModuleVersion) string {
+			mv := m
+			mv.Version = v.Version
+			file, err := resolveArchive(ctx, mv, archiveName(mv))
+			key := backendKey(ctx, mv.Namespace, mv.Name, mv.Provider, mv.Version, file)
+			var fi fs.FileInfo
+			if err == nil {
+				fi, err = fs.Stat(moduleFS(ctx), key)
+			}
+			if err != nil {
+				logBackendAccess(ctx, slog.LevelWarn, "failed to stat module archive for its published time", mv, key, slog.Any("error", err))
+				return ""
+			}
+			return fi.ModTime().UTC().Format(time.RFC3339)
+		})
+		if err != nil {
+			return err
+		}
+		for i := range mod.Versions {
+			mod.Versions[i].PublishedAt = times[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimitSweep is how often the buckets of clients that have gone quiet are forgotten
+const rateLimitSweep = time.Minute
+
+// rateLimiter is a token bucket rate limiter per client ip, each client's bucket holds up to burst requests
+// and refills at rate requests per second
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is a client's bucket, tokens is its fill as of last
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing each client perMinute requests a minute, in bursts of up to burst
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from ip's bucket, when it's empty the request isn't allowed
+// and wait is how long until the bucket holds a token again
+func (l *rateLimiter) allow(ip string, now time.Time) (ok bool, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > rateLimitSweep {
+		// Forgetting a full bucket is the same as keeping it, so only buckets that have refilled are dropped
+		for k, b := range l.buckets {
+			if l.fill(b, now) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, found := l.buckets[ip]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens, b.last = l.fill(b, now), now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// fill returns how many tokens b holds at now
+func (l *rateLimiter) fill(b *tokenBucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// rateLimit is a middleware limiting how many requests each client ip may make,
+// requests over the limit get a 429 with a Retry-After of when the client may try again
+func rateLimit(l *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := l.allow(clientIP(r), time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+				renderError(w, r, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// parseRedirects parses the -redirects flag, a comma separated list of <namespace>/<name>/<provider>=<url template> entries.
+// Downloads of a listed module are redirected to the rendered url rather than served from the backend,
+// the template is executed against the module version like -archive-name
+func parseRedirects(s string) (map[string]*template.Template, error) {
+	redirects := map[string]*template.Template{}
+	sample := Module{Namespace: "namespace", Name: "name", Provider: "provider", Version: "1.0.0"}
+	for _, r := range splitList(s) {
+		mod, tmpl, ok := strings.Cut(r, "=")
+		if !ok || strings.Count(mod, "/") != 2 || strings.Contains(mod, "//") || strings.HasPrefix(mod, "/") || strings.HasSuffix(mod, "/") {
+			return nil, fmt.Errorf("invalid redirect %q, expected <namespace>/<name>/<provider>=<url template>", r)
+		}
+		t, err := template.New("redirect-" + mod).Option("missingkey=error").Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect template for %s: %w", mod, err)
+		}
+		// Make sure the template renders an absolute url terraform can download from
+		var b strings.Builder
+		if err := t.Execute(&b, sample); err != nil {
+			return nil, fmt.Errorf("invalid redirect template for %s: %w", mod, err)
+		}
+		if err := validRedirectURL(b.String()); err != nil {
+			return nil, fmt.Errorf("invalid redirect template for %s: %w", mod, err)
+		}
+		redirects[mod] = t
+	}
+	return redirects, nil
+}
+
+// validRedirectURL checks that u is an absolute http(s) url
+func validRedirectURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) url", u)
+	}
+	return nil
+}
+
+// redirectFor returns the external url downloads of a module version are redirected to, ok is false if it has none
+func redirectFor(m Module) (target string, ok bool) {
+	t, ok := moduleRedirects[m.Namespace+"/"+m.Name+"/"+m.Provider]
+	if !ok {
+		return "", false
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, m); err != nil || validRedirectURL(b.String()) != nil {
+		// Templates are validated at startup, so this only guards against a version rendering an invalid url
+		return "", false
+	}
+	return b.String(), true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseRedirects(t *testing.T) {
+	if _, err := parseRedirects("acme/vpc/aws=https://mirror.example.com/{{.Namespace}}/{{.Name}}/{{.Version}}.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{
+		"acme/vpc=https://mirror.example.com/vpc.tgz",
+		"acme//aws=https://mirror.example.com/vpc.tgz",
+		"acme/vpc/aws",
+		"acme/vpc/aws=/vpc.tgz",
+		"acme/vpc/aws=ftp://mirror.example.com/vpc.tgz",
+		"acme/vpc/aws=https:///vpc.tgz",
+		"acme/vpc/aws=https://mirror.example.com/{{.Missing}}.tgz",
+		"acme/vpc/aws=https://mirror.example.com/{{.Version",
+	} {
+		if _, err := parseRedirects(bad); err == nil {
+			t.Errorf("parseRedirects(%q) accepted an invalid redirect", bad)
+		}
+	}
+}
+
+func TestRedirectedDownloads(t *testing.T) {
+	redirects, err := parseRedirects("acme/vpc/aws=https://mirror.example.com/{{.Namespace}}/{{.Name}}/{{.Provider}}/{{.Version}}.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &moduleRedirects, redirects)
+	h := newTestRegistry(t, testLayout(t))
+
+	// Terraform follows X-Terraform-Get to the registry's download path, which redirects it to the mirror
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/1.2.0/download", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("download url status %d, want 204: %s", w.Code, w.Body)
+	}
+	w = serve(h, http.MethodGet, w.Header().Get("X-Terraform-Get"), nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("redirected download status %d, want 302", w.Code)
+	}
+	if got, want := w.Header().Get("Location"), "https://mirror.example.com/acme/vpc/aws/1.2.0.tgz"; got != want {
+		t.Errorf("Location %q, want %q", got, want)
+	}
+
+	// Other modules are still served from the backend
+	w = serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/google/0.1.0/download", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("download url status %d, want 204: %s", w.Code, w.Body)
+	}
+	w = serve(h, http.MethodGet, w.Header().Get("X-Terraform-Get"), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download status %d, want 200", w.Code)
+	}
+	if w.Header().Get("Location") != "" {
+		t.Error("module without a redirect was redirected")
+	}
+}
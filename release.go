@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// MetadataFile is the optional metadata object published alongside a module version's tarball
+const MetadataFile = "metadata.json"
+
+// ModuleReleaseResp is our release notes response struct, pieces missing from a version are null
+type ModuleReleaseResp struct {
+	Version   string          `json:"version"`
+	Changelog *string         `json:"changelog"`
+	Summary   *string         `json:"summary"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// releaseCache caches assembled release notes by archive path and ETag, bounded like dependencyCache
+var releaseCache = &lruCache[ModuleReleaseResp]{name: "releases"}
+
+// readmeSummary returns the first paragraph of prose in a README, skipping headings, badges and html
+func readmeSummary(readme string) string {
+	for _, para := range strings.Split(strings.ReplaceAll(readme, "\r\n", "\n"), "\n\n") {
+		var lines []string
+		for _, line := range strings.Split(para, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[![") || strings.HasPrefix(line, "<") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) > 0 {
+			return strings.Join(lines, " ")
+		}
+	}
+	return ""
+}
+
+// moduleRelease assembles the release notes of a module version from its tarball and metadata object
+func moduleRelease(ctx context.Context, m Module, key string) (ModuleReleaseResp, error) {
+	rel := ModuleReleaseResp{Version: m.Version, Metadata: json.RawMessage("null")}
+	files, err := readArchiveFiles(moduleFS(ctx), key, func(name string) bool {
+		return strings.EqualFold(name, "CHANGELOG.md") || strings.EqualFold(name, "README.md")
+	})
+	if err != nil {
+		return rel, err
+	}
+	for name, b := range files {
+		s := string(b)
+		if strings.EqualFold(name, "CHANGELOG.md") {
+			rel.Changelog = &s
+		} else if summary := readmeSummary(s); summary != "" {
+			rel.Summary = &summary
+		}
+	}
+	b, err := fs.ReadFile(moduleFS(ctx), path.Join(path.Dir(key), MetadataFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return rel, err
+	}
+	if err == nil {
+		if !json.Valid(b) {
+			return rel, fmt.Errorf("%s is not valid json", MetadataFile)
+		}
+		rel.Metadata = b
+	}
+	return rel, nil
+}
+
+// httpGetRelease is a http handler for retrieving the release notes of a module version in a single response,
+// combining its changelog, a summary of its readme and its metadata object
+func httpGetRelease(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+		Provider:  chi.URLParam(r, "provider"),
+		Version:   chi.URLParam(r, "version"),
+	}
+	key := resolvedArchivePath(r.Context(), m)
+	fi, err := fs.Stat(moduleFS(r.Context()), key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module version not found"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to stat module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	// The response changes whenever either the tarball or the metadata object does, so the ETag covers both
+	etag := fileETag(fi)
+	if mfi, err := fs.Stat(moduleFS(r.Context()), path.Join(path.Dir(key), MetadataFile)); err == nil {
+		etag = strings.TrimSuffix(etag, `"`) + "-" + strings.Trim(fileETag(mfi), `"`) + `"`
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	cacheKey := key + "@" + etag
+	rel, ok := releaseCache.get(cacheKey)
+	if !ok {
+		if rel, err = moduleRelease(r.Context(), m, key); err != nil {
+			logBackendAccess(r.Context(), slog.LevelError, "failed to assemble release notes", m, key, slog.Any("error", err))
+			renderError(w, r, 500, err)
+			return
+		}
+		releaseCache.put(cacheKey, rel)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReleaseNotes(t *testing.T) {
+	setGlobal(t, &enableCatalog, true)
+	setGlobal(t, &releaseCache, &lruCache[ModuleReleaseResp]{name: "releases", max: 16})
+	fsys := testLayout(t)
+	fsys["acme/vpc/aws/2.0.0/vpc.tgz"] = testFile(testTarball(t, map[string]string{
+		"CHANGELOG.md": "# 2.0.0\n- breaking change\n",
+		"README.md":    "# vpc\n\n[![ci](https://ci.example.com/badge.svg)](https://ci.example.com)\n\nCreates a VPC\nwith subnets.\n\n## Usage\n",
+		"main.tf":      "",
+	}))
+	fsys["acme/vpc/aws/2.0.0/"+MetadataFile] = testFile([]byte(`{"owners":["@acme/platform"]}`))
+	h := newTestRegistry(t, fsys)
+
+	for _, c := range []struct {
+		name, version, want string
+	}{
+		{"complete", "2.0.0", `{"version":"2.0.0","changelog":"# 2.0.0\n- breaking change\n","summary":"Creates a VPC with subnets.","metadata":{"owners":["@acme/platform"]}}`},
+		{"partial", "1.0.0", `{"version":"1.0.0","changelog":null,"summary":null,"metadata":null}`},
+	} {
+		w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/"+c.version+"/release", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200: %s", c.name, w.Code, w.Body)
+		}
+		if got := w.Body.String(); got != c.want+"\n" {
+			t.Errorf("%s: body\n%s\nwant\n%s", c.name, got, c.want)
+		}
+		if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/"+c.version+"/release", nil, "If-None-Match", w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+			t.Errorf("%s: conditional status %d, want 304", c.name, w.Code)
+		}
+	}
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/9.9.9/release", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing version: status %d, want 404", w.Code)
+	}
+
+	// Editing the metadata object changes the release's ETag, even though the tarball is unchanged
+	w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/2.0.0/release", nil)
+	before := w.Header().Get("ETag")
+	meta := testFile([]byte(`{"owners":["ops@example.com"]}`))
+	meta.ModTime = meta.ModTime.Add(1)
+	fsys["acme/vpc/aws/2.0.0/"+MetadataFile] = meta
+	w = serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/2.0.0/release", nil, "If-None-Match", before)
+	if w.Code != http.StatusOK {
+		t.Fatalf("after a metadata edit: status %d, want 200", w.Code)
+	}
+	if want := `"metadata":{"owners":["ops@example.com"]}`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("after a metadata edit: body %s, want %s", w.Body, want)
+	}
+}
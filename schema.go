@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// ModuleSchemaResp is our module inputs/outputs schema response struct
+type ModuleSchemaResp struct {
+	Inputs  []ModuleInput  `json:"inputs"`
+	Outputs []ModuleOutput `json:"outputs"`
+}
+
+// ModuleInput describes a module's input variable
+type ModuleInput struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type,omitempty"`
+	Default     json.RawMessage `json:"default"`
+	Description string          `json:"description,omitempty"`
+	Required    bool            `json:"required"`
+}
+
+// ModuleOutput describes a module's output value
+type ModuleOutput struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Sensitive   bool   `json:"sensitive,omitempty"`
+}
+
+// isRootTFFile reports whether a tarball entry is a terraform configuration file in the module's root directory
+func isRootTFFile(name string) bool {
+	return !strings.Contains(name, "/") && strings.HasSuffix(name, ".tf")
+}
+
+// forEachBlock is a helper function to parse terraform configuration files,
+// calling fn with every single label top level block (variable, output, module etc.) and the source of its file
+func forEachBlock(files map[string][]byte, fn func(block *hclsyntax.Block, src []byte)) error {
+	for name, src := range files {
+		f, diags := hclsyntax.ParseConfig(src, name, hcl.InitialPos)
+		if diags.HasErrors() {
+			return diags
+		}
+		body, ok := f.Body.(*hclsyntax.Body)
+		if !ok {
+			return fmt.Errorf("%s: unexpected body type", name)
+		}
+		for _, block := range body.Blocks {
+			if len(block.Labels) == 1 {
+				fn(block, src)
+			}
+		}
+	}
+	return nil
+}
+
+// parseModuleSchema is a helper function to extract the variables and outputs declared in a module's .tf files
+func parseModuleSchema(files map[string][]byte) (ModuleSchemaResp, error) {
+	schema := ModuleSchemaResp{Inputs: []ModuleInput{}, Outputs: []ModuleOutput{}}
+	err := forEachBlock(files, func(block *hclsyntax.Block, src []byte) {
+		attrs := block.Body.Attributes
+		switch block.Type {
+		case "variable":
+			in := ModuleInput{
+				Name:        block.Labels[0],
+				Description: stringAttr(attrs["description"]),
+				Default:     json.RawMessage("null"),
+				Required:    attrs["default"] == nil,
+			}
+			if t := attrs["type"]; t != nil {
+				// Types are expressions such as list(string), so they're reported as written
+				in.Type = string(t.Expr.Range().SliceBytes(src))
+			}
+			if d := attrs["default"]; d != nil {
+				in.Default = literalJSON(d, src)
+			}
+			schema.Inputs = append(schema.Inputs, in)
+		case "output":
+			schema.Outputs = append(schema.Outputs, ModuleOutput{
+				Name:        block.Labels[0],
+				Description: stringAttr(attrs["description"]),
+				Sensitive:   boolAttr(attrs["sensitive"]),
+			})
+		}
+	})
+	if err != nil {
+		return ModuleSchemaResp{}, err
+	}
+	sort.Slice(schema.Inputs, func(i, j int) bool { return schema.Inputs[i].Name < schema.Inputs[j].Name })
+	sort.Slice(schema.Outputs, func(i, j int) bool { return schema.Outputs[i].Name < schema.Outputs[j].Name })
+	return schema, nil
+}
+
+// stringAttr returns the value of a literal string attribute, or an empty string if the attribute isn't one
+func stringAttr(attr *hclsyntax.Attribute) string {
+	v, ok := literalValue(attr)
+	if !ok || v.Type() != cty.String {
+		return ""
+	}
+	return v.AsString()
+}
+
+// boolAttr returns the value of a literal bool attribute, or false if the attribute isn't one
+func boolAttr(attr *hclsyntax.Attribute) bool {
+	v, ok := literalValue(attr)
+	return ok && v.Type() == cty.Bool && v.True()
+}
+
+// literalValue evaluates an attribute without any terraform context, ok is false if that's not possible
+func literalValue(attr *hclsyntax.Attribute) (cty.Value, bool) {
+	if attr == nil {
+		return cty.NilVal, false
+	}
+	v, diags := attr.Expr.Value(nil)
+	if diags.HasErrors() || !v.IsWhollyKnown() || v.IsNull() {
+		return cty.NilVal, false
+	}
+	return v, true
+}
+
+// literalJSON returns an attribute's value as JSON, falling back to its source text
+// for expressions that can't be evaluated without a terraform context
+func literalJSON(attr *hclsyntax.Attribute, src []byte) json.RawMessage {
+	if v, ok := literalValue(attr); ok {
+		if b, err := json.Marshal(ctyjson.SimpleJSONValue{Value: v}); err == nil {
+			return b
+		}
+	}
+	b, _ := json.Marshal(string(attr.Expr.Range().SliceBytes(src)))
+	return b
+}
+
+// httpGetSchema is a http handler for retrieving the inputs and outputs of a module version,
+// parsed from the .tf files in the root of the version's tarball
+func httpGetSchema(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+		Provider:  chi.URLParam(r, "provider"),
+		Version:   chi.URLParam(r, "version"),
+	}
+	key, ok := statArchive(w, r, m)
+	if !ok {
+		return
+	}
+	files, err := readArchiveFiles(moduleFS(r.Context()), key, isRootTFFile)
+	if err != nil {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to read module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	schema, err := parseModuleSchema(files)
+	if err != nil {
+		logBackendAccess(r.Context(), slog.LevelWarn, "failed to parse module configuration", m, key, slog.Any("error", err))
+		renderError(w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schema)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	setGlobal(t, &enableCatalog, true)
+	fsys := testLayout(t)
+	fsys["acme/vpc/aws/2.0.0/vpc.tgz"] = testFile(testTarball(t, map[string]string{
+		"variables.tf": `
+variable "cidr" {
+  type        = string
+  description = "CIDR block of the VPC"
+}
+
+variable "azs" {
+  type    = list(string)
+  default = ["a", "b"]
+}
+
+variable "tags" {
+  default = { Name = "vpc-${var.cidr}" }
+}
+`,
+		"outputs.tf": `
+output "vpc_id" {
+  value       = aws_vpc.this.id
+  description = "ID of the VPC"
+}
+
+output "secret" {
+  value     = "s"
+  sensitive = true
+}
+`,
+		// Only the root module is described, not its nested modules or other files
+		"modules/subnet/main.tf": `variable "nested" {}`,
+		"README.md":              `variable "readme" {}`,
+	}))
+	h := newTestRegistry(t, fsys)
+	const schema = "/terraform/modules/v1/acme/vpc/aws/2.0.0/schema"
+
+	w := serve(h, http.MethodGet, schema, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	want := `{"inputs":[` +
+		`{"name":"azs","type":"list(string)","default":["a","b"],"required":false},` +
+		`{"name":"cidr","type":"string","default":null,"description":"CIDR block of the VPC","required":true},` +
+		`{"name":"tags","default":"{ Name = \"vpc-${var.cidr}\" }","required":false}` +
+		`],"outputs":[` +
+		`{"name":"secret","sensitive":true},` +
+		`{"name":"vpc_id","description":"ID of the VPC"}` +
+		`]}` + "\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("body\n%s\nwant\n%s", got, want)
+	}
+
+	// The schema can only change with the tarball, so its ETag is the tarball's
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	if w := serve(h, http.MethodGet, schema, nil, "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("conditional status %d, want 304", w.Code)
+	}
+
+	// A module without any variables or outputs has empty lists rather than nulls
+	w = serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/1.0.0/schema", nil)
+	if got, want := w.Body.String(), `{"inputs":[{"name":"cidr","default":null,"required":true}],"outputs":[]}`+"\n"; got != want {
+		t.Errorf("body %s, want %s", got, want)
+	}
+
+	fsys["acme/vpc/aws/3.0.0/vpc.tgz"] = testFile(testTarball(t, map[string]string{"main.tf": `variable "broken" {`}))
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/3.0.0/schema", nil); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid configuration: status %d, want 422", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/9.9.9/schema", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing version: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultSearchLimit is the number of modules in a search response without a limit param, as on the public registry
+	defaultSearchLimit = 15
+	// maxSearchLimit bounds the number of modules in a search response
+	maxSearchLimit = 100
+)
+
+// SearchMeta is the pagination metadata of a module search, in the registry protocol's format.
+// The next and prev fields are omitted on the last and first page
+type SearchMeta struct {
+	Limit         int    `json:"limit"`
+	CurrentOffset int    `json:"current_offset"`
+	NextOffset    *int   `json:"next_offset,omitempty"`
+	PrevOffset    *int   `json:"prev_offset,omitempty"`
+	NextURL       string `json:"next_url,omitempty"`
+	PrevURL       string `json:"prev_url,omitempty"`
+}
+
+// SearchModule is a module matching a search, at its latest version
+type SearchModule struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+	Version   string `json:"version"`
+}
+
+// ModuleSearchResp is our module search response struct
+type ModuleSearchResp struct {
+	Meta    SearchMeta     `json:"meta"`
+	Modules []SearchModule `json:"modules"`
+}
+
+// allModules returns every module in the backend, from the module index when it's maintained,
+// otherwise by walking the registry behind the listing cache
+func allModules(ctx context.Context) ([]Module, error) {
+	if maxSuggestions > 0 && !isTenantRequest(ctx) {
+		return modIndex.Modules(), nil
+	}
+	return modulesCache.get(ctx, backendKey(ctx), func(ctx context.Context) ([]Module, error) {
+		return walkModules(moduleFS(ctx), requestPrefix(ctx), walkConcurrency, &listPacer{delay: indexDelay})
+	})
+}
+
+// listedVersion is the version a module is listed at, its latest version or its greatest pre-release
+// when it only has pre-releases. It's empty when the module's versions can't be listed, which doesn't fail the listing
+func listedVersion(ctx context.Context, m Module) string {
+	modVers, err := moduleVersions(ctx, m)
+	if err != nil {
+		return ""
+	}
+	versions := modVers.Modules[0].Versions
+	if latest := latestVersion(versions); latest != "" || len(versions) == 0 {
+		return latest
+	}
+	return versions[len(versions)-1].Version
+}
+
+// parseSearchPage parses the limit and offset query params of a module search
+func parseSearchPage(q url.Values) (limit int, offset int, err error) {
+	limit = defaultSearchLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxSearchLimit {
+			return 0, 0, fmt.Errorf("invalid limit %q, must be between 1 and %d", v, maxSearchLimit)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q, must be a non-negative integer", v)
+		}
+	}
+	return limit, offset, nil
+}
+
+// httpGetModuleSearch is a http handler for searching modules by a term (the q param) contained in their namespace or name,
+// optionally filtered by exact namespace and provider params. Matches are sorted by namespace, name and provider
+func httpGetModuleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	term := strings.ToLower(q.Get("q"))
+	limit, offset, err := parseSearchPage(q)
+	if err == nil && term == "" {
+		err = errors.New("missing search term, set the q param")
+	}
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	mods, err := allModules(r.Context())
+	if err != nil {
+		logKeyAccess(r.Context(), slog.LevelError, "failed to list modules", backendKey(r.Context()), []slog.Attr{slog.Any("error", err)})
+		renderError(w, r, 500, err)
+		return
+	}
+	var matches []Module
+	for _, m := range mods {
+		if ns := q.Get("namespace"); ns != "" && ns != m.Namespace {
+			continue
+		}
+		if p := q.Get("provider"); p != "" && p != m.Provider {
+			continue
+		}
+		if strings.Contains(strings.ToLower(m.Namespace), term) || strings.Contains(strings.ToLower(m.Name), term) {
+			matches = append(matches, m)
+		}
+	}
+
+	start := min(offset, len(matches))
+	end := min(start+limit, len(matches))
+	resp := ModuleSearchResp{
+		Meta:    SearchMeta{Limit: limit, CurrentOffset: offset},
+		Modules: make([]SearchModule, 0, end-start),
+	}
+	// Only the page's modules are resolved to a version
+	versions, err := fanOut(r.Context(), matches[start:end], listConcurrency, func(m Module) string { return listedVersion(r.Context(), m) })
+	if err != nil {
+		// The client went away, there's no one left to respond to
+		return
+	}
+	for i, m := range matches[start:end] {
+		sm := SearchModule{Namespace: m.Namespace, Name: m.Name, Provider: m.Provider, Version: versions[i]}
+		sm.ID = strings.Join([]string{m.Namespace, m.Name, m.Provider, sm.Version}, "/")
+		resp.Modules = append(resp.Modules, sm)
+	}
+	pageURL := func(o int) string {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(o))
+		q.Set("limit", strconv.Itoa(limit))
+		return baseURL + tenantPath(r.Context()) + r.URL.Path + "?" + q.Encode()
+	}
+	if end < len(matches) {
+		resp.Meta.NextOffset = &end
+		resp.Meta.NextURL = pageURL(end)
+	}
+	if offset > 0 {
+		prev := max(0, min(offset, len(matches))-limit)
+		resp.Meta.PrevOffset = &prev
+		resp.Meta.PrevURL = pageURL(prev)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
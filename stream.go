@@ -0,0 +1,213 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hashicorp/go-version"
+)
+
+// versionsPageSize is how many version directories are listed from the backend at a time when streaming versions
+const versionsPageSize = 100
+
+// VersionsCursor is the cursor metadata of a streamed version listing truncated to its limit,
+// next is the after cursor of the following versions
+type VersionsCursor struct {
+	Limit int    `json:"limit"`
+	Next  string `json:"next_cursor"`
+}
+
+// httpGetVersionsStream is a http handler for retrieving the versions of a module with thousands of them.
+// Rather than building the whole response, versions are listed from the backend a page at a time keeping only
+// their parsed semver, and written out in the same format and ascending semver order as the versions endpoint.
+// The optional after query parameter is a semver cursor, only versions newer than it are returned.
+// The optional limit query parameter bounds how many versions are returned, only the oldest limit versions after
+// the cursor are kept while listing, and the last of them is returned as the next cursor when there are more
+func httpGetVersionsStream(w http.ResponseWriter, r *http.Request) {
+	m := Module{
+		Namespace: chi.URLParam(r, "namespace"),
+		Name:      chi.URLParam(r, "name"),
+		Provider:  chi.URLParam(r, "provider"),
+	}
+	var after *version.Version
+	if a := r.URL.Query().Get("after"); a != "" {
+		var err error
+		if after, err = version.NewSemver(a); err != nil {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid after cursor %q, must be semver", a))
+			return
+		}
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid limit %q, must be a positive integer", l))
+			return
+		}
+	}
+	modPath := backendKey(r.Context(), m.Namespace, m.Name, m.Provider)
+	f, err := moduleFS(r.Context()).Open(modPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module not found"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to list module versions", m, modPath, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		renderError(w, r, 500, errors.New("module path is not a directory"))
+		return
+	}
+
+	source := m.Namespace + "/" + m.Name + "/" + m.Provider
+	kept := &boundedVersions{n: limit}
+	for {
+		entries, err := dir.ReadDir(versionsPageSize)
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			sv, err := version.NewSemver(e.Name())
+			if err != nil {
+				logger.Warn("skipping module version directory that isn't valid semver", slog.String("source", source), slog.String("version", e.Name()))
+				continue
+			}
+			// The cursor is compared as semver, backends list lexicographically (10.0.0 before 2.0.0)
+			if after != nil && !sv.GreaterThan(after) {
+				continue
+			}
+			kept.push(sv)
+		}
+		if err == io.EOF || (err == nil && len(entries) == 0) {
+			break
+		}
+		if err != nil {
+			logBackendAccess(r.Context(), slog.LevelError, "failed to list module versions", m, modPath, slog.Any("error", err))
+			renderError(w, r, 500, err)
+			return
+		}
+	}
+	// Backends list lexicographically (10.0.0 before 2.0.0), terraform expects versions in ascending semver order
+	semvers := kept.sorted()
+
+	b, _ := json.Marshal(source)
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"modules":[{"source":`+string(b)+`,"versions":[`)
+	flusher, _ := w.(http.Flusher)
+	for i, sv := range semvers {
+		b, _ := json.Marshal(ModuleVersion{Version: sv.Original()})
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		w.Write(b)
+		if flusher != nil && (i+1)%versionsPageSize == 0 {
+			flusher.Flush()
+		}
+	}
+	io.WriteString(w, "]}]")
+	if kept.dropped {
+		b, _ := json.Marshal(VersionsCursor{Limit: limit, Next: semvers[len(semvers)-1].Original()})
+		io.WriteString(w, `,"meta":`+string(b))
+	}
+	io.WriteString(w, "}\n")
+	logBackendAccess(r.Context(), slog.LevelInfo, "streamed module versions", m, modPath)
+}
+
+// readVersionDirs pushes the semver version directories of the module directory modPath to kept,
+// reading the directory versionsPageSize entries at a time, and returns how many there were
+func readVersionDirs(fsys fs.FS, modPath, source string, kept *boundedVersions) (int, error) {
+	f, err := fsys.Open(modPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return 0, &fs.PathError{Op: "readdir", Path: modPath, Err: errors.New("not a directory")}
+	}
+	total := 0
+	for {
+		entries, err := dir.ReadDir(versionsPageSize)
+		for _, v := range entries {
+			// Only directories are versions, the provider directory also holds files such as SHA256SUMS
+			if !v.IsDir() {
+				continue
+			}
+			sv, err := version.NewSemver(v.Name())
+			if err != nil {
+				logger.Warn("skipping module version directory that isn't valid semver", slog.String("source", source), slog.String("version", v.Name()))
+				continue
+			}
+			kept.push(sv)
+			total++
+		}
+		if err == io.EOF || (err == nil && len(entries) == 0) {
+			return total, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// boundedVersions collects the n oldest versions pushed to it, or the n newest when its heap is rooted at the oldest,
+// holding no more than n at a time. An n of 0 keeps every version
+type boundedVersions struct {
+	n    int
+	heap versionHeap
+	// dropped is set once a version has been dropped
+	dropped bool
+}
+
+// push adds a version, dropping the heap's root if there are more than n
+func (b *boundedVersions) push(v *version.Version) {
+	heap.Push(&b.heap, v)
+	if b.n > 0 && b.heap.Len() > b.n {
+		heap.Pop(&b.heap)
+		b.dropped = true
+	}
+}
+
+// sorted returns the kept versions in ascending semver order
+func (b *boundedVersions) sorted() []*version.Version {
+	versions := b.heap.versions
+	sort.Sort(version.Collection(versions))
+	return versions
+}
+
+// versionHeap is a heap.Interface of versions rooted at the newest, or the oldest when newest is set
+type versionHeap struct {
+	versions []*version.Version
+	newest   bool
+}
+
+func (h versionHeap) Len() int      { return len(h.versions) }
+func (h versionHeap) Swap(i, j int) { h.versions[i], h.versions[j] = h.versions[j], h.versions[i] }
+
+func (h versionHeap) Less(i, j int) bool {
+	if h.newest {
+		return h.versions[i].LessThan(h.versions[j])
+	}
+	return h.versions[i].GreaterThan(h.versions[j])
+}
+
+func (h *versionHeap) Push(x any) { h.versions = append(h.versions, x.(*version.Version)) }
+
+func (h *versionHeap) Pop() any {
+	v := h.versions[len(h.versions)-1]
+	h.versions = h.versions[:len(h.versions)-1]
+	return v
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hashicorp/go-version"
+)
+
+// pagedFS is a backend recording the page sizes directories are listed with
+type pagedFS struct {
+	fstest.MapFS
+	pages *[]int
+}
+
+func (p pagedFS) Open(name string) (fs.File, error) {
+	f, err := p.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := f.(fs.ReadDirFile); ok {
+		return pagedDir{ReadDirFile: d, pages: p.pages}, nil
+	}
+	return f, nil
+}
+
+type pagedDir struct {
+	fs.ReadDirFile
+	pages *[]int
+}
+
+func (d pagedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	*d.pages = append(*d.pages, n)
+	return d.ReadDirFile.ReadDir(n)
+}
+
+// streamedVersions is a decoded streamed version listing
+type streamedVersions struct {
+	Modules []struct {
+		Source   string `json:"source"`
+		Versions []struct {
+			Version string `json:"version"`
+		} `json:"versions"`
+	} `json:"modules"`
+	Meta *VersionsCursor `json:"meta"`
+}
+
+func TestVersionsStream(t *testing.T) {
+	const n = 5000
+	names := testVersionNames(n)
+	fsys := fstest.MapFS{"acme/vpc/aws/notsemver/README.md": testFile([]byte("not a version"))}
+	for _, name := range names {
+		fsys["acme/vpc/aws/"+name+"/vpc.tgz"] = testFile([]byte("tgz"))
+	}
+	h := newTestRegistry(t, fsys)
+	var pages []int
+	setGlobal(t, &s3fsys, fs.FS(pagedFS{MapFS: fsys, pages: &pages}))
+	stream := func(query string) ([]string, *VersionsCursor) {
+		t.Helper()
+		w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions/stream"+query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200: %s", query, w.Code, w.Body)
+		}
+		var resp streamedVersions
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", query, err)
+		}
+		if len(resp.Modules) != 1 || resp.Modules[0].Source != "acme/vpc/aws" {
+			t.Fatalf("%s: modules %+v, want acme/vpc/aws", query, resp.Modules)
+		}
+		var versions []string
+		for _, v := range resp.Modules[0].Versions {
+			versions = append(versions, v.Version)
+		}
+		return versions, resp.Meta
+	}
+
+	// Semver order, unlike the backend's lexicographic listing
+	want := slices.Clone(names)
+	slices.SortFunc(want, func(a, b string) int {
+		return version.Must(version.NewSemver(a)).Compare(version.Must(version.NewSemver(b)))
+	})
+	all, meta := stream("")
+	if !slices.Equal(all, want) || meta != nil {
+		t.Fatalf("streamed %d versions with cursor %+v, want all %d in semver order", len(all), meta, n)
+	}
+	for _, p := range pages {
+		if p != versionsPageSize {
+			t.Fatalf("listed pages of %v, want pages of %d", pages, versionsPageSize)
+		}
+	}
+	if len(pages) < n/versionsPageSize {
+		t.Errorf("listed %d pages, want the directory listed a page at a time", len(pages))
+	}
+
+	// Following the cursor returns every version once, limit at a time
+	var walked []string
+	cursor := ""
+	for i := 0; ; i++ {
+		query := "?limit=700"
+		if cursor != "" {
+			query += "&after=" + cursor
+		}
+		versions, meta := stream(query)
+		if len(versions) > 700 {
+			t.Fatalf("%s: %d versions, want at most the limit", query, len(versions))
+		}
+		walked = append(walked, versions...)
+		if meta == nil {
+			break
+		}
+		if meta.Limit != 700 || meta.Next != versions[len(versions)-1] {
+			t.Fatalf("%s: cursor %+v, want the last version returned", query, meta)
+		}
+		cursor = meta.Next
+	}
+	if !slices.Equal(walked, want) {
+		t.Errorf("walked %d versions, want all %d in order", len(walked), n)
+	}
+	// A limit of exactly what's left has no next cursor
+	if versions, meta := stream("?limit=10&after=" + want[n-11]); len(versions) != 10 || meta != nil {
+		t.Errorf("last page: %d versions with cursor %+v, want 10 and none", len(versions), meta)
+	}
+
+	for _, q := range []string{"?limit=0", "?limit=-1", "?limit=ten", "?after=latest"} {
+		if w := serve(h, http.MethodGet, "/terraform/modules/v1/acme/vpc/aws/versions/stream"+q, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestBoundedVersions(t *testing.T) {
+	var versions []*version.Version
+	for _, name := range testVersionNames(1000) {
+		versions = append(versions, version.Must(version.NewSemver(name)))
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(versions), func(i, j int) { versions[i], versions[j] = versions[j], versions[i] })
+	sorted := slices.Clone(versions)
+	slices.SortFunc(sorted, func(a, b *version.Version) int { return a.Compare(b) })
+
+	for _, c := range []struct {
+		name string
+		kept *boundedVersions
+		want []*version.Version
+	}{
+		{"oldest", &boundedVersions{n: 10}, sorted[:10]},
+		{"newest", &boundedVersions{n: 10, heap: versionHeap{newest: true}}, sorted[990:]},
+		{"unbounded", &boundedVersions{}, sorted},
+	} {
+		for _, v := range versions {
+			c.kept.push(v)
+			if c.kept.n > 0 && c.kept.heap.Len() > c.kept.n {
+				t.Fatalf("%s: holding %d versions, want at most %d", c.name, c.kept.heap.Len(), c.kept.n)
+			}
+		}
+		if got := c.kept.sorted(); !slices.Equal(got, c.want) {
+			t.Errorf("%s: kept %v, want %v", c.name, got, c.want)
+		}
+		if c.kept.dropped != (c.kept.n > 0) {
+			t.Errorf("%s: dropped %t", c.name, c.kept.dropped)
+		}
+	}
+}
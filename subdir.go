@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// archiveSubdir returns the directory of a module version's archive its module lives in, for archives holding
+// several modules, from the subdir field of the version's metadata object. It's empty when the version
+// has no metadata object or it sets no subdir
+func archiveSubdir(ctx context.Context, m Module) (string, error) {
+	b, err := fs.ReadFile(moduleFS(ctx), path.Join(backendKey(ctx, m.Namespace, m.Name, m.Provider, m.Version), MetadataFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var meta struct {
+		Subdir string `json:"subdir"`
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", MetadataFile, err)
+	}
+	return cleanSubdir(meta.Subdir)
+}
+
+// cleanSubdir validates an archive subdirectory, rejecting absolute paths and .. segments that would
+// point terraform outside of the archive, and characters that would end the url path
+func cleanSubdir(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	invalid := strings.HasPrefix(s, "/") || strings.ContainsAny(s, `\?#%`) || strings.IndexFunc(s, unicode.IsControl) >= 0
+	for _, seg := range strings.Split(s, "/") {
+		invalid = invalid || seg == ".."
+	}
+	if invalid {
+		return "", fmt.Errorf("invalid subdir %q in %s, must be a relative path within the archive", s, MetadataFile)
+	}
+	if s = path.Clean(s); s == "." {
+		return "", nil
+	}
+	return s, nil
+}
+
+// withSubdir appends the go-getter //subdir suffix to an archive url, ahead of its query string
+func withSubdir(u string, subdir string) string {
+	if subdir == "" {
+		return u
+	}
+	base, query, hasQuery := strings.Cut(u, "?")
+	base += "//" + subdir
+	if hasQuery {
+		base += "?" + query
+	}
+	return base
+}
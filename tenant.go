@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TenantBasePath is the path tenants' module routes are served below, e.g. /t/<tenant>/terraform/modules/v1/...
+const TenantBasePath = "/t"
+
+// tenantKey is the context key a tenant request's tenant is stored under
+type tenantKey struct{}
+
+// tenant is a team whose modules are served from their own prefix of the backend
+type tenant struct {
+	name   string
+	prefix string
+}
+
+// parseTenants parses the -tenants flag, a comma separated list of <tenant>=<prefix> pairs
+func parseTenants(s string) (map[string]string, error) {
+	tenants := map[string]string{}
+	for _, item := range splitList(s) {
+		name, p, ok := strings.Cut(item, "=")
+		if !ok || !validCoordinate(name) {
+			return nil, fmt.Errorf("invalid tenant %q, expected <tenant>=<prefix>", item)
+		}
+		if _, dup := tenants[name]; dup {
+			return nil, fmt.Errorf("tenant %s is configured more than once", name)
+		}
+		tenants[name] = normalizePrefix(p)
+	}
+	return tenants, nil
+}
+
+// tenantNames returns the configured tenants' names, sorted
+func tenantNames() []string {
+	names := make([]string, 0, len(tenantPrefixes))
+	for name := range tenantPrefixes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requestTenant returns the tenant a request is for, ok is false for requests outside of /t/
+func requestTenant(ctx context.Context) (t tenant, ok bool) {
+	t, ok = ctx.Value(tenantKey{}).(tenant)
+	return t, ok
+}
+
+// isTenantRequest reports whether a request is for a tenant's modules
+func isTenantRequest(ctx context.Context) bool {
+	_, ok := requestTenant(ctx)
+	return ok
+}
+
+// requestPrefix returns the prefix a request's modules are served from, its tenant's or else -prefix
+func requestPrefix(ctx context.Context) string {
+	if t, ok := requestTenant(ctx); ok {
+		return t.prefix
+	}
+	return prefix
+}
+
+// tenantPath returns the path a request's tenant routes are served below, empty for requests outside of /t/.
+// Urls handed back to clients, e.g. download urls, are prefixed with it so they resolve to the same tenant
+func tenantPath(ctx context.Context) string {
+	if t, ok := requestTenant(ctx); ok {
+		return TenantBasePath + "/" + t.name
+	}
+	return ""
+}
+
+// isTenantRoute reports whether a path is served for tenants, i.e. it's a module, provider or download route
+func isTenantRoute(p string) bool {
+	for _, base := range []string{ModuleBasePath, ProviderBasePath} {
+		if p == base || strings.HasPrefix(p, base+"/") {
+			return true
+		}
+	}
+	return strings.HasPrefix(p, "/download/") || strings.HasPrefix(p, "/providers/download/")
+}
+
+// routeTenants is a middleware serving /t/<tenant>/ module, provider and download routes from the tenant's prefix,
+// in the module backend and the provider backend respectively.
+// The tenant is removed from the path before routing, like the -base-url path, and kept in the request's context.
+// Unknown tenants, and routes other than module, provider and download routes, are a 404
+func routeTenants(tenants map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rest, ok := strings.CutPrefix(r.URL.Path, TenantBasePath+"/")
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			name, sub, _ := strings.Cut(rest, "/")
+			p, found := tenants[name]
+			if !found {
+				renderError(w, r, http.StatusNotFound, errors.New("tenant not found"))
+				return
+			}
+			sub = "/" + sub
+			if !isTenantRoute(sub) {
+				renderError(w, r, http.StatusNotFound, errors.New("only module and provider routes are served for tenants"))
+				return
+			}
+			r.URL.Path = sub
+			// chi routes on the escaped path when there is one, keep it so escaped params stay escaped
+			if raw, ok := strings.CutPrefix(r.URL.RawPath, TenantBasePath+"/"+name); ok {
+				r.URL.RawPath = raw
+			} else {
+				r.URL.RawPath = ""
+			}
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				rctx.RoutePath = r.URL.EscapedPath()
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant{name: name, prefix: p})))
+		})
+	}
+}
+
+// hiddenByTenant reports whether key, a path of the tree served from root, overlaps the prefix of a tenant other than
+// root's own: it's that prefix, below it, or one of its parent directories. Tenants' prefixes may lie within -prefix
+// (always so with an empty -prefix), and their modules are only served below /t/<tenant>, not through the root tree
+func hiddenByTenant(root, key string) bool {
+	root, key = path.Join(".", root), path.Join(".", key)
+	for _, p := range tenantPrefixes {
+		p = path.Join(".", p)
+		if p == root {
+			continue
+		}
+		if key == p || strings.HasPrefix(key, p+"/") || strings.HasPrefix(p, key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleHidden reports whether the module path elem of a request is hidden by a tenant's prefix, see hiddenByTenant
+func moduleHidden(ctx context.Context, elem ...string) bool {
+	return hiddenByTenant(requestPrefix(ctx), backendKey(ctx, elem...))
+}
+
+// hideTenantPrefixes is a middleware 404ing module routes whose namespace, name or provider path is hidden by a tenant's prefix,
+// so e.g. /terraform/modules/v1/<tenant prefix>/... and /download/<tenant prefix>/... don't serve the tenant's modules
+func hideTenantPrefixes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var elem []string
+		if strings.HasPrefix(r.URL.Path, "/download/") {
+			if m, _, ok := parseDownloadPath(r.URL.Path); ok {
+				elem = []string{m.Namespace, m.Name, m.Provider}
+			}
+		} else {
+			for _, k := range []string{"namespace", "name", "provider"} {
+				if v := chi.URLParam(r, k); v != "" {
+					elem = append(elem, v)
+				}
+			}
+		}
+		if len(elem) > 0 && moduleHidden(r.Context(), elem...) {
+			renderError(w, r, http.StatusNotFound, errors.New("module not found"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
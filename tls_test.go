@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, c := range []struct {
+		port, host, target, want string
+	}{
+		{"443", "registry.example.com", "/terraform/modules/v1/acme/vpc/aws/versions?x=1", "https://registry.example.com/terraform/modules/v1/acme/vpc/aws/versions?x=1"},
+		{"443", "registry.example.com:80", "/.well-known/terraform.json", "https://registry.example.com/.well-known/terraform.json"},
+		{"8443", "registry.example.com:8080", "/download/acme/vpc/aws/1.0.0/vpc.tgz", "https://registry.example.com:8443/download/acme/vpc/aws/1.0.0/vpc.tgz"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, c.target, nil)
+		req.Host = c.host
+		w := httptest.NewRecorder()
+		httpsRedirect(c.port).ServeHTTP(w, req)
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s%s: status %d, want 301", c.host, c.target, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != c.want {
+			t.Errorf("%s%s: Location %q, want %q", c.host, c.target, got, c.want)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	setGlobal(t, &useTLS, true)
+	setGlobal(t, &hstsMaxAge, 24*time.Hour)
+	srv := httptest.NewTLSServer(newTestRegistry(t, testLayout(t)))
+	defer srv.Close()
+	for _, p := range []string{"/.well-known/terraform.json", "/terraform/modules/v1/acme/vpc/aws/versions", "/terraform/modules/v1/acme/nope/aws/versions"} {
+		resp, err := srv.Client().Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, want := resp.Header.Get("Strict-Transport-Security"), "max-age=86400; includeSubDomains"; got != want {
+			t.Errorf("GET %s: Strict-Transport-Security %q, want %q", p, got, want)
+		}
+	}
+
+	// Plain http responses never carry the header, browsers would ignore it anyway
+	setGlobal(t, &useTLS, false)
+	if w := serve(newTestRegistry(t, testLayout(t)), http.MethodGet, "/.well-known/terraform.json", nil); w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("http response has a Strict-Transport-Security header")
+	}
+}
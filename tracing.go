@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the registry's spans, it's a no-op until initTracing installs a tracer provider
+var tracer = otel.Tracer("github.com/nalbury/tf-registry")
+
+// initTracing exports traces to the OTLP/HTTP collector at endpoint (e.g. http://otel-collector:4318),
+// and propagates W3C trace context so the registry's spans join traces started by callers or a service mesh.
+// The returned func flushes buffered spans on shutdown
+func initTracing(endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("tf-registry"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// traceRequests wraps the router with a server span per request
+func traceRequests(handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, "tf-registry")
+}
+
+// nameSpans is a middleware renaming a request's server span after the route it matched (e.g. GET /download/*),
+// which is only known once chi has routed the request
+func nameSpans(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			trace.SpanFromContext(r.Context()).SetName(r.Method + " " + rctx.RoutePattern())
+		}
+	})
+}
+
+// startModuleSpan starts a span for a backend call on behalf of module m, tagged with its coordinates
+func startModuleSpan(ctx context.Context, name string, m Module, key string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("module.namespace", m.Namespace),
+		attribute.String("module.name", m.Name),
+		attribute.String("module.provider", m.Provider),
+	}
+	if m.Version != "" {
+		attrs = append(attrs, attribute.String("module.version", m.Version))
+	}
+	// Like log lines, spans only carry the raw key when -log-keys is set
+	if logKeys {
+		attrs = append(attrs, attribute.String("backend.key", key))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err on it if the call failed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceLogHandler attaches the trace and span ids of the context a record is logged with,
+// so log lines can be found from a trace and the other way around
+type traceLogHandler struct {
+	slog.Handler
+}
+
+func (h traceLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceLogHandler) WithGroup(name string) slog.Handler {
+	return traceLogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tarTransform rewrites an uncompressed tar stream, transforms are chained as an ordered pipeline of readers
+type tarTransform func(io.Reader) io.Reader
+
+// transformStep is a configured tarTransform
+type transformStep struct {
+	// spec is the step as configured, it identifies the step in transformed archive cache keys
+	spec  string
+	apply tarTransform
+}
+
+// parseTransforms parses the -transforms flag, a semicolon separated list of steps in the form
+// [<namespace>/<name>/<provider>=]<kind>:<args>, steps without a module apply to every module. Supported kinds are:
+//
+//	strip:<pattern>[,<pattern>...]   drop entries with any path element matching one of the patterns (e.g. strip:.git)
+//	inject:<name>=<local file>       add (or replace) a file at the root of the archive (e.g. inject:provider.tf=/etc/provider.tf)
+func parseTransforms(s string) (global []transformStep, perModule map[string][]transformStep, err error) {
+	perModule = map[string][]transformStep{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		mod := ""
+		if i := strings.Index(spec, "="); i > 0 && strings.Count(spec[:i], "/") == 2 && !strings.Contains(spec[:i], ":") {
+			mod, spec = spec[:i], spec[i+1:]
+		}
+		step, err := parseTransformStep(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mod == "" {
+			global = append(global, step)
+		} else {
+			perModule[mod] = append(perModule[mod], step)
+		}
+	}
+	return global, perModule, nil
+}
+
+// parseTransformStep parses a single <kind>:<args> transform
+func parseTransformStep(spec string) (transformStep, error) {
+	kind, args, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "strip":
+		patterns := splitList(args)
+		if len(patterns) == 0 {
+			return transformStep{}, fmt.Errorf("invalid transform %q: no patterns to strip", spec)
+		}
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return transformStep{}, fmt.Errorf("invalid transform %q: %w", spec, err)
+			}
+		}
+		return transformStep{spec: spec, apply: stripFiles(patterns)}, nil
+	case "inject":
+		name, src, ok := strings.Cut(args, "=")
+		if !ok || name == "" || src == "" {
+			return transformStep{}, fmt.Errorf("invalid transform %q: expected inject:<name>=<local file>", spec)
+		}
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return transformStep{}, fmt.Errorf("invalid transform %q: %w", spec, err)
+		}
+		// the injected content is part of the cache key, so editing the file and restarting busts the cache
+		sum := sha256.Sum256(b)
+		return transformStep{spec: fmt.Sprintf("%s@%x", spec, sum[:8]), apply: injectFile(path.Clean(name), b)}, nil
+	}
+	return transformStep{}, fmt.Errorf("invalid transform %q: unknown kind %q", spec, kind)
+}
+
+// rewriteTar is a helper function to build tar transforms, every entry of the input is passed to entry,
+// which writes whatever should replace it to tw. finish is called once all entries have been read.
+// The input is closed once the transform stops, so that a closed output unwinds the whole pipeline
+func rewriteTar(r io.Reader, entry func(tw *tar.Writer, hdr *tar.Header, body io.Reader) error, finish func(tw *tar.Writer) error) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		tr := tar.NewReader(r)
+		tw := tar.NewWriter(pw)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if err := entry(tw, hdr, tr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if err := finish(tw); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr
+}
+
+// copyEntry writes a tar entry through unchanged
+func copyEntry(tw *tar.Writer, hdr *tar.Header, body io.Reader) error {
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, body)
+	return err
+}
+
+// stripFiles returns a transform dropping every entry with a path element matching one of patterns
+func stripFiles(patterns []string) tarTransform {
+	matches := func(name string) bool {
+		for _, elem := range strings.Split(path.Clean(name), "/") {
+			for _, p := range patterns {
+				if ok, _ := path.Match(p, elem); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return func(r io.Reader) io.Reader {
+		return rewriteTar(r, func(tw *tar.Writer, hdr *tar.Header, body io.Reader) error {
+			if matches(hdr.Name) {
+				return nil
+			}
+			return copyEntry(tw, hdr, body)
+		}, func(*tar.Writer) error { return nil })
+	}
+}
+
+// injectFile returns a transform adding a file at the root of the archive, replacing any existing entry of that name
+func injectFile(name string, content []byte) tarTransform {
+	return func(r io.Reader) io.Reader {
+		return rewriteTar(r, func(tw *tar.Writer, hdr *tar.Header, body io.Reader) error {
+			if path.Clean(hdr.Name) == name {
+				return nil
+			}
+			return copyEntry(tw, hdr, body)
+		}, func(tw *tar.Writer) error {
+			hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := tw.Write(content)
+			return err
+		})
+	}
+}
+
+// transformArchive streams a gzipped tarball through the transform pipeline, returning the re-compressed output.
+// Closing the returned reader stops the pipeline
+func transformArchive(src io.Reader, steps []transformStep) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = gz
+	for _, s := range steps {
+		r = s.apply(r)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		zw := gzip.NewWriter(pw)
+		if _, err := io.Copy(zw, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+	return pr, nil
+}
+
+// transformsFor returns the transform pipeline for a module's archive file, global steps run before module specific ones.
+// The steps rewrite gzipped tarballs, zip archives are served as they're stored
+func transformsFor(m Module, file string) []transformStep {
+	if strings.HasSuffix(file, ".zip") {
+		return nil
+	}
+	mod := moduleTransforms[m.Namespace+"/"+m.Name+"/"+m.Provider]
+	if len(globalTransforms) == 0 {
+		return mod
+	}
+	return append(append([]transformStep{}, globalTransforms...), mod...)
+}
+
+// transformCacheKey derives the cache key of a transformed archive from its source's ETag and the pipeline config
+func transformCacheKey(key string, etag string, steps []transformStep) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s", key, etag)
+	for _, s := range steps {
+		fmt.Fprintf(h, "\x00%s", s.spec)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+// archiveCache is an in memory cache of archives bounded by their total size in bytes, the oldest entry is evicted first
+type archiveCache struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	order []string
+	blobs map[string][]byte
+}
+
+// get returns the cached archive for key
+func (c *archiveCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.blobs[key]
+	return b, ok
+}
+
+// fits reports whether an archive of n bytes can be cached at all
+func (c *archiveCache) fits(n int64) bool {
+	return n <= c.max
+}
+
+// put caches an archive, evicting the oldest entries until it fits. Archives larger than the whole cache aren't cached
+func (c *archiveCache) put(key string, b []byte) {
+	if !c.fits(int64(len(b))) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blobs == nil {
+		c.blobs = map[string][]byte{}
+	}
+	if _, ok := c.blobs[key]; ok {
+		return
+	}
+	for c.size+int64(len(b)) > c.max {
+		c.size -= int64(len(c.blobs[c.order[0]]))
+		delete(c.blobs, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.order = append(c.order, key)
+	c.blobs[key] = b
+	c.size += int64(len(b))
+}
+
+// cappedBuffer is a bytes.Buffer that stops buffering once it holds more than max bytes,
+// writes never fail so it can tee a stream that's served regardless
+type cappedBuffer struct {
+	bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || int64(b.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// serveTransformed serves a module archive through its transform pipeline,
+// the output is cached by the source's ETag and pipeline so repeated downloads don't re-run the pipeline
+func serveTransformed(w http.ResponseWriter, r *http.Request, m Module, key string, steps []transformStep) {
+	start := time.Now()
+	fi, err := fs.Stat(moduleFS(r.Context()), key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			renderError(w, r, http.StatusNotFound, errors.New("module archive not found"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelError, "failed to stat module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	observeDownloadTTFB(r.Context(), time.Since(start))
+	etag := transformCacheKey(key, archiveETag(r.Context(), key, fi), steps)
+	w.Header().Set("ETag", etag)
+	if b, ok := transformedArchives.get(etag); ok {
+		http.ServeContent(w, r, path.Base(key), fi.ModTime(), bytes.NewReader(b))
+		return
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if validateETagOnServe {
+		serveValidatedTransform(w, r, m, key, steps, fi)
+		return
+	}
+
+	f, err := moduleFS(r.Context()).Open(key)
+	if err != nil {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to open module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	defer f.Close()
+	out, err := transformArchive(f, steps)
+	if err != nil {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to transform module archive", m, key, slog.Any("error", err))
+		renderError(w, r, 500, err)
+		return
+	}
+	defer out.Close()
+
+	// Stream the output to the client while keeping a copy for the cache, as long as it would fit in it
+	buf := &cappedBuffer{max: transformedArchives.max}
+	if _, err := io.Copy(w, io.TeeReader(out, buf)); err != nil {
+		logBackendAccess(r.Context(), slog.LevelError, "failed to stream transformed module archive", m, key, slog.Any("error", err))
+		return
+	}
+	if !buf.overflow {
+		transformedArchives.put(etag, buf.Bytes())
+	}
+}
+
+const (
+	// maxRevalidations is how many times a transformed archive is rebuilt when its source keeps changing underneath it
+	maxRevalidations = 3
+	// maxBufferedTransform bounds the size of a transformed archive buffered for -validate-etag-on-serve
+	maxBufferedTransform = 256 << 20
+)
+
+// errTransformTooLarge is returned when a transformed archive outgrows maxBufferedTransform
+var errTransformTooLarge = errors.New("transformed module archive is too large to buffer")
+
+// serveValidatedTransform serves a module archive through its transform pipeline for -validate-etag-on-serve.
+// The output is buffered rather than streamed, and only served and cached once the source's ETag is confirmed
+// unchanged since fi was taken, otherwise the source was overwritten mid-transform and it's fetched again
+func serveValidatedTransform(w http.ResponseWriter, r *http.Request, m Module, key string, steps []transformStep, fi fs.FileInfo) {
+	for attempt := 0; ; attempt++ {
+		b, err := transformObject(r.Context(), key, steps)
+		if errors.Is(err, errTransformTooLarge) {
+			logBackendAccess(r.Context(), slog.LevelError, "transformed module archive is too large to validate", m, key, slog.Int("max_bytes", maxBufferedTransform))
+			renderError(w, r, 500, err)
+			return
+		}
+		if err != nil {
+			logBackendAccess(r.Context(), slog.LevelError, "failed to transform module archive", m, key, slog.Any("error", err))
+			renderError(w, r, 500, err)
+			return
+		}
+		current, err := fs.Stat(moduleFS(r.Context()), key)
+		if err != nil {
+			logBackendAccess(r.Context(), slog.LevelError, "failed to stat module archive", m, key, slog.Any("error", err))
+			renderError(w, r, 500, err)
+			return
+		}
+		if currentETag := archiveETag(r.Context(), key, current); currentETag == archiveETag(r.Context(), key, fi) {
+			etag := transformCacheKey(key, currentETag, steps)
+			w.Header().Set("ETag", etag)
+			transformedArchives.put(etag, b)
+			http.ServeContent(w, r, path.Base(key), fi.ModTime(), bytes.NewReader(b))
+			return
+		}
+		if attempt == maxRevalidations {
+			logBackendAccess(r.Context(), slog.LevelError, "module archive kept changing while it was transformed", m, key)
+			renderError(w, r, http.StatusServiceUnavailable, errors.New("module archive changed while it was being served"))
+			return
+		}
+		logBackendAccess(r.Context(), slog.LevelWarn, "module archive changed while it was transformed, refetching", m, key)
+		fi = current
+	}
+}
+
+// transformObject runs a backend object through a transform pipeline, returning the whole output.
+// errTransformTooLarge is returned once the output outgrows maxBufferedTransform
+func transformObject(ctx context.Context, key string, steps []transformStep) ([]byte, error) {
+	f, err := moduleFS(ctx).Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out, err := transformArchive(f, steps)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	b, err := io.ReadAll(io.LimitReader(out, maxBufferedTransform+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxBufferedTransform {
+		return nil, errTransformTooLarge
+	}
+	return b, nil
+}
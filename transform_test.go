@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// tarEntries returns the contents of a gzipped tarball by entry name
+func tarEntries(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = string(body)
+	}
+}
+
+func TestStripTransform(t *testing.T) {
+	step, err := parseTransformStep("strip:.git,*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := testTarball(t, map[string]string{
+		".git/HEAD":             "ref: refs/heads/main",
+		"main.tf":               "module",
+		"main.tf.bak":           "old",
+		"modules/sub/.git/HEAD": "ref: refs/heads/sub",
+		"modules/sub/main.tf":   "submodule",
+		"git.tf":                "not a match",
+	})
+	out, err := transformArchive(bytes.NewReader(src), []transformStep{step})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	b, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"main.tf": "module", "modules/sub/main.tf": "submodule", "git.tf": "not a match"}
+	if got := tarEntries(t, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries %v, want %v", got, want)
+	}
+}
+
+// etagFS is a backend assigning its objects an ETag of its own, like S3 does
+type etagFS struct {
+	fs.FS
+	etag string
+}
+
+func (e etagFS) Open(name string) (fs.File, error) {
+	f, err := e.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return etagFile{File: f, etag: e.etag}, nil
+}
+
+type etagFile struct {
+	fs.File
+	etag string
+}
+
+func (f etagFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return etagFileInfo{FileInfo: fi, etag: f.etag}, nil
+}
+
+func (f etagFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return f.File.(fs.ReadDirFile).ReadDir(n)
+}
+
+type etagFileInfo struct {
+	fs.FileInfo
+	etag string
+}
+
+func (fi etagFileInfo) ETag() string { return fi.etag }
+
+func TestTransformedDownload(t *testing.T) {
+	step, err := parseTransformStep("strip:.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &globalTransforms, []transformStep{step})
+	setGlobal(t, &transformedArchives, &archiveCache{max: 1 << 20})
+	fsys := fstest.MapFS{"acme/vpc/aws/1.0.0/vpc.tgz": testFile(testTarball(t, map[string]string{
+		".git/HEAD": "ref: refs/heads/main",
+		"main.tf":   "module",
+	}))}
+	h := newTestRegistry(t, fsys)
+	const download = "/download/acme/vpc/aws/1.0.0/vpc.tgz"
+
+	setGlobal(t, &s3fsys, fs.FS(etagFS{FS: fsys, etag: "v1"}))
+	w := serve(h, http.MethodGet, download, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got, want := tarEntries(t, w.Body.Bytes()), map[string]string{"main.tf": "module"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries %v, want %v", got, want)
+	}
+	first := w.Header().Get("ETag")
+	if first != transformCacheKey("acme/vpc/aws/1.0.0/vpc.tgz", `"v1"`, []transformStep{step}) {
+		t.Errorf("ETag %s isn't derived from the backend's ETag", first)
+	}
+	if _, ok := transformedArchives.get(first); !ok {
+		t.Error("transformed archive wasn't cached")
+	}
+	if w := serve(h, http.MethodGet, download, nil, "If-None-Match", first); w.Code != http.StatusNotModified {
+		t.Errorf("conditional status %d, want 304", w.Code)
+	}
+
+	// The object was overwritten with the same size and modification time, only the backend's ETag tells them apart
+	setGlobal(t, &s3fsys, fs.FS(etagFS{FS: fsys, etag: "v2"}))
+	w = serve(h, http.MethodGet, download, nil, "If-None-Match", first)
+	if w.Code != http.StatusOK {
+		t.Fatalf("after overwrite: status %d, want 200", w.Code)
+	}
+	if w.Header().Get("ETag") == first {
+		t.Error("after overwrite: the stale transformed archive's ETag was served")
+	}
+}
+
+// overwriteFS is a backend whose object at key is overwritten with its next contents each time it's opened,
+// until it's been overwritten overwrites times. Every version has the same size and modification time,
+// only the backend's ETag tells them apart
+type overwriteFS struct {
+	key        string
+	contents   [][]byte
+	overwrites int
+
+	mu      sync.Mutex
+	version int
+}
+
+func (o *overwriteFS) Open(name string) (fs.File, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if name != o.key {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f, err := fstest.MapFS{name: testFile(o.contents[o.version%len(o.contents)])}.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	etag := fmt.Sprintf("v%d", o.version)
+	if o.version < o.overwrites {
+		o.version++
+	}
+	return etagFile{File: f, etag: etag}, nil
+}
+
+func (o *overwriteFS) Stat(name string) (fs.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if name != o.key {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	fi, err := fs.Stat(fstest.MapFS{name: testFile(o.contents[o.version%len(o.contents)])}, name)
+	if err != nil {
+		return nil, err
+	}
+	return etagFileInfo{FileInfo: fi, etag: fmt.Sprintf("v%d", o.version)}, nil
+}
+
+func TestValidateETagOnServe(t *testing.T) {
+	step, err := parseTransformStep("strip:.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "acme/vpc/aws/1.0.0/vpc.tgz"
+	contents := [][]byte{
+		testTarball(t, map[string]string{".git/HEAD": "x", "main.tf": "old"}),
+		testTarball(t, map[string]string{".git/HEAD": "x", "main.tf": "new"}),
+	}
+	if len(contents[0]) != len(contents[1]) {
+		t.Fatal("the versions of the archive should only differ by their ETag")
+	}
+	setGlobal(t, &globalTransforms, []transformStep{step})
+	setGlobal(t, &validateETagOnServe, true)
+	h := newTestRegistry(t, fstest.MapFS{})
+
+	for _, c := range []struct {
+		name       string
+		overwrites int
+		wantStatus int
+		wantMain   string
+		wantETag   string
+	}{
+		{"unchanged", 0, http.StatusOK, "old", `"v0"`},
+		{"changed mid-transform", 1, http.StatusOK, "new", `"v1"`},
+		{"keeps changing", 2 * maxRevalidations, http.StatusServiceUnavailable, "", ""},
+	} {
+		setGlobal(t, &transformedArchives, &archiveCache{max: 1 << 20})
+		setGlobal(t, &s3fsys, fs.FS(&overwriteFS{key: key, contents: contents, overwrites: c.overwrites}))
+		w := serve(h, http.MethodGet, "/download/"+key, nil)
+		if w.Code != c.wantStatus {
+			t.Fatalf("%s: status %d, want %d: %s", c.name, w.Code, c.wantStatus, w.Body)
+		}
+		if c.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := tarEntries(t, w.Body.Bytes())["main.tf"]; got != c.wantMain {
+			t.Errorf("%s: served main.tf %q, want %q", c.name, got, c.wantMain)
+		}
+		etag := transformCacheKey(key, c.wantETag, []transformStep{step})
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Errorf("%s: ETag %s, want %s", c.name, got, etag)
+		}
+		if b, ok := transformedArchives.get(etag); !ok || !bytes.Equal(b, w.Body.Bytes()) {
+			t.Errorf("%s: the served archive wasn't cached under its source's current ETag", c.name)
+		}
+	}
+}
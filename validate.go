@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"golang.org/x/sync/errgroup"
+)
+
+// layoutReport is the outcome of validating the backend layout below a prefix
+type layoutReport struct {
+	modules  int
+	versions int
+	problems []string
+}
+
+// validateLayout walks the modules below the prefix of ctx (see requestPrefix) and checks every version directory
+// the way downloads would resolve it: its name must be semver and its archive must exist, unless the module is redirected.
+// With -require-owners its metadata object must list its owners. Modules without any versions are reported too
+func validateLayout(ctx context.Context) (layoutReport, error) {
+	var report layoutReport
+	root := requestPrefix(ctx)
+	if err := checkPrefix(s3fsys, root); err != nil {
+		report.problems = append(report.problems, err.Error())
+		return report, nil
+	}
+	mods, err := walkModules(s3fsys, root, walkConcurrency, &listPacer{delay: indexDelay})
+	if err != nil {
+		return report, err
+	}
+	report.modules = len(mods)
+
+	var mu sync.Mutex
+	problem := func(format string, a ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.problems = append(report.problems, fmt.Sprintf(format, a...))
+	}
+	g := errgroup.Group{}
+	g.SetLimit(max(walkConcurrency, 1))
+	for _, m := range mods {
+		g.Go(func() error {
+			modPath := backendKey(ctx, m.Namespace, m.Name, m.Provider)
+			entries, err := fs.ReadDir(s3fsys, modPath)
+			if err != nil {
+				return fmt.Errorf("listing %s: %w", modPath, err)
+			}
+			_, redirected := redirectFor(m)
+			listed := 0
+			for _, e := range entries {
+				if !e.IsDir() {
+					continue
+				}
+				mv := m
+				mv.Version = e.Name()
+				source := path.Join(m.Namespace, m.Name, m.Provider, mv.Version)
+				if _, err := version.NewSemver(mv.Version); err != nil {
+					problem("%s: version directory isn't valid semver, it's never listed", source)
+					continue
+				}
+				listed++
+				mu.Lock()
+				report.versions++
+				mu.Unlock()
+				if requireOwners {
+					metadata, err := fs.ReadFile(s3fsys, backendKey(ctx, mv.Namespace, mv.Name, mv.Provider, mv.Version, MetadataFile))
+					if err != nil && !errors.Is(err, fs.ErrNotExist) {
+						return fmt.Errorf("checking %s: %w", source, err)
+					}
+					if err := checkOwners(metadata); err != nil {
+						problem("%s: %s", source, err)
+					}
+				}
+				if redirected {
+					continue
+				}
+				file, err := resolveArchive(ctx, mv, archiveName(mv))
+				if err == nil {
+					_, err = fs.Stat(s3fsys, backendKey(ctx, mv.Namespace, mv.Name, mv.Provider, mv.Version, file))
+				}
+				switch {
+				case errors.Is(err, fs.ErrNotExist):
+					problem("%s: missing archive %s", source, archiveName(mv))
+				case err != nil:
+					return fmt.Errorf("checking %s: %w", source, err)
+				}
+			}
+			// Usually the prefix is a level off, making version directories look like providers
+			if listed == 0 {
+				problem("%s: no version directories", path.Join(m.Namespace, m.Name, m.Provider))
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return report, err
+	}
+	sort.Strings(report.problems)
+	return report, nil
+}
+
+// runValidation is the -validate mode, it validates the layout below -prefix and every tenant's prefix
+// and prints what it found. The returned exit code is non-zero when there are problems
+func runValidation() int {
+	type target struct {
+		name string
+		ctx  context.Context
+	}
+	targets := []target{{name: fmt.Sprintf("prefix %q", prefix), ctx: context.Background()}}
+	for _, name := range tenantNames() {
+		ctx := context.WithValue(context.Background(), tenantKey{}, tenant{name: name, prefix: tenantPrefixes[name]})
+		targets = append(targets, target{name: "tenant " + name, ctx: ctx})
+	}
+	code := 0
+	for _, t := range targets {
+		report, err := validateLayout(t.ctx)
+		if err != nil {
+			fmt.Printf("%s: validation failed: %s\n", t.name, err)
+			code = 1
+			continue
+		}
+		for _, p := range report.problems {
+			fmt.Printf("%s: %s\n", t.name, p)
+		}
+		fmt.Printf("%s: %d modules, %d versions, %d problems\n", t.name, report.modules, report.versions, len(report.problems))
+		if len(report.problems) > 0 {
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxThrottleRetries is the number of times a throttled listing is retried before a walk gives up
+const maxThrottleRetries = 5
+
+// maxThrottleBackoff caps the extra delay added between listings while the backend is throttling
+const maxThrottleBackoff = 30 * time.Second
+
+// listPacer spaces out backend listings during a walk, so that walking a large bucket doesn't trigger throttling.
+// When the backend throttles anyway, the pacer backs off exponentially until listings succeed again
+type listPacer struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	backoff time.Duration
+	next    time.Time
+}
+
+// wait blocks until the next listing is allowed to start, a nil pacer never waits
+func (p *listPacer) wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	start := p.next
+	if start.Before(now) {
+		start = now
+	}
+	p.next = start.Add(p.delay + p.backoff)
+	p.mu.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+// observe adjusts the backoff from the result of a listing
+func (p *listPacer) observe(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case isThrottleError(err):
+		p.backoff = p.backoff*2 + time.Second
+		if p.backoff > maxThrottleBackoff {
+			p.backoff = maxThrottleBackoff
+		}
+	case err == nil:
+		p.backoff /= 2
+	}
+}
+
+// readDir lists a directory through the pacer, retrying listings the backend throttled
+func (p *listPacer) readDir(fsys fs.FS, dir string) ([]fs.DirEntry, error) {
+	for attempt := 0; ; attempt++ {
+		p.wait()
+		entries, err := fs.ReadDir(fsys, dir)
+		p.observe(err)
+		if p == nil || !isThrottleError(err) || attempt == maxThrottleRetries {
+			return entries, err
+		}
+	}
+}
+
+// readDirs is a helper function to list many backend directories at once,
+// at most concurrency listings are in flight at a time so large buckets don't get throttled,
+// and listings are spaced out by the pacer when one is given.
+// The results are returned in the same order as dirs, regardless of which listing finishes first
+func readDirs(fsys fs.FS, dirs []string, concurrency int, pacer *listPacer) ([][]fs.DirEntry, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([][]fs.DirEntry, len(dirs))
+	errs := make([]error, len(dirs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, d := range dirs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, d string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// each goroutine only writes its own index, so no further locking is needed
+			results[i], errs[i] = pacer.readDir(fsys, d)
+		}(i, d)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// fanOut calls fn for every item with at most concurrency calls in flight, e.g. to list many modules' versions at once.
+// The results are returned in the same order as items. Once ctx is done no more calls are started,
+// and the context's error is returned after the calls in flight finish
+func fanOut[T, R any](ctx context.Context, items []T, concurrency int, fn func(T) R) ([]R, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]R, len(items))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// each goroutine only writes its own index, so no further locking is needed
+			results[i] = fn(item)
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// walkModules walks the namespace/name/provider tree of the backend rooted at root,
+// and returns every module found, sorted by namespace, name and provider
+func walkModules(fsys fs.FS, root string, concurrency int, pacer *listPacer) ([]Module, error) {
+	// Each level of the tree is listed in parallel before descending to the next one
+	mods := []Module{{}}
+	for depth := 0; depth < 3; depth++ {
+		dirs := make([]string, len(mods))
+		for i, m := range mods {
+			dirs[i] = path.Join(".", root, m.Namespace, m.Name, m.Provider)
+		}
+		entries, err := readDirs(fsys, dirs, concurrency, pacer)
+		if err != nil {
+			return nil, err
+		}
+		var next []Module
+		for i, m := range mods {
+			for _, e := range entries[i] {
+				// The providers directory holds the provider registry, not a module namespace,
+				// and tenants' prefixes within root hold their modules, which aren't root's
+				if !e.IsDir() || (depth == 0 && e.Name() == ProvidersDir) || hiddenByTenant(root, path.Join(dirs[i], e.Name())) {
+					continue
+				}
+				child := m
+				switch depth {
+				case 0:
+					child.Namespace = e.Name()
+				case 1:
+					child.Name = e.Name()
+				case 2:
+					child.Provider = e.Name()
+				}
+				next = append(next, child)
+			}
+		}
+		mods = next
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		a, b := mods[i], mods[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Provider < b.Provider
+	})
+	return mods, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// testModuleTree returns a backend of namespaces × names × providers modules below root, and the modules in walk order
+func testModuleTree(root string, namespaces, names, providers int) (fstest.MapFS, []Module) {
+	fsys := fstest.MapFS{}
+	var mods []Module
+	for n := 0; n < namespaces; n++ {
+		for m := 0; m < names; m++ {
+			for p := 0; p < providers; p++ {
+				mod := Module{Namespace: fmt.Sprintf("ns%02d", n), Name: fmt.Sprintf("mod%02d", m), Provider: fmt.Sprintf("p%02d", p)}
+				mods = append(mods, mod)
+				fsys[root+mod.Namespace+"/"+mod.Name+"/"+mod.Provider+"/1.0.0/"+mod.Name+".tgz"] = testFile(nil)
+			}
+		}
+	}
+	return fsys, mods
+}
+
+// TestWalkModulesConcurrency walks the same tree at different concurrencies, run it with -race to check the merge
+func TestWalkModulesConcurrency(t *testing.T) {
+	fsys, want := testModuleTree("pre/", 12, 8, 3)
+	// The providers directory isn't a namespace
+	fsys["pre/providers/acme/foo/1.0.0/x.zip"] = testFile(nil)
+	for _, concurrency := range []int{0, 1, 2, 7, 64} {
+		for run := 0; run < 3; run++ {
+			got, err := walkModules(fsys, "pre", concurrency, nil)
+			if err != nil {
+				t.Fatalf("concurrency %d: %s", concurrency, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("concurrency %d, run %d: walked %d modules, want %d in order", concurrency, run, len(got), len(want))
+			}
+		}
+	}
+}
+
+// listingClock records when each directory listing of a backend starts
+type listingClock struct {
+	fs.ReadDirFS
+
+	mu     sync.Mutex
+	starts []time.Time
+}
+
+func (c *listingClock) ReadDir(name string) ([]fs.DirEntry, error) {
+	c.mu.Lock()
+	c.starts = append(c.starts, time.Now())
+	c.mu.Unlock()
+	return c.ReadDirFS.ReadDir(name)
+}
+
+func TestWalkModulesPacing(t *testing.T) {
+	tree, want := testModuleTree("", 3, 2, 1)
+	const delay = 10 * time.Millisecond
+	for _, concurrency := range []int{1, 4} {
+		fsys := &listingClock{ReadDirFS: tree}
+		got, err := walkModules(fsys, ".", concurrency, &listPacer{delay: delay})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("concurrency %d: walked %v, want %v", concurrency, got, want)
+		}
+		// Listings are spaced out by the delay however many are in flight, so n listings span at least n-1 delays
+		sort.Slice(fsys.starts, func(i, j int) bool { return fsys.starts[i].Before(fsys.starts[j]) })
+		n := len(fsys.starts)
+		if span := fsys.starts[n-1].Sub(fsys.starts[0]); span < time.Duration(n-1)*delay {
+			t.Errorf("concurrency %d: %d listings in %s, want them at least %s apart", concurrency, n, span, delay)
+		}
+	}
+}
+
+func TestListPacerBackoff(t *testing.T) {
+	throttled := awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), http.StatusServiceUnavailable, "req")
+	p := &listPacer{delay: time.Millisecond}
+	var backoffs []time.Duration
+	for i := 0; i < 7; i++ {
+		p.observe(throttled)
+		backoffs = append(backoffs, p.backoff)
+	}
+	want := []time.Duration{time.Second, 3 * time.Second, 7 * time.Second, 15 * time.Second, maxThrottleBackoff, maxThrottleBackoff, maxThrottleBackoff}
+	if !reflect.DeepEqual(backoffs, want) {
+		t.Errorf("backoff while throttled %v, want %v", backoffs, want)
+	}
+	// Other errors leave the backoff alone, successful listings wind it down
+	p.observe(fs.ErrNotExist)
+	if p.backoff != maxThrottleBackoff {
+		t.Errorf("backoff after a missing directory %s, want %s", p.backoff, maxThrottleBackoff)
+	}
+	p.observe(nil)
+	if p.backoff != maxThrottleBackoff/2 {
+		t.Errorf("backoff after a listing %s, want %s", p.backoff, maxThrottleBackoff/2)
+	}
+	for i := 0; i < 64; i++ {
+		p.observe(nil)
+	}
+	if p.backoff != 0 {
+		t.Errorf("backoff after the throttling stopped %s, want 0", p.backoff)
+	}
+	// The next listing is due after the delay plus the current backoff
+	p.next = time.Time{}
+	start := time.Now()
+	p.wait()
+	if due := p.next.Sub(start); due < p.delay {
+		t.Errorf("next listing due in %s, want at least %s", due, p.delay)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	got, err := fanOut(context.Background(), items, 4, func(i int) int {
+		mu.Lock()
+		inFlight++
+		most = max(most, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		// finish out of order
+		time.Sleep(time.Duration(len(items)-i) * 10 * time.Microsecond)
+		return i * i
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range got {
+		if r != i*i {
+			t.Fatalf("result %d is %d, want %d: results aren't in the order of their items", i, r, i*i)
+		}
+	}
+	if most > 4 {
+		t.Errorf("%d calls in flight, want at most 4", most)
+	}
+
+	// Once the context is done no more calls are started
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	_, err = fanOut(ctx, items, 2, func(i int) int {
+		if calls.Add(1) == 3 {
+			cancel()
+		}
+		return i
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: error %v, want %v", err, context.Canceled)
+	}
+	if n := calls.Load(); n > 5 {
+		t.Errorf("cancelled: %d calls made, want the ones started before the cancellation", n)
+	}
+}
+
+// slowFS is a backend whose directory listings take latency, like listing an s3 prefix does
+type slowFS struct {
+	fs.ReadDirFS
+	latency time.Duration
+}
+
+func (s slowFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	time.Sleep(s.latency)
+	return s.ReadDirFS.ReadDir(name)
+}
+
+// BenchmarkFanOut lists the version directories of every module of a namespace, one after another and concurrently
+func BenchmarkFanOut(b *testing.B) {
+	tree, mods := testModuleTree("", 1, 32, 2)
+	fsys := slowFS{ReadDirFS: tree, latency: time.Millisecond}
+	for _, c := range []struct {
+		name        string
+		concurrency int
+	}{
+		{"sequential", 1},
+		{"parallel", 8},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := fanOut(context.Background(), mods, c.concurrency, func(m Module) error {
+					_, err := fs.ReadDir(fsys, m.Namespace+"/"+m.Name+"/"+m.Provider)
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
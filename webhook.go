@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Webhook events sent for modules
+const (
+	// EventDownload is sent for every module download
+	EventDownload = "download"
+	// EventPublish is sent for every module version published, once its archive and checksum are written
+	EventPublish = "publish"
+)
+
+const (
+	// webhookQueueSize bounds the events waiting for delivery, events beyond it are dropped rather than blocking requests
+	webhookQueueSize = 256
+	// webhookAttempts is how many times delivery of an event is attempted
+	webhookAttempts = 5
+	// webhookSignatureHeader carries the hex HMAC-SHA256 of the payload, keyed with -webhook-secret
+	webhookSignatureHeader = "X-TF-Registry-Signature"
+)
+
+// WebhookEvent is our webhook payload struct
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Provider  string    `json:"provider"`
+	Version   string    `json:"version"`
+	Checksum  string    `json:"checksum,omitempty"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// webhookSender delivers events to a webhook url from a background goroutine, retrying failed deliveries with backoff
+type webhookSender struct {
+	url    string
+	secret string
+	client *http.Client
+	queue  chan WebhookEvent
+	// backoff is the delay before the first retry, doubled for every further retry
+	backoff time.Duration
+}
+
+// newWebhookSender returns a sender for url and starts its delivery goroutine
+func newWebhookSender(url string, secret string) *webhookSender {
+	s := &webhookSender{
+		url:     url,
+		secret:  secret,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan WebhookEvent, webhookQueueSize),
+		backoff: time.Second,
+	}
+	go s.run()
+	return s
+}
+
+// send queues an event for delivery without blocking, events are dropped if the queue is full.
+// A nil sender, i.e. webhooks not configured, drops every event
+func (s *webhookSender) send(ev WebhookEvent) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		logger.Warn("webhook queue full, dropping event", slog.String("event", ev.Event), slog.String("request_id", ev.RequestID))
+	}
+}
+
+// run delivers queued events one at a time
+func (s *webhookSender) run() {
+	for ev := range s.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		delay := s.backoff
+		for attempt := 1; ; attempt++ {
+			err = s.deliver(body)
+			if err == nil || attempt == webhookAttempts {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err != nil {
+			logger.Error("webhook delivery failed", slog.String("event", ev.Event), slog.String("request_id", ev.RequestID), slog.Any("error", err))
+		}
+	}
+}
+
+// deliver posts a single payload, any non 2xx response is an error
+func (s *webhookSender) deliver(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(s.secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the hex HMAC-SHA256 of body keyed with secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyDownloads is a middleware sending a download event to s for every successfully served download,
+// events are queued after the response has been written so delivery never holds up the request.
+// A download resumed or fetched in parts is only counted once, for the range starting at its first byte
+func notifyDownloads(s *webhookSender) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			m, _, ok := parseDownloadPath(r.URL.Path)
+			if !ok || r.Method != http.MethodGet {
+				return
+			}
+			status := ww.Status()
+			if status == http.StatusOK || status == http.StatusFound || (status == http.StatusPartialContent && rangeFromStart(r.Header.Get("Range"))) {
+				s.send(WebhookEvent{
+					Event:     EventDownload,
+					Namespace: m.Namespace,
+					Name:      m.Name,
+					Provider:  m.Provider,
+					Version:   m.Version,
+					Time:      time.Now().UTC(),
+					RequestID: middleware.GetReqID(r.Context()),
+				})
+			}
+		})
+	}
+}
+
+// rangeFromStart reports whether a Range header's first range starts at byte 0
+func rangeFromStart(h string) bool {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok {
+		return false
+	}
+	first, _, _ := strings.Cut(spec, ",")
+	start, _, ok := strings.Cut(strings.TrimSpace(first), "-")
+	return ok && strings.TrimSpace(start) == "0"
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhookDelivery is a payload received by a test webhook
+type webhookDelivery struct {
+	body      []byte
+	signature string
+}
+
+// testWebhook starts a webhook endpoint, returning a sender delivering to it and the payloads it receives
+func testWebhook(t *testing.T, secret string) (*webhookSender, <-chan webhookDelivery) {
+	t.Helper()
+	received := make(chan webhookDelivery, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- webhookDelivery{body: body, signature: r.Header.Get(webhookSignatureHeader)}
+	}))
+	t.Cleanup(srv.Close)
+	s := newWebhookSender(srv.URL, secret)
+	t.Cleanup(func() { close(s.queue) })
+	return s, received
+}
+
+func TestDownloadWebhook(t *testing.T) {
+	const secret = "hook-s3cret"
+	s, received := testWebhook(t, secret)
+	setGlobal(t, &webhookURL, "http://hooks.example.com")
+	setGlobal(t, &webhooks, s)
+	h := newTestRegistry(t, testLayout(t))
+	next := func() WebhookEvent {
+		t.Helper()
+		select {
+		case d := <-received:
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(d.body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.signature != want {
+				t.Errorf("signature %q, want %q", d.signature, want)
+			}
+			var ev WebhookEvent
+			if err := json.Unmarshal(d.body, &ev); err != nil {
+				t.Fatal(err)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no webhook delivered")
+			return WebhookEvent{}
+		}
+	}
+
+	before := time.Now().UTC()
+	w := serve(h, http.MethodGet, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	ev := next()
+	if ev.Event != EventDownload || ev.Namespace != "acme" || ev.Name != "vpc" || ev.Provider != "aws" || ev.Version != "1.0.0" || ev.Checksum != "" {
+		t.Errorf("event %+v, want a download of acme/vpc/aws 1.0.0", ev)
+	}
+	if ev.Time.Before(before.Add(-time.Second)) || ev.Time.After(time.Now().Add(time.Second)) {
+		t.Errorf("event time %s, want the time of the download", ev.Time)
+	}
+	if ev.RequestID == "" || ev.RequestID != w.Header().Get("X-Correlation-ID") {
+		t.Errorf("event request id %q, want the download's %q", ev.RequestID, w.Header().Get("X-Correlation-ID"))
+	}
+
+	// A range from the first byte counts as a download, later ranges, failures and HEADs of the same download don't
+	for _, c := range []struct {
+		version, rng string
+		want         int
+	}{
+		{"1.2.0", "bytes=0-9", http.StatusPartialContent},
+		{"1.0.0", "bytes=10-", http.StatusPartialContent},
+		{"1.0.0", "bytes=-10", http.StatusPartialContent},
+		{"9.9.9", "", http.StatusNotFound},
+	} {
+		if w := serve(h, http.MethodGet, "/download/acme/vpc/aws/"+c.version+"/vpc.tgz", nil, "Range", c.rng); w.Code != c.want {
+			t.Fatalf("%s %s: status %d, want %d", c.version, c.rng, w.Code, c.want)
+		}
+	}
+	serve(h, http.MethodHead, "/download/acme/vpc/aws/1.0.0/vpc.tgz", nil)
+	serve(h, http.MethodGet, "/download/acme/vpc/aws/10.0.0/vpc.tgz", nil)
+	// events are delivered in order, so only the first byte range and the last download come through
+	if ev := next(); ev.Version != "1.2.0" {
+		t.Errorf("event for %s, want the range from the first byte of 1.2.0", ev.Version)
+	}
+	if ev := next(); ev.Version != "10.0.0" {
+		t.Errorf("event for %s, want the download of 10.0.0 next", ev.Version)
+	}
+}
+
+func TestRangeFromStart(t *testing.T) {
+	for h, want := range map[string]bool{
+		"bytes=0-":         true,
+		"bytes=0-99":       true,
+		"bytes= 0-99,200-": true,
+		"bytes=100-":       false,
+		"bytes=-100":       false,
+		"bytes=100-,0-9":   false,
+		"items=0-9":        false,
+		"":                 false,
+	} {
+		if got := rangeFromStart(h); got != want {
+			t.Errorf("%q: %t, want %t", h, got, want)
+		}
+	}
+}